@@ -0,0 +1,262 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package conf parses configuration files in the INI format of wg setconf
+// and wg-quick into device configurations.
+package conf
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// A ParseError reports an invalid line of a configuration file.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// wgQuickKeys are the keys of wg-quick, which are not device settings.
+var wgQuickKeys = map[string]bool{
+	"address":    true,
+	"dns":        true,
+	"mtu":        true,
+	"table":      true,
+	"preup":      true,
+	"postup":     true,
+	"predown":    true,
+	"postdown":   true,
+	"saveconfig": true,
+}
+
+// Load parses the configuration file at path.
+func Load(path string) (*device.DeviceConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Parse parses a configuration file with an [Interface] section and
+// [Peer] sections. Endpoint hostnames are left for the device to resolve,
+// as the EndpointHost of their peers. The keys of wg-quick that do not
+// configure the device, such as Address, are ignored.
+func Parse(r io.Reader) (*device.DeviceConfig, error) {
+	config := new(device.DeviceConfig)
+	var peer *device.PeerConfig
+	var section string
+	var peerLine int
+	seen := make(map[device.NoisePublicKey]int)
+
+	endPeer := func() error {
+		if peer == nil {
+			return nil
+		}
+		if peer.PublicKey.IsZero() {
+			return &ParseError{peerLine, errors.New("peer section without PublicKey")}
+		}
+		if line, ok := seen[peer.PublicKey]; ok {
+			return &ParseError{peerLine, fmt.Errorf("duplicate peer of line %d", line)}
+		}
+		seen[peer.PublicKey] = peerLine
+		config.Peers = append(config.Peers, *peer)
+		peer = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fail := func(format string, args ...any) error {
+			return &ParseError{lineNumber, fmt.Errorf(format, args...)}
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if err := endPeer(); err != nil {
+				return nil, err
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				peer = new(device.PeerConfig)
+				peerLine = lineNumber
+			default:
+				return nil, fail("unknown section %s", line)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fail("expected key = value")
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section {
+		case "interface":
+			err = parseInterfaceKey(config, key, value)
+		case "peer":
+			err = parsePeerKey(peer, key, value)
+		default:
+			err = errors.New("key outside of a section")
+		}
+		if err != nil {
+			return nil, fail("%s: %w", key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := endPeer(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func parseInterfaceKey(config *device.DeviceConfig, key, value string) error {
+	switch key {
+	case "privatekey":
+		raw, err := parseKey(value)
+		if err != nil {
+			return err
+		}
+		var sk device.NoisePrivateKey
+		if err := sk.FromMaybeZeroHex(hex.EncodeToString(raw[:])); err != nil {
+			return err
+		}
+		config.PrivateKey = &sk
+	case "listenport":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", value)
+		}
+		config.ListenPort = new(uint16)
+		*config.ListenPort = uint16(port)
+	case "fwmark":
+		var mark uint64
+		if value != "off" {
+			var err error
+			mark, err = strconv.ParseUint(value, 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid mark %q", value)
+			}
+		}
+		config.FirewallMark = new(uint32)
+		*config.FirewallMark = uint32(mark)
+	default:
+		if !wgQuickKeys[key] {
+			return errors.New("unknown key")
+		}
+	}
+	return nil
+}
+
+func parsePeerKey(peer *device.PeerConfig, key, value string) error {
+	switch key {
+	case "publickey":
+		raw, err := parseKey(value)
+		if err != nil {
+			return err
+		}
+		peer.PublicKey = device.NoisePublicKey(raw)
+	case "presharedkey":
+		raw, err := parseKey(value)
+		if err != nil {
+			return err
+		}
+		psk := device.NoisePresharedKey(raw)
+		peer.PresharedKey = &psk
+	case "allowedips":
+		for _, s := range strings.Split(value, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				// A bare address is a prefix of its own length.
+				addr, err := netip.ParseAddr(s)
+				if err != nil {
+					return fmt.Errorf("invalid prefix %q", s)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, prefix)
+		}
+	case "endpoint":
+		host, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return err
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", port)
+		}
+		if addr, err := netip.ParseAddr(host); err == nil {
+			peer.Endpoint = netip.AddrPortFrom(addr.Unmap(), uint16(p)).String()
+		} else if host != "" && p != 0 {
+			peer.EndpointHost = net.JoinHostPort(host, port)
+		} else {
+			return fmt.Errorf("invalid endpoint %q", value)
+		}
+	case "persistentkeepalive":
+		var secs uint64
+		if value != "off" {
+			var err error
+			secs, err = strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid interval %q", value)
+			}
+		}
+		peer.PersistentKeepaliveInterval = new(uint16)
+		*peer.PersistentKeepaliveInterval = uint16(secs)
+	default:
+		return errors.New("unknown key")
+	}
+	return nil
+}
+
+// parseKey decodes a base64 key.
+func parseKey(value string) ([32]byte, error) {
+	var key [32]byte
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(raw) != len(key) {
+		return key, errors.New("invalid key, expected 32 bytes in base64")
+	}
+	copy(key[:], raw)
+	return key, nil
+}
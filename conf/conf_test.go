@@ -0,0 +1,217 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func testKey(b byte) string {
+	var key [32]byte
+	key[0] = b
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+func parse(text string) (*device.DeviceConfig, error) {
+	return Parse(strings.NewReader(text))
+}
+
+func TestParse(t *testing.T) {
+	config, err := parse(`
+# A comment
+[Interface]
+PrivateKey = ` + testKey(0xff) + `
+ListenPort = 51820
+FwMark = 0x1234
+Address = 10.0.0.1/24 # wg-quick only
+DNS = 10.0.0.53
+
+[Peer]
+PublicKey = ` + testKey(1) + `
+PresharedKey = ` + testKey(2) + `
+AllowedIPs = 10.0.0.2/32, fd00::/64,10.1.0.1
+Endpoint = vpn.example.com:51820
+PersistentKeepalive = 25
+
+[peer]
+publickey = ` + testKey(3) + `
+endpoint = [2001:db8::2]:443
+persistentkeepalive = off
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.PrivateKey == nil || config.PrivateKey[0] != 0xf8 {
+		t.Errorf("private key %v not clamped", config.PrivateKey)
+	}
+	if *config.ListenPort != 51820 || *config.FirewallMark != 0x1234 {
+		t.Errorf("port %d, mark %#x", *config.ListenPort, *config.FirewallMark)
+	}
+	if len(config.Peers) != 2 {
+		t.Fatalf("got %d peers, want 2", len(config.Peers))
+	}
+	peer := config.Peers[0]
+	if peer.PublicKey[0] != 1 || peer.PresharedKey[0] != 2 {
+		t.Errorf("peer keys %v %v", peer.PublicKey, peer.PresharedKey)
+	}
+	wantIPs := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.2/32"),
+		netip.MustParsePrefix("fd00::/64"),
+		netip.MustParsePrefix("10.1.0.1/32"),
+	}
+	if !reflect.DeepEqual(peer.AllowedIPs, wantIPs) {
+		t.Errorf("allowed IPs %v, want %v", peer.AllowedIPs, wantIPs)
+	}
+	if peer.Endpoint != "" || peer.EndpointHost != "vpn.example.com:51820" {
+		t.Errorf("endpoint %q, host %q, want the hostname left to the device", peer.Endpoint, peer.EndpointHost)
+	}
+	if *peer.PersistentKeepaliveInterval != 25 {
+		t.Errorf("keepalive %d", *peer.PersistentKeepaliveInterval)
+	}
+	peer = config.Peers[1]
+	if peer.Endpoint != "[2001:db8::2]:443" || *peer.PersistentKeepaliveInterval != 0 {
+		t.Errorf("second peer %+v", peer)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		line int
+	}{
+		{"[Interface]\nPrivateKey = abc\n", 2},
+		{"[Interface]\n\nListenPort = 65536\n", 3},
+		{"ListenPort = 1\n", 1},
+		{"[Interface]\nPublicKey = " + testKey(1) + "\n", 2},
+		{"[Peer]\nAllowedIPs = 10.0.0.0/8\n", 1},
+		{"[Peer]\nPublicKey = " + testKey(1) + "\n[Peer]\nPublicKey = " + testKey(1) + "\n", 3},
+		{"[Peer]\nPublicKey = " + testKey(1) + "\nEndpoint = vpn.example.com:0\n", 3},
+		{"[Peer]\nPublicKey = " + testKey(1) + "\nEndpoint = vpn.example.com\n", 3},
+		{"[Peer]\nPublicKey = " + testKey(1) + "\nAllowedIPs = 10.0.0.0/33\n", 3},
+		{"[Interface]\nListenPort\n", 2},
+		{"[Device]\n", 1},
+	} {
+		_, err := parse(test.text)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("%q: got error %v, want a ParseError", test.text, err)
+			continue
+		}
+		if parseErr.Line != test.line {
+			t.Errorf("%q: error %v on line %d, want line %d", test.text, err, parseErr.Line, test.line)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	running, err := parse(`
+[Interface]
+PrivateKey = ` + testKey(0x40) + `
+ListenPort = 51820
+
+[Peer]
+PublicKey = ` + testKey(1) + `
+AllowedIPs = 10.0.0.1/32, 10.0.1.0/24
+Endpoint = 192.0.2.1:51820
+
+[Peer]
+PublicKey = ` + testKey(2) + `
+AllowedIPs = 10.0.0.2/32
+
+[Peer]
+PublicKey = ` + testKey(3) + `
+AllowedIPs = 10.0.0.3/32
+PersistentKeepalive = 25
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := parse(`
+[Interface]
+PrivateKey = ` + testKey(0x40) + `
+ListenPort = 51821
+
+[Peer]
+PublicKey = ` + testKey(1) + `
+AllowedIPs = 10.0.1.0/24, 10.0.0.1/32
+Endpoint = 192.0.2.1:51820
+
+[Peer]
+PublicKey = ` + testKey(3) + `
+AllowedIPs = 10.0.0.4/32
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = ` + testKey(4) + `
+AllowedIPs = 10.0.0.5/32
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := Sync(running, running, target)
+	if changes.PrivateKey != nil || changes.ListenPort == nil || *changes.ListenPort != 51821 {
+		t.Errorf("device changes: private key %v, port %v", changes.PrivateKey, changes.ListenPort)
+	}
+	want := []device.PeerConfig{
+		{
+			PublicKey:         target.Peers[1].PublicKey,
+			UpdateOnly:        true,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        target.Peers[1].AllowedIPs,
+		},
+		target.Peers[2],
+		{PublicKey: running.Peers[1].PublicKey, Remove: true},
+	}
+	if !reflect.DeepEqual(changes.Peers, want) {
+		t.Errorf("peer changes %+v, want %+v", changes.Peers, want)
+	}
+
+	if changes := Sync(target, target, target); changes.ListenPort != nil || len(changes.Peers) != 0 {
+		t.Errorf("syncing a configuration with itself gave %+v", changes)
+	}
+}
+
+func TestSyncEndpoints(t *testing.T) {
+	file := func(endpoint string) *device.DeviceConfig {
+		t.Helper()
+		config, err := parse("[Peer]\nPublicKey = " + testKey(1) + "\nEndpoint = " + endpoint + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	last := file("192.0.2.1:51820")
+	running := file("198.51.100.7:40000") // roamed
+	for _, test := range []struct {
+		last, target *device.DeviceConfig
+		endpoint     string
+		host         string
+	}{
+		{last, file("192.0.2.1:51820"), "", ""},
+		{nil, file("192.0.2.1:51820"), "192.0.2.1:51820", ""},
+		{last, file("192.0.2.2:51820"), "192.0.2.2:51820", ""},
+		{last, file("vpn.example.com:51820"), "", "vpn.example.com:51820"},
+		{file("vpn.example.com:51820"), file("vpn.example.com:51820"), "", ""},
+	} {
+		var endpoint, host string
+		if changes := Sync(running, test.last, test.target); len(changes.Peers) != 0 {
+			endpoint, host = changes.Peers[0].Endpoint, changes.Peers[0].EndpointHost
+		}
+		if endpoint != test.endpoint || host != test.host {
+			t.Errorf("syncing to %q: endpoint %q, host %q, want %q, %q",
+				test.target.Peers[0].Endpoint+test.target.Peers[0].EndpointHost, endpoint, host, test.endpoint, test.host)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"net/netip"
+	"sort"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// Sync returns the changes that bring a device configured as running to
+// target. Peers missing from target are removed, new peers are added, and
+// existing peers are updated in place, so that their sessions survive a
+// reload that does not change them. last is the target of the previous Sync,
+// or nil: the endpoint of a peer is only set when it differs from last, so
+// that reloading a file does not undo the roaming of its peers.
+func Sync(running, last, target *device.DeviceConfig) *device.DeviceConfig {
+	changes := new(device.DeviceConfig)
+	if target.PrivateKey != nil && (running.PrivateKey == nil || *running.PrivateKey != *target.PrivateKey) {
+		changes.PrivateKey = target.PrivateKey
+	}
+	if target.ListenPort != nil && (running.ListenPort == nil || *running.ListenPort != *target.ListenPort) {
+		changes.ListenPort = target.ListenPort
+	}
+	if target.FirewallMark != nil && *target.FirewallMark != valueOf(running.FirewallMark) {
+		changes.FirewallMark = target.FirewallMark
+	}
+
+	current := make(map[device.NoisePublicKey]*device.PeerConfig, len(running.Peers))
+	for i := range running.Peers {
+		current[running.Peers[i].PublicKey] = &running.Peers[i]
+	}
+	loaded := make(map[device.NoisePublicKey]*device.PeerConfig)
+	if last != nil {
+		for i := range last.Peers {
+			loaded[last.Peers[i].PublicKey] = &last.Peers[i]
+		}
+	}
+	for i := range target.Peers {
+		want := &target.Peers[i]
+		have := current[want.PublicKey]
+		delete(current, want.PublicKey)
+		if have == nil {
+			changes.Peers = append(changes.Peers, *want)
+			continue
+		}
+		if change, ok := syncPeer(have, loaded[want.PublicKey], want); ok {
+			changes.Peers = append(changes.Peers, change)
+		}
+	}
+
+	// Remove the peers in a stable order.
+	var removed []device.PeerConfig
+	for key := range current {
+		removed = append(removed, device.PeerConfig{PublicKey: key, Remove: true})
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		return string(removed[i].PublicKey[:]) < string(removed[j].PublicKey[:])
+	})
+	changes.Peers = append(changes.Peers, removed...)
+	return changes
+}
+
+// syncPeer returns the changes that bring have to want, if there are any.
+// The endpoint is only changed when want has another one than last, if any.
+func syncPeer(have, last, want *device.PeerConfig) (device.PeerConfig, bool) {
+	change := device.PeerConfig{PublicKey: want.PublicKey, UpdateOnly: true}
+	changed := false
+	var zeroKey device.NoisePresharedKey
+	if valueOr(want.PresharedKey, zeroKey) != valueOr(have.PresharedKey, zeroKey) {
+		psk := valueOr(want.PresharedKey, zeroKey)
+		change.PresharedKey = &psk
+		changed = true
+	}
+	if last == nil {
+		last = new(device.PeerConfig)
+	}
+	if (want.Endpoint != "" || want.EndpointHost != "") &&
+		(want.Endpoint != last.Endpoint || want.EndpointHost != last.EndpointHost) {
+		change.Endpoint = want.Endpoint
+		change.EndpointHost = want.EndpointHost
+		changed = true
+	}
+	if valueOf(want.PersistentKeepaliveInterval) != valueOf(have.PersistentKeepaliveInterval) {
+		interval := valueOf(want.PersistentKeepaliveInterval)
+		change.PersistentKeepaliveInterval = &interval
+		changed = true
+	}
+	if !samePrefixes(want.AllowedIPs, have.AllowedIPs) {
+		change.ReplaceAllowedIPs = true
+		change.AllowedIPs = want.AllowedIPs
+		changed = true
+	}
+	return change, changed
+}
+
+func valueOf[T any](p *T) T {
+	var zero T
+	return valueOr(p, zero)
+}
+
+func valueOr[T any](p *T, def T) T {
+	if p == nil {
+		return def
+	}
+	return *p
+}
+
+// samePrefixes reports whether a and b hold the same set of prefixes.
+func samePrefixes(a, b []netip.Prefix) bool {
+	set := make(map[netip.Prefix]bool, len(a))
+	for _, prefix := range a {
+		set[prefix.Masked()] = true
+	}
+	other := make(map[netip.Prefix]bool, len(b))
+	for _, prefix := range b {
+		prefix = prefix.Masked()
+		if !set[prefix] {
+			return false
+		}
+		other[prefix] = true
+	}
+	return len(other) == len(set)
+}
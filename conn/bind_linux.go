@@ -281,6 +281,16 @@ func (end *LinuxSocketEndpoint) DstIP() netip.Addr {
 	}
 }
 
+func (end *LinuxSocketEndpoint) DstAddrPort() netip.AddrPort {
+	var port int
+	if !end.isV6 {
+		port = end.dst4().Port
+	} else {
+		port = end.dst6().Port
+	}
+	return netip.AddrPortFrom(end.DstIP(), uint16(port))
+}
+
 func (end *LinuxSocketEndpoint) DstToBytes() []byte {
 	if !end.isV6 {
 		return (*[unsafe.Offsetof(end.dst4().Addr) + unsafe.Sizeof(end.dst4().Addr)]byte)(unsafe.Pointer(end.dst4()))[:]
@@ -294,13 +304,7 @@ func (end *LinuxSocketEndpoint) SrcToString() string {
 }
 
 func (end *LinuxSocketEndpoint) DstToString() string {
-	var port int
-	if !end.isV6 {
-		port = end.dst4().Port
-	} else {
-		port = end.dst6().Port
-	}
-	return netip.AddrPortFrom(end.DstIP(), uint16(port)).String()
+	return end.DstAddrPort().String()
 }
 
 func (end *LinuxSocketEndpoint) ClearDst() {
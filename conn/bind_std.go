@@ -26,12 +26,17 @@ type StdNetBind struct {
 	blackhole6 bool
 
 	protectSocket func(fd int) int
+	errorChan     chan<- error // only passed on by Hooks
 }
 
 func NewStdNetBind(protectSocket func(fd int) int) Bind {
 	return &StdNetBind{protectSocket: protectSocket}
 }
 
+func (bind *StdNetBind) Hooks() (chan<- error, func(fd int) int) {
+	return bind.errorChan, bind.protectSocket
+}
+
 type StdNetEndpoint netip.AddrPort
 
 var (
@@ -41,7 +46,10 @@ var (
 
 func (*StdNetBind) ParseEndpoint(s string) (Endpoint, error) {
 	e, err := netip.ParseAddrPort(s)
-	return asEndpoint(e), err
+	if err != nil {
+		return nil, err
+	}
+	return asEndpoint(e), nil
 }
 
 func (StdNetEndpoint) ClearSrc() {}
@@ -54,6 +62,10 @@ func (e StdNetEndpoint) SrcIP() netip.Addr {
 	return netip.Addr{} // not supported
 }
 
+func (e StdNetEndpoint) DstAddrPort() netip.AddrPort {
+	return netip.AddrPort(e)
+}
+
 func (e StdNetEndpoint) DstToBytes() []byte {
 	b, _ := (netip.AddrPort)(e).MarshalBinary()
 	return b
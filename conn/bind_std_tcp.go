@@ -27,26 +27,61 @@ import (
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-	"sync/atomic"
 
 	tls "github.com/refraction-networking/utls"
 )
 
-var lastErrorTimestamp time.Time
-
 var nextHelloIdx atomic.Int32
-var hellos = []tls.ClientHelloID {
+var hellos = []tls.ClientHelloID{
 	tls.HelloChrome_Auto,
 	tls.HelloChrome_120_PQ,
 	tls.HelloChrome_115_PQ,
 }
 
+// TLSFingerprints are the ClientHello fingerprints the TLS transport can mimic.
+var TLSFingerprints = []string{"chrome_auto", "chrome_120_pq", "chrome_115_pq"}
+
+// TLSOptions configure the TLS transport.
+type TLSOptions struct {
+	// ServerName is the name sent in the TLS handshake; a random one when empty.
+	ServerName string
+
+	// Fingerprint is one of TLSFingerprints. When empty, the transport moves
+	// on to the next fingerprint after a failed handshake.
+	Fingerprint string
+}
+
+// Validate reports whether the options are valid.
+func (options TLSOptions) Validate() error {
+	if options.Fingerprint == "" {
+		return nil
+	}
+	for _, name := range TLSFingerprints {
+		if name == options.Fingerprint {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown TLS fingerprint %q", options.Fingerprint)
+}
+
+// hello returns the ClientHello to send.
+func (options TLSOptions) hello() tls.ClientHelloID {
+	for i, name := range TLSFingerprints {
+		if name == options.Fingerprint {
+			return hellos[i]
+		}
+	}
+	return hellos[nextHelloIdx.Load()]
+}
+
 type StdNetBindTcp struct {
 	mu sync.Mutex
 
 	useTls        bool
+	tlsOptions    TLSOptions
 	tcp           *net.TCPConn
 	tls           *tls.UConn
 	endpoint      *StdNetEndpoint
@@ -55,25 +90,61 @@ type StdNetBindTcp struct {
 	log           *Logger
 	errorChan     chan<- error
 	protectSocket func(fd int) int
+	errorLimiter  *LogLimiter
 
 	tunsafe *TunSafeData
 }
 
 //goland:noinspection GoUnusedExportedFunction
 func CreateStdNetBind(socketType string, log *Logger, errorChan chan<- error, protectSocket func(fd int) int) Bind {
+	return CreateStdNetBindWithOptions(socketType, TLSOptions{}, log, errorChan, protectSocket)
+}
+
+// CreateStdNetBindWithOptions is CreateStdNetBind with options for the TLS
+// transport. Socket errors are not reported when errorChan is nil, and
+// sockets are not protected when protectSocket is nil.
+func CreateStdNetBindWithOptions(socketType string, tlsOptions TLSOptions, log *Logger, errorChan chan<- error, protectSocket func(fd int) int) Bind {
+	if protectSocket == nil {
+		protectSocket = func(int) int { return 0 }
+	}
 	if socketType == "udp" {
-		return NewStdNetBind(protectSocket)
+		return &StdNetBind{protectSocket: protectSocket, errorChan: errorChan}
 	} else {
-		return &StdNetBindTcp{tunsafe: NewTunSafeData(), useTls: socketType == "tls", log: log, errorChan: errorChan, protectSocket: protectSocket}
+		return &StdNetBindTcp{
+			tunsafe:       NewTunSafeData(),
+			useTls:        socketType == "tls",
+			tlsOptions:    tlsOptions,
+			log:           log,
+			errorChan:     errorChan,
+			protectSocket: protectSocket,
+			errorLimiter:  NewLogLimiter(5 * time.Second),
+		}
 	}
 }
 
+func (bind *StdNetBindTcp) Hooks() (chan<- error, func(fd int) int) {
+	return bind.errorChan, bind.protectSocket
+}
+
+func (bind *StdNetBindTcp) Transport() string {
+	if bind.useTls {
+		return "tls"
+	}
+	return "tcp"
+}
+
+// TLSOptions returns the options of the TLS transport.
+func (bind *StdNetBindTcp) TLSOptions() TLSOptions {
+	return bind.tlsOptions
+}
+
 func (bind *StdNetBindTcp) ParseEndpoint(s string) (Endpoint, error) {
 	e, err := netip.ParseAddrPort(s)
-	if err == nil {
-		bind.endpoint = (*StdNetEndpoint)(&e)
+	if err != nil {
+		return nil, err
 	}
-	return asEndpoint(e), err
+	bind.endpoint = (*StdNetEndpoint)(&e)
+	return asEndpoint(e), nil
 }
 
 func dialTcp(addr string, protectSocket func(fd int) int) (*net.TCPConn, int, error) {
@@ -110,16 +181,24 @@ func dialTcp(addr string, protectSocket func(fd int) int) (*net.TCPConn, int, er
 }
 
 func (bind *StdNetBindTcp) upgradeToTls() error {
+	serverName := bind.tlsOptions.ServerName
+	if serverName == "" {
+		serverName = randomServerName()
+	}
 	tlsConf := &tls.Config{
 		InsecureSkipVerify: true,
-		ServerName:         randomServerName(),
+		ServerName:         serverName,
 	}
 
-	conn := tls.UClient(bind.tcp, tlsConf, hellos[nextHelloIdx.Load()])
+	conn := tls.UClient(bind.tcp, tlsConf, bind.tlsOptions.hello())
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	bind.log.Verbosef("TLS: Starting handshake")
+	bind.log.Log(SubsystemBind, LevelDebug, "Starting TLS handshake", TransportField("tls"), bind.endpointField())
 	err := conn.Handshake()
-	bind.log.Verbosef("TLS: Handshake result: %v", err)
+	if err != nil {
+		bind.log.Log(SubsystemBind, LevelWarn, "TLS handshake failed", TransportField("tls"), bind.endpointField(), ErrorField(err))
+	} else {
+		bind.log.Log(SubsystemBind, LevelDebug, "TLS handshake completed", TransportField("tls"), bind.endpointField())
+	}
 	conn.SetDeadline(time.Time{})
 
 	// On some devices (e.g. Samsung S21 FE) we see first WireGuard handshake failing on TLS socket and adding small
@@ -141,7 +220,7 @@ func (bind *StdNetBindTcp) Open(uport uint16) ([]ReceiveFunc, uint16, error) {
 	bind.mu.Lock()
 	defer bind.mu.Unlock()
 
-	bind.log.Verbosef("TCP/TLS: Open %d", uport)
+	bind.log.Log(SubsystemBind, LevelDebug, "Opening bind", TransportField(bind.Transport()))
 	bind.closed = false
 	return []ReceiveFunc{bind.makeReceiveFunc()}, uport, nil
 }
@@ -156,11 +235,12 @@ func (bind *StdNetBindTcp) initTcp() error {
 	var tcp *net.TCPConn
 
 	tcp, _, err = dialTcp(bind.endpoint.DstToString(), bind.protectSocket)
-	bind.log.Verbosef("TCP dial result: %v", err)
 	if err != nil {
+		bind.log.Log(SubsystemBind, LevelWarn, "TCP dial failed", TransportField(bind.Transport()), bind.endpointField(), ErrorField(err))
 		bind.onSocketError(err)
 		return err
 	}
+	bind.log.Log(SubsystemBind, LevelDebug, "TCP connected", TransportField(bind.Transport()), bind.endpointField())
 	bind.tcp = tcp
 	return nil
 }
@@ -169,7 +249,7 @@ func (bind *StdNetBindTcp) Close() error {
 	bind.mu.Lock()
 	defer bind.mu.Unlock()
 
-	bind.log.Verbosef("TCP/TLS: Close")
+	bind.log.Log(SubsystemBind, LevelDebug, "Closing bind", TransportField(bind.Transport()))
 	bind.closed = true
 	err := bind.closeInternal()
 	return err
@@ -289,6 +369,10 @@ func (bind *StdNetBindTcp) Send(buff []byte, endpoint Endpoint) error {
 		return errors.New("StdNetBindTcp.Send endpoints mismatch")
 	}
 
+	if len(buff) > tunSafeMaxPayloadSize {
+		return fmt.Errorf("StdNetBindTcp: packet of %d bytes exceeds TunSafe frame size", len(buff))
+	}
+
 	tunSafePacket := bind.tunsafe.wgToTunSafe(buff)
 	_, err = conn.Write(tunSafePacket)
 	if err != nil {
@@ -303,14 +387,26 @@ func (bind *StdNetBindTcp) SetMark(_ uint32) error {
 }
 
 func (bind *StdNetBindTcp) onSocketError(err error) {
-	if err != nil && !bind.closed {
+	if err != nil && !bind.closed && bind.errorChan != nil {
 		bind.errorChan <- err
 	}
 }
 
-func (bind *StdNetBindTcp) logError(t string, err error) {
-	if time.Now().After(lastErrorTimestamp.Add(5 * time.Second)) {
-		lastErrorTimestamp = time.Now()
-		bind.log.Errorf("TCP/TLS error %s: %v", t, err)
+func (bind *StdNetBindTcp) endpointField() Field {
+	if bind.endpoint == nil {
+		return EndpointField(nil)
+	}
+	return EndpointField(*bind.endpoint)
+}
+
+func (bind *StdNetBindTcp) logError(op string, err error) {
+	ok, suppressed := bind.errorLimiter.Allow()
+	if !ok {
+		return
+	}
+	fields := []Field{TransportField(bind.Transport()), bind.endpointField(), {"op", op}, ErrorField(err)}
+	if suppressed > 0 {
+		fields = append(fields, Field{KeySuppressed, suppressed})
 	}
+	bind.log.Log(SubsystemBind, LevelError, "Socket error", fields...)
 }
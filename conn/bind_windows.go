@@ -141,6 +141,14 @@ func (e *WinRingEndpoint) DstIP() netip.Addr {
 	return netip.Addr{}
 }
 
+func (e *WinRingEndpoint) DstAddrPort() netip.AddrPort {
+	switch e.family {
+	case windows.AF_INET, windows.AF_INET6:
+		return netip.AddrPortFrom(e.DstIP(), binary.BigEndian.Uint16(e.data[0:2]))
+	}
+	return netip.AddrPort{}
+}
+
 func (e *WinRingEndpoint) SrcIP() netip.Addr {
 	return netip.Addr{} // not supported
 }
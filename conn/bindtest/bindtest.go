@@ -65,6 +65,10 @@ func (c ChannelEndpoint) DstToBytes() []byte { return []byte{byte(c)} }
 
 func (c ChannelEndpoint) DstIP() netip.Addr { return netip.AddrFrom4([4]byte{127, 0, 0, 1}) }
 
+func (c ChannelEndpoint) DstAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(c.DstIP(), uint16(c))
+}
+
 func (c ChannelEndpoint) SrcIP() netip.Addr { return netip.Addr{} }
 
 func (c *ChannelBind) Open(port uint16) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
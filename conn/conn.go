@@ -45,11 +45,6 @@ type Bind interface {
 	ParseEndpoint(s string) (Endpoint, error)
 }
 
-type Logger struct {
-	Verbosef func(format string, args ...any)
-	Errorf   func(format string, args ...any)
-}
-
 // BindSocketToInterface is implemented by Bind objects that support being
 // tied to a single network interface. Used by wireguard-windows.
 type BindSocketToInterface interface {
@@ -64,6 +59,32 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// BindTransport is implemented by Bind objects that carry WireGuard over
+// something other than plain UDP. Used for logging and by the UAPI.
+type BindTransport interface {
+	Transport() string // "udp", "tcp" or "tls"
+}
+
+// BindTLS is implemented by Bind objects that carry WireGuard over TLS.
+type BindTLS interface {
+	TLSOptions() TLSOptions
+}
+
+// BindHooks is implemented by the binds of CreateStdNetBind, which return
+// the channel they report socket errors to and the function protecting
+// their sockets, so that binds replacing them can be created alike.
+type BindHooks interface {
+	Hooks() (errorChan chan<- error, protectSocket func(fd int) int)
+}
+
+// TransportOf returns the transport used by bind.
+func TransportOf(bind Bind) string {
+	if t, ok := bind.(BindTransport); ok {
+		return t.Transport()
+	}
+	return "udp"
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst: the remote address of a peer ("endpoint" in uapi terminology)
@@ -77,6 +98,13 @@ type Endpoint interface {
 	SrcIP() netip.Addr
 }
 
+// EndpointAddrPort is implemented by endpoints that can return their
+// destination without formatting it, which lets the receive path compare
+// endpoints without allocating.
+type EndpointAddrPort interface {
+	DstAddrPort() netip.AddrPort
+}
+
 var (
 	ErrBindAlreadyOpen   = errors.New("bind is already open")
 	ErrWrongEndpointType = errors.New("endpoint type does not correspond with bind type")
@@ -0,0 +1,304 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Logger provides logging for a Bind and the Device using it.
+//
+// Verbosef and Errorf are Printf-style functions.
+// They must be safe for concurrent use.
+// They do not require a trailing newline in the format.
+// If nil, that level of logging will be silent.
+//
+// Handler, if non-nil, receives the structured records written with Log.
+// Without a Handler, Log renders records as text through Verbosef and Errorf.
+type Logger struct {
+	Verbosef func(format string, args ...any)
+	Errorf   func(format string, args ...any)
+	Handler  LogHandler
+}
+
+// DiscardLogf is a Printf-style function that discards its lines.
+// Log does not render the records it would pass to it.
+func DiscardLogf(format string, args ...any) {}
+
+var discardLogf = reflect.ValueOf(DiscardLogf).Pointer()
+
+// A Level is the importance of a structured log record.
+// The values match those of log/slog, so a Level converts directly to a slog.Level.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("Level(%d)", int(level))
+	}
+}
+
+// ParseLevel parses the case-insensitive level names "debug", "verbose", "info", "warn" and "error".
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug", "verbose":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Subsystems that tag structured log records.
+const (
+	SubsystemDevice    = "device"
+	SubsystemPeer      = "peer"
+	SubsystemHandshake = "handshake"
+	SubsystemBind      = "bind"
+	SubsystemUAPI      = "uapi"
+	SubsystemState     = "state"
+)
+
+// Keys of the well-known fields attached to structured log records.
+const (
+	KeyPeer       = "peer"
+	KeyEndpoint   = "endpoint"
+	KeyTransport  = "transport"
+	KeyState      = "state"
+	KeyError      = "error"
+	KeySuppressed = "suppressed"
+)
+
+// A Field is a key-value pair attached to a structured log record.
+// Values that implement fmt.Stringer or error are rendered lazily,
+// only once a handler has accepted the record.
+type Field struct {
+	Key   string
+	Value any
+}
+
+func PeerField(peer fmt.Stringer) Field { return Field{KeyPeer, peer} }
+
+func EndpointField(endpoint Endpoint) Field { return Field{KeyEndpoint, endpointValue{endpoint}} }
+
+func TransportField(transport string) Field { return Field{KeyTransport, transport} }
+
+func StateField(state any) Field { return Field{KeyState, state} }
+
+func ErrorField(err error) Field { return Field{KeyError, err} }
+
+type endpointValue struct {
+	endpoint Endpoint
+}
+
+func (v endpointValue) String() string {
+	if v.endpoint == nil {
+		return "none"
+	}
+	return v.endpoint.DstToString()
+}
+
+// FieldString renders the value of a field the way the text and slog handlers do.
+func FieldString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// A LogHandler receives structured log records.
+// Implementations must be safe for concurrent use.
+type LogHandler interface {
+	// Enabled reports whether records from subsystem at level should be handled.
+	Enabled(subsystem string, level Level) bool
+
+	// Handle processes a single record.
+	// It must not retain fields after returning.
+	Handle(subsystem string, level Level, msg string, fields []Field)
+}
+
+// Log writes a structured record for subsystem.
+// Records are dropped early when the handler does not want them.
+func (logger *Logger) Log(subsystem string, level Level, msg string, fields ...Field) {
+	if logger.Handler != nil {
+		if logger.Handler.Enabled(subsystem, level) {
+			logger.Handler.Handle(subsystem, level, msg, fields)
+		}
+		return
+	}
+	logf := logger.Verbosef
+	if level >= LevelWarn {
+		logf = logger.Errorf
+	}
+	if logf == nil || reflect.ValueOf(logf).Pointer() == discardLogf {
+		return
+	}
+	logf("%s", formatRecord(subsystem, msg, fields))
+}
+
+// formatRecord renders a record as "msg key=value ...".
+func formatRecord(subsystem string, msg string, fields []Field) string {
+	var b strings.Builder
+	b.WriteString(subsystem)
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for _, field := range fields {
+		b.WriteByte(' ')
+		b.WriteString(field.Key)
+		b.WriteByte('=')
+		value := FieldString(field.Value)
+		if value == "" || strings.ContainsAny(value, " =\"") {
+			fmt.Fprintf(&b, "%q", value)
+		} else {
+			b.WriteString(value)
+		}
+	}
+	return b.String()
+}
+
+// NewHandlerLogger returns a Logger that sends everything to handler,
+// including lines written with Verbosef and Errorf,
+// which are tagged with subsystem and logged at LevelDebug and LevelError.
+func NewHandlerLogger(handler LogHandler, subsystem string) Logger {
+	logf := func(level Level) func(string, ...any) {
+		return func(format string, args ...any) {
+			if handler.Enabled(subsystem, level) {
+				handler.Handle(subsystem, level, fmt.Sprintf(format, args...), nil)
+			}
+		}
+	}
+	return Logger{
+		Verbosef: logf(LevelDebug),
+		Errorf:   logf(LevelError),
+		Handler:  handler,
+	}
+}
+
+// A LevelFilter is a LogHandler that drops records below a minimum level
+// before passing them on. The minimum can be set per subsystem.
+type LevelFilter struct {
+	handler LogHandler
+
+	mu         sync.RWMutex
+	level      Level
+	subsystems map[string]Level
+}
+
+// NewLevelFilter returns a LevelFilter passing records at level and above to handler.
+func NewLevelFilter(handler LogHandler, level Level) *LevelFilter {
+	return &LevelFilter{handler: handler, level: level}
+}
+
+// SetLevel sets the minimum level for subsystem.
+// An empty subsystem sets the default for subsystems without their own level.
+func (filter *LevelFilter) SetLevel(subsystem string, level Level) {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	if subsystem == "" {
+		filter.level = level
+		return
+	}
+	if filter.subsystems == nil {
+		filter.subsystems = make(map[string]Level)
+	}
+	filter.subsystems[subsystem] = level
+}
+
+// ParseLevels applies a comma separated list of levels,
+// such as "info,handshake=debug,bind=error".
+// Entries without a subsystem set the default level.
+func (filter *LevelFilter) ParseLevels(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		if entry == "" {
+			continue
+		}
+		subsystem, name, ok := strings.Cut(entry, "=")
+		if !ok {
+			subsystem, name = "", entry
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		filter.SetLevel(subsystem, level)
+	}
+	return nil
+}
+
+func (filter *LevelFilter) Enabled(subsystem string, level Level) bool {
+	filter.mu.RLock()
+	min, ok := filter.subsystems[subsystem]
+	if !ok {
+		min = filter.level
+	}
+	filter.mu.RUnlock()
+	return level >= min && filter.handler.Enabled(subsystem, level)
+}
+
+func (filter *LevelFilter) Handle(subsystem string, level Level, msg string, fields []Field) {
+	filter.handler.Handle(subsystem, level, msg, fields)
+}
+
+// A LogLimiter limits how often a single source logs.
+// Each Bind or Device owns its own limiter, so a noisy instance
+// does not silence the others.
+// The zero value allows every record.
+type LogLimiter struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	last       time.Time
+	suppressed uint64
+}
+
+// NewLogLimiter returns a LogLimiter that allows at most one record per interval.
+func NewLogLimiter(interval time.Duration) *LogLimiter {
+	return &LogLimiter{interval: interval}
+}
+
+// Allow reports whether a record may be logged now,
+// and if so, how many records were suppressed since the last one.
+func (limiter *LogLimiter) Allow() (ok bool, suppressed uint64) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := time.Now()
+	if !limiter.last.IsZero() && now.Sub(limiter.last) < limiter.interval {
+		limiter.suppressed++
+		return false, 0
+	}
+	limiter.last = now
+	suppressed = limiter.suppressed
+	limiter.suppressed = 0
+	return true, suppressed
+}
@@ -0,0 +1,45 @@
+//go:build go1.21
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"context"
+	"log/slog"
+)
+
+// KeySubsystem is the attribute under which SlogHandler records the subsystem.
+const KeySubsystem = "subsystem"
+
+// SlogHandler is a LogHandler that writes to a *slog.Logger.
+type SlogHandler struct {
+	logger *slog.Logger
+}
+
+// NewSlogHandler returns a LogHandler writing records to logger.
+// Wrap it in a LevelFilter for per-subsystem levels.
+func NewSlogHandler(logger *slog.Logger) *SlogHandler {
+	return &SlogHandler{logger: logger}
+}
+
+func (h *SlogHandler) Enabled(subsystem string, level Level) bool {
+	return h.logger.Enabled(context.Background(), slog.Level(level))
+}
+
+func (h *SlogHandler) Handle(subsystem string, level Level, msg string, fields []Field) {
+	attrs := make([]slog.Attr, 0, len(fields)+1)
+	attrs = append(attrs, slog.String(KeySubsystem, subsystem))
+	for _, field := range fields {
+		switch v := field.Value.(type) {
+		case string, bool, int, int64, uint16, uint32, uint64:
+			attrs = append(attrs, slog.Any(field.Key, v))
+		default:
+			attrs = append(attrs, slog.String(field.Key, FieldString(v)))
+		}
+	}
+	h.logger.LogAttrs(context.Background(), slog.Level(level), msg, attrs...)
+}
@@ -0,0 +1,53 @@
+//go:build go1.21
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"testing"
+)
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
+
+func TestSlogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	handler := NewSlogHandler(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	logger := NewHandlerLogger(handler, SubsystemDevice)
+
+	logger.Log(SubsystemHandshake, LevelDebug, "dropped")
+	logger.Log(SubsystemHandshake, LevelWarn, "Handshake did not complete",
+		PeerField(stringer("peer(AAAA…BBBB)")),
+		EndpointField(asEndpoint(netip.MustParseAddrPort("[2001:db8::1]:443"))),
+		ErrorField(errors.New("timeout")),
+		Field{"attempts", 20})
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"level":      "WARN",
+		"msg":        "Handshake did not complete",
+		KeySubsystem: SubsystemHandshake,
+		KeyPeer:      "peer(AAAA…BBBB)",
+		KeyEndpoint:  "[2001:db8::1]:443",
+		KeyError:     "timeout",
+		"attempts":   float64(20),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+type record struct {
+	subsystem string
+	level     Level
+	msg       string
+	fields    []Field
+}
+
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []record
+}
+
+func (h *recordingHandler) Enabled(subsystem string, level Level) bool { return true }
+
+func (h *recordingHandler) Handle(subsystem string, level Level, msg string, fields []Field) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, record{subsystem, level, msg, append([]Field(nil), fields...)})
+}
+
+func TestLoggerTextFallback(t *testing.T) {
+	var verbose, errs []string
+	logger := Logger{
+		Verbosef: func(format string, args ...any) { verbose = append(verbose, fmt.Sprintf(format, args...)) },
+		Errorf:   func(format string, args ...any) { errs = append(errs, fmt.Sprintf(format, args...)) },
+	}
+	endpoint := asEndpoint(netip.MustParseAddrPort("192.0.2.1:51820"))
+	logger.Log(SubsystemHandshake, LevelDebug, "Sending handshake initiation", EndpointField(endpoint), TransportField("tls"))
+	logger.Log(SubsystemBind, LevelError, "Socket error", ErrorField(errors.New("broken pipe")))
+
+	if len(verbose) != 1 || verbose[0] != "handshake: Sending handshake initiation endpoint=192.0.2.1:51820 transport=tls" {
+		t.Errorf("unexpected verbose lines: %q", verbose)
+	}
+	if len(errs) != 1 || errs[0] != `bind: Socket error error="broken pipe"` {
+		t.Errorf("unexpected error lines: %q", errs)
+	}
+}
+
+type countingStringer struct{ n *int }
+
+func (s countingStringer) String() string {
+	*s.n++
+	return "rendered"
+}
+
+func TestLoggerDiscardSkipsFormatting(t *testing.T) {
+	var rendered int
+	logger := Logger{Verbosef: DiscardLogf, Errorf: DiscardLogf}
+	logger.Log(SubsystemPeer, LevelDebug, "Receiving keepalive packet", PeerField(countingStringer{&rendered}))
+	logger.Log(SubsystemPeer, LevelError, "Failed to send handshake initiation", PeerField(countingStringer{&rendered}))
+	if rendered != 0 {
+		t.Errorf("discarded records rendered %d fields", rendered)
+	}
+}
+
+func TestLevelFilter(t *testing.T) {
+	var h recordingHandler
+	filter := NewLevelFilter(&h, LevelInfo)
+	if err := filter.ParseLevels("warn,handshake=debug"); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.ParseLevels("bind=loud"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+	logger := NewHandlerLogger(filter, SubsystemDevice)
+
+	logger.Log(SubsystemHandshake, LevelDebug, "kept")
+	logger.Log(SubsystemBind, LevelInfo, "dropped")
+	logger.Log(SubsystemBind, LevelWarn, "kept")
+	logger.Verbosef("dropped %d", 1)
+	logger.Errorf("kept %d", 2)
+
+	if len(h.records) != 3 {
+		t.Fatalf("expected 3 records, got %d: %+v", len(h.records), h.records)
+	}
+	last := h.records[2]
+	if last.subsystem != SubsystemDevice || last.level != LevelError || last.msg != "kept 2" {
+		t.Errorf("unexpected printf record: %+v", last)
+	}
+}
+
+func TestLogLimiter(t *testing.T) {
+	var zero LogLimiter
+	for i := 0; i < 3; i++ {
+		if ok, _ := zero.Allow(); !ok {
+			t.Fatal("zero LogLimiter must not limit")
+		}
+	}
+
+	a, b := NewLogLimiter(time.Hour), NewLogLimiter(time.Hour)
+	if ok, _ := a.Allow(); !ok {
+		t.Fatal("first record must be allowed")
+	}
+	for i := 0; i < 5; i++ {
+		if ok, _ := a.Allow(); ok {
+			t.Fatal("record within interval must be suppressed")
+		}
+	}
+	if ok, _ := b.Allow(); !ok {
+		t.Fatal("limiters must not share state")
+	}
+	a.last = a.last.Add(-2 * time.Hour)
+	ok, suppressed := a.Allow()
+	if !ok || suppressed != 5 {
+		t.Errorf("got ok=%v suppressed=%d, want true and 5", ok, suppressed)
+	}
+}
@@ -34,6 +34,7 @@ var wgDataHeaderSize = 16
 var wgDataPrefixSize = 8 // Wireguard data header without counter
 
 var tunSafeHeaderSize = 2
+var tunSafeMaxPayloadSize = 1<<14 - 1 // the header holds the size in 14 bits
 var tunSafeNormalType = uint8(0b00)
 var tunSafeDataType = uint8(0b10)
 
@@ -0,0 +1,320 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package control serves a JSON/HTTP API to configure and monitor a Device.
+//
+// The API is a thin layer over the configuration protocol: reads are get
+// operations parsed by Device.Snapshot, and writes are set operations run
+// by Device.Apply, so both interfaces accept and report the same things.
+// Configurations are device.DeviceConfig and device.PeerConfig encoded
+// as JSON, with keys in hex and durations in nanoseconds. Requests with a
+// body must be of type application/json. The private key of the device and
+// the preshared keys of the peers can be set, but are never reported.
+//
+// The API is only served on a Unix socket, which only the user running the
+// process may connect to.
+//
+//	GET    /v1/device         the configuration and statistics of the device
+//	POST   /v1/device         applies a DeviceConfig
+//	GET    /v1/peers          the peers of the device
+//	GET    /v1/peers/KEY      the peer with the public key KEY, in hex
+//	POST   /v1/peers/KEY      applies a PeerConfig to the peer, creating it if needed
+//	DELETE /v1/peers/KEY      removes the peer
+//	GET    /v1/state          the state and transport of the device
+//	GET    /v1/runtime        the device.RuntimeState of the device
+//	POST   /v1/runtime        imports a device.RuntimeState
+//	GET    /v1/events         a stream of device.Event, one JSON object per line
+//
+// Failures are reported with an HTTP status and an Error, whose Errno is
+// the error code of the configuration protocol, from package ipc.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+// An Error is the body of a failed request.
+type Error struct {
+	Errno int64  `json:"errno"`
+	Error string `json:"error"`
+}
+
+// A State is the body of GET /v1/state.
+type State struct {
+	State     string `json:"state"`     // "up", "down" or "closed"
+	Transport string `json:"transport"` // "udp", "tcp" or "tls"
+	Peers     int    `json:"peers"`
+}
+
+// Handler serves the API for a device.
+type Handler struct {
+	device *device.Device
+	mux    *http.ServeMux
+}
+
+// NewHandler returns a Handler serving the API for dev.
+func NewHandler(dev *device.Device) *Handler {
+	h := &Handler{device: dev, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/v1/device", h.serveDevice)
+	h.mux.HandleFunc("/v1/peers", h.servePeers)
+	h.mux.HandleFunc("/v1/peers/", h.servePeer)
+	h.mux.HandleFunc("/v1/state", h.serveState)
+	h.mux.HandleFunc("/v1/runtime", h.serveRuntime)
+	h.mux.HandleFunc("/v1/events", h.serveEvents)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) serveDevice(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		config, err := h.device.Snapshot()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		redact(config)
+		writeJSON(w, config)
+	case http.MethodPost:
+		var config device.DeviceConfig
+		if !readJSON(w, r, &config) {
+			return
+		}
+		if err := h.device.Apply(&config); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (h *Handler) servePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	config, err := h.device.Snapshot()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	redact(config)
+	peers := config.Peers
+	if peers == nil {
+		peers = []device.PeerConfig{}
+	}
+	writeJSON(w, peers)
+}
+
+func (h *Handler) servePeer(w http.ResponseWriter, r *http.Request) {
+	var key device.NoisePublicKey
+	if err := key.FromHex(strings.TrimPrefix(r.URL.Path, "/v1/peers/")); err != nil {
+		writeStatus(w, http.StatusNotFound, ipc.IpcErrorInvalid, "invalid public key")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		config, err := h.device.Snapshot()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		redact(config)
+		for i := range config.Peers {
+			if config.Peers[i].PublicKey == key {
+				writeJSON(w, &config.Peers[i])
+				return
+			}
+		}
+		writeStatus(w, http.StatusNotFound, ipc.IpcErrorInvalid, "no such peer")
+	case http.MethodPost:
+		var peer device.PeerConfig
+		if !readJSON(w, r, &peer) {
+			return
+		}
+		if !peer.PublicKey.IsZero() && peer.PublicKey != key {
+			writeStatus(w, http.StatusBadRequest, ipc.IpcErrorInvalid, "public key does not match the path")
+			return
+		}
+		peer.PublicKey = key
+		if err := h.device.Apply(&device.DeviceConfig{Peers: []device.PeerConfig{peer}}); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		remove := device.PeerConfig{PublicKey: key, Remove: true}
+		if err := h.device.Apply(&device.DeviceConfig{Peers: []device.PeerConfig{remove}}); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (h *Handler) serveState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	config, err := h.device.Snapshot()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, State{
+		State:     h.device.State(),
+		Transport: h.device.Transport(),
+		Peers:     len(config.Peers),
+	})
+}
+
+func (h *Handler) serveRuntime(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.device.ExportRuntimeState())
+	case http.MethodPost:
+		var state device.RuntimeState
+		if !readJSON(w, r, &state) {
+			return
+		}
+		if err := h.device.ImportRuntimeState(&state); err != nil {
+			writeStatus(w, http.StatusBadRequest, ipc.IpcErrorInvalid, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (h *Handler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	sub := h.device.SubscribeEvents(0)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// redact removes the secrets from config.
+func redact(config *device.DeviceConfig) {
+	config.PrivateKey = nil
+	for i := range config.Peers {
+		config.Peers[i].PresharedKey = nil
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeStatus(w, http.StatusUnsupportedMediaType, ipc.IpcErrorProtocol, "request body must be application/json")
+		return false
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeStatus(w, http.StatusBadRequest, ipc.IpcErrorProtocol, fmt.Sprintf("invalid request: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, status int, errno int64, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Error{Errno: errno, Error: message})
+}
+
+// writeError reports err with the status matching its configuration protocol error code.
+func writeError(w http.ResponseWriter, err error) {
+	errno := int64(ipc.IpcErrorInvalid)
+	var ipcErr *device.IPCError
+	if errors.As(err, &ipcErr) {
+		errno = ipcErr.ErrorCode()
+	}
+	status := http.StatusInternalServerError
+	switch errno {
+	case ipc.IpcErrorInvalid, ipc.IpcErrorProtocol:
+		status = http.StatusBadRequest
+	case ipc.IpcErrorPortInUse:
+		status = http.StatusConflict
+	case ipc.IpcErrorDenied:
+		status = http.StatusForbidden
+	}
+	writeStatus(w, status, errno, err.Error())
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeStatus(w, http.StatusMethodNotAllowed, ipc.IpcErrorProtocol, "method not allowed")
+}
+
+// Listen listens for API clients on the Unix socket at path, which only
+// the user running the process may connect to. A socket left at path by
+// a process that is gone is replaced, but nothing else is.
+func Listen(path string) (net.Listener, error) {
+	listener, err := listenUnix(path)
+	if err == nil {
+		return listener, nil
+	}
+	if info, statErr := os.Lstat(path); statErr != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil, err
+	}
+	// Test socket, if not in use cleanup and try again.
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, errors.New("unix socket in use")
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return listenUnix(path)
+}
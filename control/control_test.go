@@ -0,0 +1,227 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package control
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, ""))
+	t.Cleanup(dev.Close)
+	server := httptest.NewServer(NewHandler(dev))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// do sends a request with body and decodes the response into v, if not nil.
+// It returns the status of the response.
+func do(t *testing.T, server *httptest.Server, method, path, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHandler(t *testing.T) {
+	server := newServer(t)
+	var key device.NoisePublicKey
+	key[0] = 1
+	keyHex := hex.EncodeToString(key[:])
+
+	status := do(t, server, "POST", "/v1/device", `{
+		"PrivateKey": "`+strings.Repeat("11", 32)+`",
+		"ReplayWindow": 100000,
+		"Peers": [{
+			"PublicKey": "`+keyHex+`",
+			"PresharedKey": "`+strings.Repeat("22", 32)+`",
+			"Endpoint": "192.0.2.1:51820",
+			"AllowedIPs": ["10.0.0.0/24"]
+		}]
+	}`, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("POST /v1/device: status %d", status)
+	}
+
+	var peer device.PeerConfig
+	if status := do(t, server, "GET", "/v1/peers/"+keyHex, "", &peer); status != http.StatusOK {
+		t.Fatalf("GET peer: status %d", status)
+	}
+	if want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}; peer.PublicKey != key || peer.Endpoint != "192.0.2.1:51820" || !reflect.DeepEqual(peer.AllowedIPs, want) {
+		t.Errorf("GET peer = %+v", peer)
+	}
+
+	if status := do(t, server, "POST", "/v1/peers/"+keyHex, `{"PersistentKeepaliveInterval": 25}`, nil); status != http.StatusNoContent {
+		t.Errorf("POST peer: status %d", status)
+	}
+	var config device.DeviceConfig
+	do(t, server, "GET", "/v1/device", "", &config)
+	if len(config.Peers) != 1 || *config.Peers[0].PersistentKeepaliveInterval != 25 || *config.ReplayWindow != 100000 {
+		t.Errorf("GET /v1/device = %+v", config)
+	}
+	if config.PrivateKey != nil || config.Peers[0].PresharedKey != nil {
+		t.Errorf("GET /v1/device reported secrets: %+v", config)
+	}
+
+	var state State
+	do(t, server, "GET", "/v1/state", "", &state)
+	if state.Transport != "udp" || state.Peers != 1 || state.State == "" {
+		t.Errorf("GET /v1/state = %+v", state)
+	}
+
+	var runtime device.RuntimeState
+	do(t, server, "GET", "/v1/runtime", "", &runtime)
+	if len(runtime.Peers) != 1 || runtime.Peers[0].Endpoint != "192.0.2.1:51820" {
+		t.Errorf("GET /v1/runtime = %+v", runtime)
+	}
+	if status := do(t, server, "POST", "/v1/runtime", `{"Peers": [{"PublicKey": "`+keyHex+`", "Endpoint": "192.0.2.2:51820", "RxBytes": 7}]}`, nil); status != http.StatusNoContent {
+		t.Errorf("POST /v1/runtime: status %d", status)
+	}
+	do(t, server, "GET", "/v1/peers/"+keyHex, "", &peer)
+	if peer.Endpoint != "192.0.2.2:51820" || peer.RxBytes != 7 {
+		t.Errorf("peer after importing runtime state = %+v", peer)
+	}
+
+	// Errors carry the error codes of the configuration protocol.
+	for _, test := range []struct {
+		method, path, body string
+		status             int
+		errno              int64
+	}{
+		{"POST", "/v1/device", `{"Peers": [{"PublicKey": "` + keyHex + `", "Endpoint": "nowhere"}]}`, http.StatusBadRequest, ipc.IpcErrorInvalid},
+		{"POST", "/v1/device", `{"NoSuchField": 1}`, http.StatusBadRequest, ipc.IpcErrorProtocol},
+		{"POST", "/v1/peers/00", `{}`, http.StatusNotFound, ipc.IpcErrorInvalid},
+		{"PUT", "/v1/state", ``, http.StatusMethodNotAllowed, ipc.IpcErrorProtocol},
+	} {
+		var apiErr Error
+		status := do(t, server, test.method, test.path, test.body, &apiErr)
+		if status != test.status || apiErr.Errno != test.errno {
+			t.Errorf("%s %s %s: status %d, %+v; want %d, errno %d", test.method, test.path, test.body, status, apiErr, test.status, test.errno)
+		}
+	}
+
+	// Bodies that are not JSON, as web pages may send to any address, are refused.
+	resp, err := server.Client().Post(server.URL+"/v1/device", "text/plain", strings.NewReader(`{"ReplacePeers": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("POST text/plain: status %d", resp.StatusCode)
+	}
+
+	if status := do(t, server, "DELETE", "/v1/peers/"+keyHex, "", nil); status != http.StatusNoContent {
+		t.Errorf("DELETE peer: status %d", status)
+	}
+	if status := do(t, server, "GET", "/v1/peers/"+keyHex, "", nil); status != http.StatusNotFound {
+		t.Errorf("GET removed peer: status %d", status)
+	}
+	var peers []device.PeerConfig
+	do(t, server, "GET", "/v1/peers", "", &peers)
+	if peers == nil || len(peers) != 0 {
+		t.Errorf("GET /v1/peers = %v, want an empty list", peers)
+	}
+}
+
+func TestListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	listener, err := Listen(path)
+	if runtime.GOOS == "windows" {
+		if err == nil {
+			listener.Close()
+			t.Error("Listen succeeded on Windows")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		t.Errorf("socket permissions %v, want only the owner", perm)
+	}
+}
+
+func TestListenExisting(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the control API is not supported on Windows")
+	}
+	dir := t.TempDir()
+
+	// A file that is not a socket is left alone.
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("keep"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err := Listen(path); err == nil {
+		listener.Close()
+		t.Error("Listen replaced a regular file")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "keep" {
+		t.Errorf("regular file changed: %q, %v", b, err)
+	}
+
+	// A socket in use is left alone.
+	path = filepath.Join(dir, "control.sock")
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := Listen(path); err == nil {
+		l.Close()
+		t.Error("Listen replaced a socket in use")
+	}
+	if c, err := net.Dial("unix", path); err != nil {
+		t.Errorf("socket in use no longer reachable: %v", err)
+	} else {
+		c.Close()
+	}
+
+	// A socket left behind is replaced.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = Listen(path)
+	if err != nil {
+		t.Fatalf("Listen did not replace a stale socket: %v", err)
+	}
+	listener.Close()
+}
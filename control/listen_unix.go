@@ -0,0 +1,20 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package control
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func listenUnix(path string) (net.Listener, error) {
+	oldUmask := unix.Umask(0o077)
+	defer unix.Umask(oldUmask)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,17 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package control
+
+import (
+	"errors"
+	"net"
+)
+
+// listenUnix fails on Windows, where the permissions of Unix sockets
+// cannot be restricted to the user running the process.
+func listenUnix(path string) (net.Listener, error) {
+	return nil, errors.New("the control API is not supported on Windows")
+}
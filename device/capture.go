@@ -0,0 +1,471 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Packet capture
+ *
+ * A capture records both sides of the tunnel into a single pcapng stream:
+ *
+ *   interface 0 ("tun"): plaintext IP packets read from and written to the TUN device
+ *   interface 1 ("wg"):  WireGuard datagrams sent and received through the Bind
+ *
+ * Datagrams on the Bind side are wrapped in synthesized IP/UDP headers built
+ * from the endpoint, so that Wireshark can dissect them as WireGuard.
+ *
+ * Capturing never blocks the data path. Packets are copied into a ring of
+ * fixed size and written out by a separate goroutine; when the writer
+ * falls behind, the oldest packets in the ring are dropped.
+ */
+
+const (
+	CaptureInterfaceTUN  = 0
+	CaptureInterfaceBind = 1
+
+	DefaultCaptureBufferPackets = 1024
+)
+
+// CaptureOptions configures a packet capture started with Device.StartCapture.
+type CaptureOptions struct {
+	// Snaplen limits the number of bytes recorded of each packet,
+	// which allows recording headers without payloads.
+	// Zero records whole packets.
+	Snaplen int
+
+	// BufferPackets is the number of packets held in the ring buffer
+	// waiting to be written. Zero selects DefaultCaptureBufferPackets.
+	BufferPackets int
+}
+
+type capturedPacket struct {
+	iface    uint32
+	inbound  bool
+	time     int64 // nanoseconds since epoch
+	length   int   // original length, including synthesized headers
+	data     []byte
+	dataSize int
+}
+
+type packetCapture struct {
+	w       *bufio.Writer
+	closer  io.Closer
+	name    string
+	options CaptureOptions
+	port    atomic.Uint32 // local port of the Bind, for synthesized headers
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	ring    []capturedPacket
+	head    int // index of the oldest packet
+	count   int
+	dropped uint64
+	closed  bool
+	done    chan error
+}
+
+const (
+	pcapngBlockSHB    = 0x0a0d0d0a
+	pcapngBlockIDB    = 0x00000001
+	pcapngBlockEPB    = 0x00000006
+	pcapngByteOrder   = 0x1a2b3c4d
+	pcapngLinktypeRaw = 101
+
+	pcapngOptEnd     = 0
+	pcapngOptIfName  = 2
+	pcapngOptTsresol = 9
+	pcapngOptFlags   = 2
+
+	pcapngFlagInbound  = 1
+	pcapngFlagOutbound = 2
+
+	captureHeaderRoom = 48 // room for a synthesized IPv6 and UDP header
+)
+
+func newPacketCapture(w io.Writer, name string, options CaptureOptions) (*packetCapture, error) {
+	if options.Snaplen < 0 || options.BufferPackets < 0 {
+		return nil, errors.New("invalid capture options")
+	}
+	if options.BufferPackets == 0 {
+		options.BufferPackets = DefaultCaptureBufferPackets
+	}
+	c := &packetCapture{
+		w:       bufio.NewWriter(w),
+		name:    name,
+		options: options,
+		ring:    make([]capturedPacket, options.BufferPackets),
+		done:    make(chan error, 1),
+	}
+	if closer, ok := w.(io.Closer); ok {
+		c.closer = closer
+	}
+	c.cond.L = &c.mu
+	if err := c.writeHeader(); err != nil {
+		return nil, err
+	}
+	go c.routineWriter()
+	return c, nil
+}
+
+func (c *packetCapture) snaplen() uint32 {
+	if c.options.Snaplen == 0 {
+		return MaxMessageSize + captureHeaderRoom
+	}
+	return uint32(c.options.Snaplen)
+}
+
+func (c *packetCapture) writeHeader() error {
+	var shb [28]byte
+	binary.LittleEndian.PutUint32(shb[0:], pcapngBlockSHB)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrder)
+	binary.LittleEndian.PutUint16(shb[12:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[14:], 0) // minor version
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+	c.w.Write(shb[:])
+
+	for _, name := range []string{"tun", "wg"} {
+		var opts []byte
+		opts = appendPcapngOption(opts, pcapngOptIfName, []byte(name))
+		opts = appendPcapngOption(opts, pcapngOptTsresol, []byte{9}) // nanoseconds
+		opts = appendPcapngOption(opts, pcapngOptEnd, nil)
+		idb := make([]byte, 16, 20+len(opts))
+		binary.LittleEndian.PutUint32(idb[0:], pcapngBlockIDB)
+		binary.LittleEndian.PutUint32(idb[4:], uint32(cap(idb)))
+		binary.LittleEndian.PutUint16(idb[8:], pcapngLinktypeRaw)
+		binary.LittleEndian.PutUint32(idb[12:], c.snaplen())
+		idb = append(idb, opts...)
+		idb = binary.LittleEndian.AppendUint32(idb, uint32(cap(idb)))
+		c.w.Write(idb)
+	}
+	return c.w.Flush()
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// slot reserves the next ring entry, overwriting the oldest one if the ring is full.
+// The caller must hold c.mu.
+func (c *packetCapture) slot() *capturedPacket {
+	if c.count == len(c.ring) {
+		c.head = (c.head + 1) % len(c.ring)
+		c.count--
+		c.dropped++
+	}
+	p := &c.ring[(c.head+c.count)%len(c.ring)]
+	c.count++
+	return p
+}
+
+func (c *packetCapture) record(iface uint32, inbound bool, length int, fill func(dst []byte) int) {
+	now := time.Now().UnixNano()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	size := length
+	if snaplen := int(c.snaplen()); size > snaplen {
+		size = snaplen
+	}
+	p := c.slot()
+	if cap(p.data) < size {
+		p.data = make([]byte, size)
+	}
+	p.iface = iface
+	p.inbound = inbound
+	p.time = now
+	p.length = length
+	p.dataSize = fill(p.data[:size])
+	c.cond.Signal()
+}
+
+// tunPacket records a plaintext packet read from or written to the TUN device.
+func (c *packetCapture) tunPacket(packet []byte, inbound bool) {
+	c.record(CaptureInterfaceTUN, inbound, len(packet), func(dst []byte) int {
+		return copy(dst, packet)
+	})
+}
+
+// bindPacket records a WireGuard datagram sent to or received from endpoint.
+func (c *packetCapture) bindPacket(packet []byte, endpoint conn.Endpoint, inbound bool) {
+	remote, err := netip.ParseAddrPort(endpoint.DstToString())
+	if err != nil {
+		return
+	}
+	local := netip.AddrPortFrom(endpoint.SrcIP(), uint16(c.port.Load()))
+	if !local.Addr().IsValid() || local.Addr().Is4() != remote.Addr().Is4() {
+		if remote.Addr().Is4() {
+			local = netip.AddrPortFrom(netip.IPv4Unspecified(), local.Port())
+		} else {
+			local = netip.AddrPortFrom(netip.IPv6Unspecified(), local.Port())
+		}
+	}
+	src, dst := local, remote
+	if inbound {
+		src, dst = remote, local
+	}
+	var header [captureHeaderRoom]byte
+	headerSize := synthesizeUDPHeader(header[:], src, dst, packet)
+	c.record(CaptureInterfaceBind, inbound, headerSize+len(packet), func(b []byte) int {
+		n := copy(b, header[:headerSize])
+		return n + copy(b[n:], packet)
+	})
+}
+
+// synthesizeUDPHeader writes IP and UDP headers for a datagram carrying payload into b
+// and returns their combined length.
+func synthesizeUDPHeader(b []byte, src, dst netip.AddrPort, payload []byte) int {
+	const udpHeaderLen = 8
+	var ipHeaderLen int
+	udpLen := udpHeaderLen + len(payload)
+	if src.Addr().Is4() {
+		ipHeaderLen = 20
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:], uint16(ipHeaderLen+udpLen))
+		b[8] = 64 // TTL
+		b[9] = 17 // UDP
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(b[IPv4offsetSrc:], s[:])
+		copy(b[IPv4offsetDst:], d[:])
+		binary.BigEndian.PutUint16(b[10:], ^checksum(b[:ipHeaderLen], 0))
+	} else {
+		ipHeaderLen = 40
+		b[0] = 0x60
+		binary.BigEndian.PutUint16(b[IPv6offsetPayloadLength:], uint16(udpLen))
+		b[6] = 17 // UDP
+		b[7] = 64 // hop limit
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		copy(b[IPv6offsetSrc:], s[:])
+		copy(b[IPv6offsetDst:], d[:])
+	}
+	udp := b[ipHeaderLen : ipHeaderLen+udpHeaderLen]
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	if !src.Addr().Is4() {
+		// The UDP checksum is mandatory over IPv6.
+		var pseudo [40]byte
+		copy(pseudo[0:], b[IPv6offsetSrc:IPv6offsetSrc+32])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(udpLen))
+		pseudo[39] = 17
+		sum := checksum(payload, checksum(udp, checksum(pseudo[:], 0)))
+		if sum == 0xffff {
+			sum = 0
+		}
+		binary.BigEndian.PutUint16(udp[6:], ^sum)
+	}
+	return ipHeaderLen + udpHeaderLen
+}
+
+// checksum folds b into the ones' complement sum initial, as used by IP and UDP.
+func checksum(b []byte, initial uint16) uint16 {
+	sum := uint32(initial)
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+func (c *packetCapture) routineWriter() {
+	var p capturedPacket
+	var err error
+	for {
+		c.mu.Lock()
+		for c.count == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.count == 0 {
+			c.mu.Unlock()
+			break
+		}
+		// Swap the buffer out of the ring so that the packet can be written without the lock held.
+		slot := &c.ring[c.head]
+		p, *slot = *slot, capturedPacket{data: p.data}
+		c.head = (c.head + 1) % len(c.ring)
+		c.count--
+		idle := c.count == 0
+		c.mu.Unlock()
+
+		if err == nil {
+			err = c.writePacket(&p)
+		}
+		if err == nil && idle {
+			err = c.w.Flush()
+		}
+	}
+	if flushErr := c.w.Flush(); err == nil {
+		err = flushErr
+	}
+	if c.closer != nil {
+		if closeErr := c.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	c.done <- err
+}
+
+func (c *packetCapture) writePacket(p *capturedPacket) error {
+	var opts []byte
+	var flags [4]byte
+	if p.inbound {
+		binary.LittleEndian.PutUint32(flags[:], pcapngFlagInbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags[:], pcapngFlagOutbound)
+	}
+	opts = appendPcapngOption(opts, pcapngOptFlags, flags[:])
+	opts = appendPcapngOption(opts, pcapngOptEnd, nil)
+
+	padded := (p.dataSize + 3) &^ 3
+	total := 28 + padded + len(opts) + 4
+	var header [28]byte
+	binary.LittleEndian.PutUint32(header[0:], pcapngBlockEPB)
+	binary.LittleEndian.PutUint32(header[4:], uint32(total))
+	binary.LittleEndian.PutUint32(header[8:], p.iface)
+	binary.LittleEndian.PutUint32(header[12:], uint32(uint64(p.time)>>32))
+	binary.LittleEndian.PutUint32(header[16:], uint32(p.time))
+	binary.LittleEndian.PutUint32(header[20:], uint32(p.dataSize))
+	binary.LittleEndian.PutUint32(header[24:], uint32(p.length))
+	c.w.Write(header[:])
+	c.w.Write(p.data[:p.dataSize])
+	var pad [3]byte
+	c.w.Write(pad[:padded-p.dataSize])
+	c.w.Write(opts)
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(total))
+	_, err := c.w.Write(trailer[:])
+	return err
+}
+
+// close stops accepting packets, waits for the ones already buffered to be written,
+// and closes the underlying writer if it is an io.Closer.
+func (c *packetCapture) close() (dropped uint64, err error) {
+	c.mu.Lock()
+	c.closed = true
+	dropped = c.dropped
+	c.cond.Signal()
+	c.mu.Unlock()
+	return dropped, <-c.done
+}
+
+// StartCapture starts recording the device's traffic to w in pcapng format,
+// replacing any capture already running.
+// If w is an io.Closer, it is closed when the capture stops.
+func (device *Device) StartCapture(w io.Writer, options CaptureOptions) error {
+	return device.startCapture(w, "", options)
+}
+
+func (device *Device) startCapture(w io.Writer, name string, options CaptureOptions) error {
+	c, err := newPacketCapture(w, name, options)
+	if err != nil {
+		return err
+	}
+	device.net.RLock()
+	c.port.Store(uint32(device.net.port))
+	device.net.RUnlock()
+	if old := device.capture.Swap(c); old != nil {
+		device.finishCapture(old)
+	}
+	device.log.Log(conn.SubsystemDevice, conn.LevelInfo, "Packet capture started", conn.Field{Key: "file", Value: name})
+	return nil
+}
+
+// StartCaptureFile starts a capture written to the file at path, which is truncated.
+func (device *Device) StartCaptureFile(path string, options CaptureOptions) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := device.startCapture(f, path, options); err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// startCaptureInDir starts a capture written to the file name in the capture
+// directory, for the capture_file UAPI key. The file is opened without
+// following symbolic links, and only truncated once it is known to be a
+// regular file, so that the capture cannot overwrite files outside the directory.
+func (device *Device) startCaptureInDir(name string, options CaptureOptions) error {
+	f, err := os.OpenFile(filepath.Join(device.captureDir, name), os.O_WRONLY|os.O_CREATE|captureDirFlags, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = fmt.Errorf("capture file %q is not a regular file", name)
+	}
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		err = device.startCapture(f, name, options)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// checkCaptureName checks that name can be given to the capture_file UAPI key,
+// which only writes files directly in the capture directory of the device.
+func (device *Device) checkCaptureName(name string) error {
+	if device.captureDir == "" {
+		return errors.New("packet captures are disabled without a capture directory")
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid capture file name %q: not a name in the capture directory", name)
+	}
+	return nil
+}
+
+// StopCapture stops the running capture, if any, once buffered packets have been written.
+func (device *Device) StopCapture() error {
+	if c := device.capture.Swap(nil); c != nil {
+		return device.finishCapture(c)
+	}
+	return nil
+}
+
+func (device *Device) finishCapture(c *packetCapture) error {
+	dropped, err := c.close()
+	if err != nil {
+		device.log.Log(conn.SubsystemDevice, conn.LevelError, "Packet capture failed", conn.ErrorField(err))
+	}
+	device.log.Log(conn.SubsystemDevice, conn.LevelInfo, "Packet capture stopped", conn.Field{Key: "dropped", Value: dropped})
+	return err
+}
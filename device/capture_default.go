@@ -0,0 +1,14 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "syscall"
+
+// captureDirFlags keep the capture_file UAPI key from opening a symbolic link
+// planted in the capture directory, or from blocking on a named pipe.
+const captureDirFlags = syscall.O_NOFOLLOW | syscall.O_NONBLOCK
@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+type pcapngPacket struct {
+	iface   uint32
+	length  uint32
+	data    []byte
+	inbound bool
+}
+
+// parsePcapng returns the packets of a pcapng stream after checking its
+// section header and interface descriptions.
+func parsePcapng(t *testing.T, b []byte) []pcapngPacket {
+	t.Helper()
+	var packets []pcapngPacket
+	interfaces := 0
+	for i := 0; len(b) > 0; i++ {
+		if len(b) < 12 {
+			t.Fatalf("truncated block header: %x", b)
+		}
+		typ := binary.LittleEndian.Uint32(b[0:])
+		size := binary.LittleEndian.Uint32(b[4:])
+		if size%4 != 0 || int(size) > len(b) || binary.LittleEndian.Uint32(b[size-4:]) != size {
+			t.Fatalf("block %d has invalid length %d", i, size)
+		}
+		body := b[8 : size-4]
+		switch {
+		case i == 0:
+			if typ != pcapngBlockSHB || binary.LittleEndian.Uint32(body) != pcapngByteOrder {
+				t.Fatalf("stream does not start with a section header block")
+			}
+		case typ == pcapngBlockIDB:
+			if binary.LittleEndian.Uint16(body) != pcapngLinktypeRaw {
+				t.Errorf("interface %d has wrong link type", interfaces)
+			}
+			interfaces++
+		case typ == pcapngBlockEPB:
+			captured := binary.LittleEndian.Uint32(body[12:])
+			p := pcapngPacket{
+				iface:  binary.LittleEndian.Uint32(body[0:]),
+				length: binary.LittleEndian.Uint32(body[16:]),
+				data:   body[20 : 20+captured],
+			}
+			if int(p.iface) >= interfaces {
+				t.Errorf("packet refers to undeclared interface %d", p.iface)
+			}
+			opts := body[20+(captured+3)&^3:]
+			if binary.LittleEndian.Uint16(opts) == pcapngOptFlags {
+				p.inbound = binary.LittleEndian.Uint32(opts[4:])&3 == pcapngFlagInbound
+			}
+			packets = append(packets, p)
+		default:
+			t.Fatalf("unexpected block type %#x", typ)
+		}
+		b = b[size:]
+	}
+	if interfaces != 2 {
+		t.Errorf("got %d interfaces, want 2", interfaces)
+	}
+	return packets
+}
+
+func TestCaptureFormat(t *testing.T) {
+	var buf bytes.Buffer
+	c, err := newPacketCapture(&buf, "", CaptureOptions{Snaplen: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.port.Store(51820)
+
+	short := []byte{0x45, 1, 2, 3, 4}
+	long := make([]byte, 100)
+	c.tunPacket(short, false)
+	c.tunPacket(long, true)
+	remote := conn.StdNetEndpoint(netip.MustParseAddrPort("[2001:db8::1]:12912"))
+	c.bindPacket(long, &remote, true)
+	if dropped, err := c.close(); err != nil || dropped != 0 {
+		t.Fatalf("close: dropped=%d err=%v", dropped, err)
+	}
+
+	packets := parsePcapng(t, buf.Bytes())
+	if len(packets) != 3 {
+		t.Fatalf("got %d packets, want 3", len(packets))
+	}
+	if p := packets[0]; p.iface != CaptureInterfaceTUN || p.inbound || !bytes.Equal(p.data, short) || p.length != 5 {
+		t.Errorf("unexpected outbound TUN packet: %+v", p)
+	}
+	if p := packets[1]; !p.inbound || len(p.data) != 40 || p.length != 100 {
+		t.Errorf("inbound TUN packet not truncated to snaplen: %+v", p)
+	}
+	p := packets[2]
+	if p.iface != CaptureInterfaceBind || !p.inbound || p.length != 40+8+100 {
+		t.Fatalf("unexpected Bind packet: %+v", p)
+	}
+	// The synthesized IPv6 header goes from the remote endpoint to the local port.
+	if p.data[0]>>4 != 6 || p.data[6] != 17 {
+		t.Errorf("Bind packet does not start with an IPv6 UDP header: %x", p.data)
+	}
+	if src, _ := netip.AddrFromSlice(p.data[IPv6offsetSrc : IPv6offsetSrc+16]); src != remote.DstIP() {
+		t.Errorf("source address = %v, want %v", src, remote.DstIP())
+	}
+}
+
+type blockingWriter struct {
+	bytes.Buffer
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	if w.entered != nil {
+		close(w.entered)
+		w.entered = nil
+		<-w.release
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestCaptureRingDropsOldest(t *testing.T) {
+	w := new(blockingWriter)
+	c, err := newPacketCapture(w, "", CaptureOptions{BufferPackets: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered := make(chan struct{})
+	w.entered, w.release = entered, make(chan struct{})
+
+	// The first packet stalls the writer, leaving the ring to fill up.
+	c.tunPacket([]byte{1}, false)
+	<-entered
+	for i := byte(2); i <= 5; i++ {
+		c.tunPacket([]byte{i}, false)
+	}
+	close(w.release)
+
+	dropped, err := c.close()
+	if err != nil || dropped != 2 {
+		t.Fatalf("close: dropped=%d err=%v, want 2 dropped", dropped, err)
+	}
+	var got []byte
+	for _, p := range parsePcapng(t, w.Bytes()) {
+		got = append(got, p.data...)
+	}
+	if !bytes.Equal(got, []byte{1, 4, 5}) {
+		t.Errorf("captured packets %v, want [1 4 5]", got)
+	}
+}
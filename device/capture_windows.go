@@ -0,0 +1,11 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+// captureDirFlags are empty, as Windows has no O_NOFOLLOW. Creating symbolic
+// links there takes privileges, and capture files are checked to be regular
+// files once opened.
+const captureDirFlags = 0
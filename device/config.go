@@ -0,0 +1,673 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Typed configuration
+ *
+ * DeviceConfig and PeerConfig model the keys of the configuration protocol.
+ * Device.Apply marshals a DeviceConfig and runs it as a set operation, and
+ * Device.Snapshot parses the output of a get operation, so the Go API and
+ * the text protocol share a single implementation.
+ *
+ * Nil and zero fields are left out of the text and leave the corresponding
+ * setting unchanged. Fields documented as reported are only filled in by
+ * Snapshot, and ignored by Apply.
+ *
+ * The values of the keys are parsed by unmarshalLine, for UnmarshalUAPI and
+ * for the set operations of the device alike, and the settings made of
+ * several keys are described by the tables below, which the get operation
+ * shares.
+ */
+
+// timerKeys are the keys of the protocol timers, and of the timers that
+// peers override.
+var timerKeys = []struct {
+	key    string
+	device func(*ProtocolTimers) *time.Duration
+	peer   func(*PeerTimers) *time.Duration // nil if peers do not override it
+}{
+	{"rekey_after_time", func(t *ProtocolTimers) *time.Duration { return &t.RekeyAfterTime }, nil},
+	{"reject_after_time", func(t *ProtocolTimers) *time.Duration { return &t.RejectAfterTime }, nil},
+	{"rekey_timeout", func(t *ProtocolTimers) *time.Duration { return &t.RekeyTimeout }, func(t *PeerTimers) *time.Duration { return &t.RekeyTimeout }},
+	{"rekey_attempt_time", func(t *ProtocolTimers) *time.Duration { return &t.RekeyAttemptTime }, func(t *PeerTimers) *time.Duration { return &t.RekeyAttemptTime }},
+	{"keepalive_timeout", func(t *ProtocolTimers) *time.Duration { return &t.KeepaliveTimeout }, func(t *PeerTimers) *time.Duration { return &t.KeepaliveTimeout }},
+}
+
+// deviceTimer returns the timer of t with the key, or nil if there is none.
+func deviceTimer(t *ProtocolTimers, key string) *time.Duration {
+	for _, k := range timerKeys {
+		if k.key == key {
+			return k.device(t)
+		}
+	}
+	return nil
+}
+
+// peerTimer returns the timer of t with the key, or nil if there is none.
+func peerTimer(t *PeerTimers, key string) *time.Duration {
+	for _, k := range timerKeys {
+		if k.key == key && k.peer != nil {
+			return k.peer(t)
+		}
+	}
+	return nil
+}
+
+// obfuscationKeys are the keys of an ObfuscationProfile. The fields are
+// *uint32 or *int.
+var obfuscationKeys = []struct {
+	key   string
+	field func(*ObfuscationProfile) any
+}{
+	{"obfuscation_initiation_type", func(p *ObfuscationProfile) any { return &p.InitiationType }},
+	{"obfuscation_response_type", func(p *ObfuscationProfile) any { return &p.ResponseType }},
+	{"obfuscation_cookie_reply_type", func(p *ObfuscationProfile) any { return &p.CookieReplyType }},
+	{"obfuscation_transport_type", func(p *ObfuscationProfile) any { return &p.TransportType }},
+	{"obfuscation_hybrid_initiation_type", func(p *ObfuscationProfile) any { return &p.HybridInitiationType }},
+	{"obfuscation_hybrid_response_type", func(p *ObfuscationProfile) any { return &p.HybridResponseType }},
+	{"obfuscation_junk_max", func(p *ObfuscationProfile) any { return &p.JunkPrefixMax }},
+	{"obfuscation_decoys", func(p *ObfuscationProfile) any { return &p.Decoys }},
+	{"obfuscation_decoy_min", func(p *ObfuscationProfile) any { return &p.DecoySizeMin }},
+	{"obfuscation_decoy_max", func(p *ObfuscationProfile) any { return &p.DecoySizeMax }},
+}
+
+// obfuscationValue returns the field of p with the key, or false if there is none.
+func obfuscationValue(p *ObfuscationProfile, key string) (uint64, bool) {
+	for _, k := range obfuscationKeys {
+		if k.key == key {
+			switch field := k.field(p).(type) {
+			case *uint32:
+				return uint64(*field), true
+			case *int:
+				return uint64(*field), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// setObfuscationValue sets the field of p with the key to n,
+// and reports whether there is one.
+func setObfuscationValue(p *ObfuscationProfile, key string, n uint32) bool {
+	for _, k := range obfuscationKeys {
+		if k.key == key {
+			switch field := k.field(p).(type) {
+			case *uint32:
+				*field = n
+			case *int:
+				*field = int(n)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// A DeviceConfig is the configuration of a Device.
+type DeviceConfig struct {
+	// PrivateKey replaces the private key; a zero key removes it.
+	PrivateKey *NoisePrivateKey
+
+	// RotatePrivateKey replaces the private key, keeping the previous one
+	// for KeyRotationGrace, or DefaultKeyRotationGrace if that is zero.
+	RotatePrivateKey *NoisePrivateKey
+	KeyRotationGrace *time.Duration
+
+	ListenPort   *uint16
+	FirewallMark *uint32
+	MTU          int // reported
+
+	// BrokenRoaming disables roaming for the peers with an endpoint,
+	// as DisableSomeRoamingForBrokenMobileSemantics does, or enables it again.
+	BrokenRoaming *bool
+
+	// State brings the device "up" or "down", once the rest is applied.
+	State string
+
+	// ReplaceSourceFilter removes the source filter of the device
+	// before adding the prefixes of SourceFilter.
+	ReplaceSourceFilter bool
+	SourceFilter        []netip.Prefix
+	SourceFilterDropped uint64 // reported
+
+	// ReplayWindow is the minimum anti-replay window in messages, zero for the default.
+	ReplayWindow *uint64
+
+	// ProtocolTimers replaces the non-zero timers of the device.
+	ProtocolTimers *ProtocolTimers
+
+	// Obfuscation replaces the obfuscation profile of the device.
+	Obfuscation *ObfuscationProfile
+
+	// Transport switches the transport to "udp", "tcp" or "tls".
+	Transport string
+
+	// TLS replaces the options of the TLS transport.
+	TLS *conn.TLSOptions
+
+	// Capture starts a packet capture to a file, or stops it.
+	Capture *CaptureConfig
+
+	// ReplacePeers removes all peers before configuring Peers.
+	ReplacePeers bool
+	Peers        []PeerConfig
+}
+
+// A CaptureConfig starts a packet capture written to File, a file name in
+// the directory set with WithCaptureDir, or stops the running capture if
+// File is empty.
+type CaptureConfig struct {
+	File    string
+	Options CaptureOptions
+}
+
+// A PeerConfig is the configuration of a peer of a Device.
+type PeerConfig struct {
+	PublicKey NoisePublicKey
+
+	// UpdateOnly only configures the peer if it exists already.
+	UpdateOnly bool
+
+	// Remove removes the peer.
+	Remove bool
+
+	PresharedKey *NoisePresharedKey
+	Endpoint     string // host:port, empty to leave unchanged
+	EndpointHost string // the hostname and port Endpoint is resolved from, if any
+
+	PersistentKeepaliveInterval *uint16 // in seconds, zero to disable
+
+	// ReplaceAllowedIPs removes the allowed IPs of the peer
+	// before adding AllowedIPs.
+	ReplaceAllowedIPs bool
+	AllowedIPs        []netip.Prefix
+
+	HybridHandshake *bool
+
+	// Timers replaces the timer overrides of the peer.
+	Timers *PeerTimers
+
+	ReplayWindow *uint64 // in messages, zero for the window of the device
+	TTL          *time.Duration
+	IdleTimeout  *time.Duration
+
+	// ReplaceSourceFilter removes the source filter of the peer
+	// before adding the prefixes of SourceFilter.
+	ReplaceSourceFilter bool
+	SourceFilter        []netip.Prefix
+	SourceFilterDropped uint64 // reported
+
+	LastHandshakeTime time.Time // reported, zero if there was none
+	TxBytes           uint64    // reported
+	RxBytes           uint64    // reported
+}
+
+// Apply applies config to the device as a single set operation.
+func (device *Device) Apply(config *DeviceConfig) error {
+	text, err := config.MarshalUAPI()
+	if err != nil {
+		return err
+	}
+	return device.IpcSetOperation(bytes.NewReader(text))
+}
+
+// Snapshot returns the configuration of the device, as reported by a get operation.
+func (device *Device) Snapshot() (*DeviceConfig, error) {
+	var buf bytes.Buffer
+	if err := device.IpcGetOperation(&buf); err != nil {
+		return nil, err
+	}
+	config := new(DeviceConfig)
+	if err := config.UnmarshalUAPI(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// uapiWriter writes the lines of a configuration.
+type uapiWriter struct {
+	bytes.Buffer
+}
+
+func (w *uapiWriter) line(key string, format string, args ...any) {
+	w.WriteString(key)
+	w.WriteByte('=')
+	fmt.Fprintf(w, format, args...)
+	w.WriteByte('\n')
+}
+
+func (w *uapiWriter) key(key string, k *[32]byte) {
+	w.line(key, "%s", hex.EncodeToString(k[:]))
+}
+
+func (w *uapiWriter) flag(key string, set bool) {
+	if set {
+		w.line(key, "true")
+	}
+}
+
+func (w *uapiWriter) seconds(key string, d time.Duration) {
+	w.line(key, "%d", d/time.Second)
+}
+
+func (w *uapiWriter) prefixes(key string, prefixes []netip.Prefix) {
+	for _, prefix := range prefixes {
+		w.line(key, "%s", prefix)
+	}
+}
+
+// MarshalUAPI returns config in the text format of a set operation,
+// without the operation line and the terminating blank line.
+func (config *DeviceConfig) MarshalUAPI() ([]byte, error) {
+	var w uapiWriter
+	if config.PrivateKey != nil {
+		w.key("private_key", (*[32]byte)(config.PrivateKey))
+	}
+	if config.KeyRotationGrace != nil {
+		w.seconds("key_rotation_grace", *config.KeyRotationGrace)
+	}
+	if config.RotatePrivateKey != nil {
+		w.key("rotate_private_key", (*[32]byte)(config.RotatePrivateKey))
+	}
+	if config.ListenPort != nil {
+		w.line("listen_port", "%d", *config.ListenPort)
+	}
+	if config.FirewallMark != nil {
+		w.line("fwmark", "%d", *config.FirewallMark)
+	}
+	if config.BrokenRoaming != nil {
+		w.line("broken_roaming", "%t", *config.BrokenRoaming)
+	}
+	w.flag("replace_source_filter", config.ReplaceSourceFilter)
+	w.prefixes("source_filter", config.SourceFilter)
+	if config.ReplayWindow != nil {
+		w.line("replay_window", "%d", *config.ReplayWindow)
+	}
+	if t := config.ProtocolTimers; t != nil {
+		for _, k := range timerKeys {
+			if d := *k.device(t); d != 0 {
+				w.seconds(k.key, d)
+			}
+		}
+	}
+	if p := config.Obfuscation; p != nil {
+		for _, k := range obfuscationKeys {
+			n, _ := obfuscationValue(p, k.key)
+			w.line(k.key, "%d", n)
+		}
+	}
+	if config.Transport != "" {
+		w.line("transport", "%s", config.Transport)
+	}
+	if t := config.TLS; t != nil {
+		if strings.ContainsAny(t.ServerName+t.Fingerprint, "\n") {
+			return nil, fmt.Errorf("invalid TLS options %+v", *t)
+		}
+		w.line("tls_server_name", "%s", t.ServerName)
+		w.line("tls_fingerprint", "%s", t.Fingerprint)
+	}
+	if c := config.Capture; c != nil {
+		if strings.Contains(c.File, "\n") {
+			return nil, fmt.Errorf("invalid capture file name %q", c.File)
+		}
+		if c.File != "" {
+			w.line("capture_snaplen", "%d", c.Options.Snaplen)
+			w.line("capture_buffer", "%d", c.Options.BufferPackets)
+		}
+		w.line("capture_file", "%s", c.File)
+	}
+	if config.State != "" {
+		if strings.Contains(config.State, "\n") {
+			return nil, fmt.Errorf("invalid state %q", config.State)
+		}
+		w.line("state", "%s", config.State)
+	}
+	w.flag("replace_peers", config.ReplacePeers)
+
+	for i := range config.Peers {
+		if err := config.Peers[i].marshal(&w); err != nil {
+			return nil, err
+		}
+	}
+	return w.Bytes(), nil
+}
+
+func (peer *PeerConfig) marshal(w *uapiWriter) error {
+	w.key("public_key", (*[32]byte)(&peer.PublicKey))
+	w.flag("update_only", peer.UpdateOnly)
+	w.flag("remove", peer.Remove)
+	if peer.PresharedKey != nil {
+		w.key("preshared_key", (*[32]byte)(peer.PresharedKey))
+	}
+	if peer.Endpoint != "" {
+		if strings.Contains(peer.Endpoint, "\n") {
+			return fmt.Errorf("invalid endpoint %q", peer.Endpoint)
+		}
+		w.line("endpoint", "%s", peer.Endpoint)
+	}
+	if peer.EndpointHost != "" {
+		if strings.Contains(peer.EndpointHost, "\n") {
+			return fmt.Errorf("invalid endpoint %q", peer.EndpointHost)
+		}
+		w.line("endpoint_host", "%s", peer.EndpointHost)
+	}
+	if peer.PersistentKeepaliveInterval != nil {
+		w.line("persistent_keepalive_interval", "%d", *peer.PersistentKeepaliveInterval)
+	}
+	w.flag("replace_allowed_ips", peer.ReplaceAllowedIPs)
+	w.prefixes("allowed_ip", peer.AllowedIPs)
+	if peer.HybridHandshake != nil {
+		w.line("hybrid_handshake", "%t", *peer.HybridHandshake)
+	}
+	if t := peer.Timers; t != nil {
+		for _, k := range timerKeys {
+			if k.peer != nil {
+				w.seconds(k.key, *k.peer(t))
+			}
+		}
+	}
+	if peer.ReplayWindow != nil {
+		w.line("replay_window", "%d", *peer.ReplayWindow)
+	}
+	if peer.TTL != nil {
+		w.seconds("ttl", *peer.TTL)
+	}
+	if peer.IdleTimeout != nil {
+		w.seconds("idle_timeout", *peer.IdleTimeout)
+	}
+	w.flag("replace_source_filter", peer.ReplaceSourceFilter)
+	w.prefixes("source_filter", peer.SourceFilter)
+	return nil
+}
+
+// UnmarshalUAPI parses the text format of a set operation, or the output of
+// a get operation, into config. It stops at a blank line or errno line.
+func (config *DeviceConfig) UnmarshalUAPI(text []byte) error {
+	*config = DeviceConfig{}
+	var peer *PeerConfig
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("failed to parse line %q", line)
+		}
+		var err error
+		switch {
+		case key == "errno":
+			if value != "0" {
+				return fmt.Errorf("operation failed with errno %s", value)
+			}
+			return nil
+		case key == "public_key":
+			config.Peers = append(config.Peers, PeerConfig{})
+			peer = &config.Peers[len(config.Peers)-1]
+			err = peer.PublicKey.FromHex(value)
+		case peer == nil:
+			err = config.unmarshalLine(key, value)
+		default:
+			err = peer.unmarshalLine(key, value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func parseSeconds(value string) (time.Duration, error) {
+	secs, err := strconv.ParseUint(value, 10, 32)
+	return time.Duration(secs) * time.Second, err
+}
+
+func parseTrue(value string) (bool, error) {
+	if value != "true" {
+		return false, fmt.Errorf("invalid value %q", value)
+	}
+	return true, nil
+}
+
+func (config *DeviceConfig) unmarshalLine(key, value string) (err error) {
+	switch key {
+	case "private_key", "rotate_private_key":
+		var sk NoisePrivateKey
+		if err := sk.FromMaybeZeroHex(value); err != nil {
+			return err
+		}
+		if key == "private_key" {
+			config.PrivateKey = &sk
+		} else {
+			config.RotatePrivateKey = &sk
+		}
+	case "key_rotation_grace":
+		grace, err := parseSeconds(value)
+		if err != nil {
+			return err
+		}
+		config.KeyRotationGrace = &grace
+	case "listen_port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return err
+		}
+		config.ListenPort = new(uint16)
+		*config.ListenPort = uint16(port)
+	case "fwmark":
+		mark, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		config.FirewallMark = new(uint32)
+		*config.FirewallMark = uint32(mark)
+	case "mtu":
+		config.MTU, err = strconv.Atoi(value)
+	case "broken_roaming":
+		broken, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		config.BrokenRoaming = &broken
+	case "state":
+		config.State = value
+	case "replace_source_filter":
+		config.ReplaceSourceFilter, err = parseTrue(value)
+	case "source_filter":
+		prefix, err := parseSourcePrefix(value)
+		if err != nil {
+			return err
+		}
+		config.SourceFilter = append(config.SourceFilter, prefix)
+	case "source_filter_dropped":
+		config.SourceFilterDropped, err = strconv.ParseUint(value, 10, 64)
+	case "replay_window":
+		size, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		config.ReplayWindow = &size
+	case "capture_snaplen", "capture_buffer":
+		n, err := strconv.ParseUint(value, 10, 20)
+		if err != nil {
+			return err
+		}
+		if config.Capture == nil {
+			config.Capture = new(CaptureConfig)
+		}
+		if key == "capture_snaplen" {
+			config.Capture.Options.Snaplen = int(n)
+		} else {
+			config.Capture.Options.BufferPackets = int(n)
+		}
+	case "transport":
+		config.Transport = value
+	case "tls_server_name", "tls_fingerprint":
+		if config.TLS == nil {
+			config.TLS = new(conn.TLSOptions)
+		}
+		if key == "tls_server_name" {
+			config.TLS.ServerName = value
+		} else {
+			config.TLS.Fingerprint = value
+		}
+	case "capture_file":
+		if config.Capture == nil {
+			config.Capture = new(CaptureConfig)
+		}
+		config.Capture.File = value
+	case "replace_peers":
+		config.ReplacePeers, err = parseTrue(value)
+	default:
+		return config.unmarshalGroupLine(key, value)
+	}
+	return err
+}
+
+// unmarshalGroupLine parses the keys of the protocol timers and of the
+// obfuscation profile, which are in tables.
+func (config *DeviceConfig) unmarshalGroupLine(key, value string) error {
+	if deviceTimer(new(ProtocolTimers), key) != nil {
+		d, err := parseSeconds(value)
+		if err != nil {
+			return err
+		}
+		if config.ProtocolTimers == nil {
+			config.ProtocolTimers = new(ProtocolTimers)
+		}
+		*deviceTimer(config.ProtocolTimers, key) = d
+		return nil
+	}
+	if _, ok := obfuscationValue(new(ObfuscationProfile), key); ok {
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		if config.Obfuscation == nil {
+			config.Obfuscation = new(ObfuscationProfile)
+		}
+		setObfuscationValue(config.Obfuscation, key, uint32(n))
+		return nil
+	}
+	return fmt.Errorf("unknown device key")
+}
+
+func (peer *PeerConfig) unmarshalLine(key, value string) (err error) {
+	switch key {
+	case "update_only":
+		peer.UpdateOnly, err = parseTrue(value)
+	case "remove":
+		peer.Remove, err = parseTrue(value)
+	case "preshared_key":
+		var psk NoisePresharedKey
+		if err := psk.FromHex(value); err != nil {
+			return err
+		}
+		peer.PresharedKey = &psk
+	case "endpoint":
+		peer.Endpoint = value
+	case "endpoint_host":
+		peer.EndpointHost = value
+	case "persistent_keepalive_interval":
+		secs, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return err
+		}
+		peer.PersistentKeepaliveInterval = new(uint16)
+		*peer.PersistentKeepaliveInterval = uint16(secs)
+	case "replace_allowed_ips":
+		peer.ReplaceAllowedIPs, err = parseTrue(value)
+	case "allowed_ip":
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return err
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, prefix)
+	case "hybrid_handshake":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		peer.HybridHandshake = &enabled
+	case "replay_window":
+		size, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		peer.ReplayWindow = &size
+	case "ttl", "idle_timeout":
+		d, err := parseSeconds(value)
+		if err != nil {
+			return err
+		}
+		if key == "ttl" {
+			peer.TTL = &d
+		} else {
+			peer.IdleTimeout = &d
+		}
+	case "replace_source_filter":
+		peer.ReplaceSourceFilter, err = parseTrue(value)
+	case "source_filter":
+		prefix, err := parseSourcePrefix(value)
+		if err != nil {
+			return err
+		}
+		peer.SourceFilter = append(peer.SourceFilter, prefix)
+	case "source_filter_dropped":
+		peer.SourceFilterDropped, err = strconv.ParseUint(value, 10, 64)
+	case "last_handshake_time_sec":
+		secs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		if secs != 0 {
+			peer.LastHandshakeTime = time.Unix(secs, 0)
+		}
+	case "last_handshake_time_nsec":
+		nsecs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		if !peer.LastHandshakeTime.IsZero() {
+			peer.LastHandshakeTime = peer.LastHandshakeTime.Add(time.Duration(nsecs))
+		}
+	case "tx_bytes":
+		peer.TxBytes, err = strconv.ParseUint(value, 10, 64)
+	case "rx_bytes":
+		peer.RxBytes, err = strconv.ParseUint(value, 10, 64)
+	case "protocol_version":
+		if value != "1" {
+			return fmt.Errorf("unsupported version %q", value)
+		}
+	default:
+		if peerTimer(new(PeerTimers), key) == nil {
+			return fmt.Errorf("unknown peer key")
+		}
+		d, err := parseSeconds(value)
+		if err != nil {
+			return err
+		}
+		if peer.Timers == nil {
+			peer.Timers = new(PeerTimers)
+		}
+		*peerTimer(peer.Timers, key) = d
+	}
+	return err
+}
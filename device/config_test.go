@@ -0,0 +1,164 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func testDeviceConfig(t *testing.T) *DeviceConfig {
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peerSK, err := newPrivateKey()
+	assertNil(t, err)
+	var psk NoisePresharedKey
+	psk[0] = 1
+	timers := DefaultProtocolTimers()
+	timers.KeepaliveTimeout = 20 * time.Second
+	return &DeviceConfig{
+		PrivateKey:       &sk,
+		KeyRotationGrace: ptr(time.Minute),
+		FirewallMark:     ptr[uint32](0),
+		SourceFilter:     []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		ReplayWindow:     ptr[uint64](100000),
+		ProtocolTimers:   &timers,
+		Obfuscation:      &ObfuscationProfile{InitiationType: 7, ResponseType: 8, CookieReplyType: 9, TransportType: 10, JunkPrefixMax: 16},
+		Peers: []PeerConfig{{
+			PublicKey:                   peerSK.publicKey(),
+			PresharedKey:                &psk,
+			Endpoint:                    "127.0.0.1:51820",
+			PersistentKeepaliveInterval: ptr[uint16](25),
+			AllowedIPs:                  []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("fd00::/64")},
+			HybridHandshake:             ptr(hybridSupported),
+			Timers:                      &PeerTimers{RekeyTimeout: 10 * time.Second},
+			ReplayWindow:                ptr[uint64](200000),
+			IdleTimeout:                 ptr(time.Hour),
+			SourceFilter:                []netip.Prefix{netip.MustParsePrefix("10.1.2.0/24")},
+		}},
+	}
+}
+
+func TestDeviceConfigMarshal(t *testing.T) {
+	config := testDeviceConfig(t)
+	config.RotatePrivateKey = config.PrivateKey
+	config.ListenPort = ptr[uint16](51820)
+	config.ReplaceSourceFilter = true
+	config.BrokenRoaming = ptr(true)
+	config.State = "up"
+	config.Transport = "tls"
+	config.TLS = &conn.TLSOptions{ServerName: "example.com"}
+	config.Capture = &CaptureConfig{File: "/tmp/wg.pcapng", Options: CaptureOptions{Snaplen: 128, BufferPackets: 64}}
+	config.ReplacePeers = true
+	peer := &config.Peers[0]
+	peer.UpdateOnly = true
+	peer.ReplaceAllowedIPs = true
+	peer.ReplaceSourceFilter = true
+	peer.TTL = ptr(time.Minute)
+	peer.EndpointHost = "vpn.example.com:51820"
+	config.Peers = append(config.Peers, PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+
+	text, err := config.MarshalUAPI()
+	assertNil(t, err)
+	var parsed DeviceConfig
+	assertNil(t, parsed.UnmarshalUAPI(text))
+	if !reflect.DeepEqual(&parsed, config) {
+		t.Errorf("round trip of\n%s\ngave %+v, want %+v", text, parsed, config)
+	}
+
+	for _, invalid := range []string{
+		"listen_port=65536\n",
+		"public_key=00\n",
+		"replace_peers=false\n",
+		"unknown=1\n",
+		"private_key\n",
+	} {
+		if err := parsed.UnmarshalUAPI([]byte(invalid)); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
+
+// TestUnmarshalUAPISetKeys checks that set operations reject the values
+// UnmarshalUAPI rejects, since both parse them with unmarshalLine.
+func TestUnmarshalUAPISetKeys(t *testing.T) {
+	device := newDownDevice(t)
+	peerKey := randPublicKeyHex(t)
+	for _, cfg := range []string{
+		uapiCfg("listen_port", "65536"),
+		uapiCfg("rekey_timeout", "soon"),
+		uapiCfg("obfuscation_decoys", "-1"),
+		uapiCfg("capture_buffer", "2000000"),
+		uapiCfg("broken_roaming", "maybe"),
+		uapiCfg("no_such_key", "1"),
+		uapiCfg("public_key", peerKey, "ttl", "-1"),
+		uapiCfg("public_key", peerKey, "keepalive_timeout", "4294967296"),
+		uapiCfg("public_key", peerKey, "persistent_keepalive_interval", "65536"),
+		uapiCfg("public_key", peerKey, "allowed_ip", "10.0.0.0/33"),
+		uapiCfg("public_key", peerKey, "protocol_version", "2"),
+		uapiCfg("public_key", peerKey, "no_such_key", "1"),
+	} {
+		var config DeviceConfig
+		if err := config.UnmarshalUAPI([]byte(cfg)); err == nil {
+			t.Errorf("%q parsed", cfg)
+		}
+		if err := device.IpcSet(cfg); err == nil {
+			t.Errorf("%q set", cfg)
+		}
+	}
+}
+
+func TestApplySnapshot(t *testing.T) {
+	device := randDevice(t, WithCaptureDir(t.TempDir()))
+	defer device.Close()
+	config := testDeviceConfig(t)
+	config.Capture = &CaptureConfig{File: "wg.pcapng"}
+	assertNil(t, device.Apply(config))
+	defer device.StopCapture()
+
+	snapshot, err := device.Snapshot()
+	assertNil(t, err)
+	want := *config
+	want.ListenPort = snapshot.ListenPort // the device may have come up meanwhile
+	want.FirewallMark = nil               // zero marks are not reported
+	want.State = snapshot.State
+	want.MTU = tuntest.DefaultMTU
+	want.BrokenRoaming = ptr(false)
+	want.Transport = "udp"
+	want.Capture.Options.BufferPackets = DefaultCaptureBufferPackets
+	want.Peers = []PeerConfig{config.Peers[0]}
+	if !hybridSupported {
+		want.Peers[0].HybridHandshake = nil
+	}
+	// The peer may have sent handshakes if the device came up.
+	snapshot.Peers[0].TxBytes = 0
+	if !reflect.DeepEqual(snapshot, &want) {
+		t.Errorf("Snapshot() = %+v, want %+v", snapshot, &want)
+	}
+
+	// A snapshot applied to another device configures it the same way.
+	other := randDevice(t)
+	defer other.Close()
+	snapshot.ListenPort = nil
+	snapshot.State = ""
+	snapshot.Capture = nil
+	assertNil(t, other.Apply(snapshot))
+	device.StopCapture()
+	withoutPortAndState := func(cfg string) string {
+		return regexp.MustCompile(`(?m)^(listen_port|state)=.*\n`).ReplaceAllString(cfg, "")
+	}
+	if got, want := withoutPortAndState(ipcConfig(t, other)), withoutPortAndState(ipcConfig(t, device)); got != want {
+		t.Errorf("applied snapshot gave\n%s\nwant\n%s", got, want)
+	}
+}
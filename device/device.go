@@ -6,8 +6,6 @@
 package device
 
 import (
-	"net"
-	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,6 +14,7 @@ import (
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/ratelimiter"
 	"golang.zx2c4.com/wireguard/rwcancel"
+	"golang.zx2c4.com/wireguard/tai64n"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
@@ -51,13 +50,16 @@ type Device struct {
 
 	staticIdentity struct {
 		sync.RWMutex
-		privateKey NoisePrivateKey
+		identity   StaticIdentity  // nil if there is no static key
+		privateKey NoisePrivateKey // zero unless the identity is held in memory
 		publicKey  NoisePublicKey
+		previous   atomic.Pointer[retiredIdentity] // written with the lock held
 	}
 
 	peers struct {
-		sync.RWMutex // protects keyMap
+		sync.RWMutex // protects keyMap and expiring
 		keyMap       map[NoisePublicKey]*Peer
+		expiring     map[*Peer]struct{} // peers with a TTL or idle timeout
 	}
 
 	rate struct {
@@ -86,12 +88,35 @@ type Device struct {
 		mtu    atomic.Int32
 	}
 
+	capture    atomic.Pointer[packetCapture]
+	captureDir string // where the capture_file UAPI key writes, if set
+	// captureOptions are the options for the next capture started through UAPI,
+	// guarded by ipcMutex.
+	captureOptions CaptureOptions
+	// keyRotationGrace is the grace period of rotate_private_key, guarded by ipcMutex.
+	keyRotationGrace time.Duration
+	// ipcGeneration counts the set operations applied, guarded by ipcMutex.
+	ipcGeneration uint64
+
 	ipcMutex sync.RWMutex
 	closed   chan struct{}
 	log      *Logger
 
-	handshakeStateChan chan<- HandshakeState
-	allowedSrcAddresses []net.IP
+	sourceFilter   sourceFilter
+	obfuscation    atomic.Pointer[obfuscation]
+	protocolTimers atomic.Pointer[ProtocolTimers]
+	pskProvider    atomic.Pointer[presharedKeyProviderHolder]
+	peerResolver   atomic.Pointer[peerResolver]
+	hostResolver   atomic.Pointer[hostResolver]
+	replayWindow   atomic.Uint64 // minimum anti-replay window in messages, zero for the default
+	timestamps     atomic.Pointer[tai64n.Source]
+	queueSizes     QueueSizes
+	clock          Clock
+	bindFactory    BindFactory
+
+	handshakeEvents   eventRegistry[HandshakeEvent]
+	peerRemovedEvents eventRegistry[PeerRemovedEvent]
+	events            eventRegistry[Event]
 }
 
 type HandshakeState int
@@ -100,6 +125,11 @@ const (
 	HandshakeInit    HandshakeState = iota
 	HandshakeSuccess                = iota
 	HandshakeFail                   = iota
+
+	// HandshakeRejected reports an initiation from a peer that was refused,
+	// such as a replay. It is not a failure of the handshakes of the device,
+	// and is not sent to the channel of WithHandshakeStateChan.
+	HandshakeRejected = iota
 )
 
 // deviceState represents the state of a Device.
@@ -136,14 +166,21 @@ func (device *Device) isUp() bool {
 	return device.deviceState() == deviceStateUp
 }
 
+// State returns the state of the device: "up", "down" or "closed".
+func (device *Device) State() string {
+	return strings.ToLower(device.deviceState().String())
+}
+
 // Must hold device.peers.Lock()
-func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
+func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey, reason PeerRemovalReason) {
 	// stop routing and processing of packets
 	device.allowedips.RemoveByPeer(peer)
 	peer.Stop()
 
 	// remove from peer map
 	delete(device.peers.keyMap, key)
+	delete(device.peers.expiring, peer)
+	device.publishEvent(Event{Kind: EventPeerRemoved, PublicKey: key, Reason: string(reason)})
 }
 
 // changeState attempts to change the device state to match want.
@@ -173,7 +210,11 @@ func (device *Device) changeState(want deviceState) (err error) {
 			err = errDown
 		}
 	}
-	device.log.Verbosef("Interface state was %s, requested %s, now %s", old, want, device.deviceState())
+	device.log.Log(conn.SubsystemDevice, conn.LevelInfo, "Interface state changed",
+		conn.Field{Key: "old", Value: old}, conn.Field{Key: "requested", Value: want}, conn.StateField(device.deviceState()))
+	if device.deviceState() != old {
+		device.publishEvent(Event{Kind: EventStateChanged, State: device.State()})
+	}
 	return
 }
 
@@ -182,7 +223,7 @@ func (device *Device) changeState(want deviceState) (err error) {
 func (device *Device) upLocked() error {
 	device.UpdateHandshakeState(HandshakeInit)
 	if err := device.BindUpdate(); err != nil {
-		device.log.Errorf("Unable to update bind: %v", err)
+		device.log.Log(conn.SubsystemBind, conn.LevelError, "Unable to update bind", conn.TransportField(conn.TransportOf(device.net.bind)), conn.ErrorField(err))
 		return err
 	}
 
@@ -228,8 +269,8 @@ func (device *Device) Down() error {
 
 func (device *Device) IsUnderLoad() bool {
 	// check if currently under load
-	now := time.Now()
-	underLoad := len(device.queue.handshake.c) >= QueueHandshakeSize/8
+	now := device.now()
+	underLoad := len(device.queue.handshake.c) >= device.queueSizes.Handshake/8
 	if underLoad {
 		device.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime).UnixNano())
 		return true
@@ -244,10 +285,21 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	device.staticIdentity.Lock()
 	defer device.staticIdentity.Unlock()
 
-	if sk.Equals(device.staticIdentity.privateKey) {
+	if sk.Equals(device.staticIdentity.privateKey) && sk.IsZero() == (device.staticIdentity.identity == nil) {
 		return nil
 	}
 
+	device.dropRetiredKeyLocked()
+	old := device.staticIdentity.identity
+	device.setIdentityLocked(newMemoryIdentity(sk), true)
+	clearIdentity(old)
+	return nil
+}
+
+// setIdentityLocked replaces the static identity and, if expire is set,
+// expires the current keypairs of all peers.
+// The caller must hold device.staticIdentity locked for writing.
+func (device *Device) setIdentityLocked(id StaticIdentity, expire bool) {
 	device.peers.Lock()
 	defer device.peers.Unlock()
 
@@ -259,18 +311,25 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 
 	// remove peers with matching public keys
 
-	publicKey := sk.publicKey()
+	var publicKey NoisePublicKey
+	if id != nil {
+		publicKey = id.PublicKey()
+	}
 	for key, peer := range device.peers.keyMap {
 		if peer.handshake.remoteStatic.Equals(publicKey) {
 			peer.handshake.mutex.RUnlock()
-			removePeerLocked(device, peer, key)
+			removePeerLocked(device, peer, key, "")
 			peer.handshake.mutex.RLock()
 		}
 	}
 
 	// update key material
 
-	device.staticIdentity.privateKey = sk
+	device.staticIdentity.identity = id
+	device.staticIdentity.privateKey = NoisePrivateKey{}
+	if id, ok := id.(*memoryIdentity); ok {
+		device.staticIdentity.privateKey = id.privateKey
+	}
 	device.staticIdentity.publicKey = publicKey
 	device.cookieChecker.Init(publicKey)
 
@@ -279,34 +338,69 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	expiredPeers := make([]*Peer, 0, len(device.peers.keyMap))
 	for _, peer := range device.peers.keyMap {
 		handshake := &peer.handshake
-		handshake.precomputedStaticStatic, _ = device.staticIdentity.privateKey.sharedSecret(handshake.remoteStatic)
+		handshake.precomputedStaticStatic, _ = sharedSecret(id, handshake.remoteStatic)
 		expiredPeers = append(expiredPeers, peer)
 	}
 
 	for _, peer := range lockedPeers {
 		peer.handshake.mutex.RUnlock()
 	}
+	if !expire {
+		return
+	}
 	for _, peer := range expiredPeers {
 		peer.ExpireCurrentKeypairs()
 	}
+}
 
-	return nil
+// NewDevice creates a Device reading from tunDevice and sending through bind.
+// The device starts down; see Option for the optional settings.
+// NewDevice panics if an option is invalid; CreateDevice returns the error instead.
+func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger, opts ...Option) *Device {
+	device, err := CreateDevice(tunDevice, bind, logger, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return device
+}
+
+// CreateDevice is like NewDevice, but returns an error if an option is invalid,
+// such as a source filter given by the user.
+func CreateDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger, opts ...Option) (*Device, error) {
+	options := newDeviceOptions(opts)
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return newDevice(tunDevice, bind, logger, options), nil
 }
 
-func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger, handshakeStateChan chan<- HandshakeState, allowedSrcAddresses string) *Device {
+func newDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger, options deviceOptions) *Device {
 	device := new(Device)
 	device.state.state.Store(uint32(deviceStateDown))
-	device.handshakeStateChan = handshakeStateChan
-	var allowedSources = strings.Split(allowedSrcAddresses, ",")
-	device.allowedSrcAddresses = make([]net.IP, len(allowedSources))
-	for i, source := range allowedSources {
-		ip := net.ParseIP(source)
-		if ip != nil {
-			device.allowedSrcAddresses[i] = ip
-		}
-	}
+	device.queueSizes = options.queueSizes
+	device.clock = options.clock
+	device.bindFactory = options.bindFactory
+	device.captureDir = options.captureDir
+	if device.bindFactory == nil {
+		device.bindFactory = device.defaultBindFactory
+	}
+	timers := DefaultProtocolTimers()
+	device.protocolTimers.Store(&timers)
+	device.SetHostResolver(DefaultHostResolver, HostResolverOptions{})
+	device.timestamps.Store(device.newTimestampSource())
 	device.closed = make(chan struct{})
 	device.log = logger
+	if options.logHandler != nil {
+		device.log = &Logger{conn.Logger{
+			Verbosef: logger.Verbosef,
+			Errorf:   logger.Errorf,
+			Handler:  options.logHandler,
+		}}
+	}
+	if options.handshakeStateChan != nil {
+		go forwardHandshakeStates(device.SubscribeHandshakes(0), options.handshakeStateChan, device.closed)
+	}
+	device.SetSourceFilter(options.sourceFilter) // validated by CreateDevice
 	device.net.bind = bind
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
@@ -316,22 +410,23 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger, handshakeSt
 	}
 	device.tun.mtu.Store(int32(mtu))
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.expiring = make(map[*Peer]struct{})
 	device.rate.limiter.Init()
 	device.indexTable.Init()
 	device.PopulatePools()
 
 	// create queues
 
-	device.queue.handshake = newHandshakeQueue()
-	device.queue.encryption = newOutboundQueue()
-	device.queue.decryption = newInboundQueue()
+	device.queue.handshake = newHandshakeQueue(device.queueSizes.Handshake)
+	device.queue.encryption = newOutboundQueue(device.queueSizes.Outbound)
+	device.queue.decryption = newInboundQueue(device.queueSizes.Inbound)
 
 	// start workers
 
-	cpus := runtime.NumCPU()
+	workers := options.workers
 	device.state.stopping.Wait()
-	device.queue.encryption.wg.Add(cpus) // One for each RoutineHandshake
-	for i := 0; i < cpus; i++ {
+	device.queue.encryption.wg.Add(workers) // One for each RoutineHandshake
+	for i := 0; i < workers; i++ {
 		go device.RoutineEncryption(i + 1)
 		go device.RoutineDecryption(i + 1)
 		go device.RoutineHandshake(i + 1)
@@ -341,6 +436,7 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger, handshakeSt
 	device.queue.encryption.wg.Add(1) // RoutineReadFromTUN
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
+	go device.RoutineExpirePeers()
 
 	return device
 }
@@ -359,7 +455,7 @@ func (device *Device) RemovePeer(key NoisePublicKey) {
 
 	peer, ok := device.peers.keyMap[key]
 	if ok {
-		removePeerLocked(device, peer, key)
+		removePeerLocked(device, peer, key, "")
 	}
 }
 
@@ -368,10 +464,11 @@ func (device *Device) RemoveAllPeers() {
 	defer device.peers.Unlock()
 
 	for key, peer := range device.peers.keyMap {
-		removePeerLocked(device, peer, key)
+		removePeerLocked(device, peer, key, "")
 	}
 
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.expiring = make(map[*Peer]struct{})
 }
 
 func (device *Device) Close() {
@@ -399,17 +496,18 @@ func (device *Device) Close() {
 	device.state.stopping.Wait()
 
 	device.rate.limiter.Close()
+	device.StopCapture()
+
+	device.staticIdentity.Lock()
+	device.dropRetiredKeyLocked()
+	device.staticIdentity.Unlock()
 
 	device.log.Verbosef("Device closed")
 	close(device.closed)
-	close(device.handshakeStateChan)
-}
-
-func (device *Device) UpdateHandshakeState(state HandshakeState) {
-	select {
-	case device.handshakeStateChan <- state:
-	case <- device.closed:
-	}
+	device.publishEvent(Event{Kind: EventStateChanged, State: "closed"})
+	device.handshakeEvents.close()
+	device.peerRemovedEvents.close()
+	device.events.close()
 }
 
 func (device *Device) Wait() chan struct{} {
@@ -424,7 +522,7 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.keypairs.RLock()
-		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(time.Now())
+		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(device.timers().RejectAfterTime).Before(device.now())
 		peer.keypairs.RUnlock()
 		if sendKeepalive {
 			peer.SendKeepalive()
@@ -515,6 +613,10 @@ func (device *Device) BindUpdate() error {
 		return err
 	}
 
+	if c := device.capture.Load(); c != nil {
+		c.port.Store(uint32(netc.port))
+	}
+
 	// set fwmark
 	if netc.fwmark != 0 {
 		err = netc.bind.SetMark(netc.fwmark)
@@ -542,7 +644,7 @@ func (device *Device) BindUpdate() error {
 		go device.RoutineReceiveIncoming(fn)
 	}
 
-	device.log.Verbosef("UDP bind has been updated")
+	device.log.Log(conn.SubsystemBind, conn.LevelDebug, "Bind has been updated", conn.TransportField(conn.TransportOf(netc.bind)), conn.Field{Key: "port", Value: netc.port})
 	return nil
 }
 
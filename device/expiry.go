@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Peer expiry
+ *
+ * A peer may be given a time to live, after which it is removed,
+ * and an idle timeout, after which it is removed unless an authenticated
+ * packet was received from it. The device checks the peers that have
+ * either once per ExpiryCheckInterval and publishes a PeerRemovedEvent
+ * for each peer it removes.
+ */
+
+const ExpiryCheckInterval = time.Second
+
+// A PeerRemovalReason tells why the device removed a peer by itself.
+type PeerRemovalReason string
+
+const (
+	PeerRemovedTTL  PeerRemovalReason = "ttl"  // the time to live of the peer ran out
+	PeerRemovedIdle PeerRemovalReason = "idle" // nothing was received from the peer for its idle timeout
+)
+
+// A PeerRemovedEvent reports a peer removed by the device.
+type PeerRemovedEvent struct {
+	PublicKey NoisePublicKey
+	Time      time.Time
+	Reason    PeerRemovalReason
+}
+
+// SubscribePeerRemovals returns a subscription to the removals of expired peers
+// holding up to buffer events; zero selects DefaultSubscriptionBuffer.
+func (device *Device) SubscribePeerRemovals(buffer int) *Subscription[PeerRemovedEvent] {
+	return device.peerRemovedEvents.subscribe(buffer)
+}
+
+// SetTTL makes the device remove the peer once ttl has elapsed.
+// A ttl of zero keeps the peer until it is removed explicitly.
+// It must not be called with device.peers locked.
+func (peer *Peer) SetTTL(ttl time.Duration) {
+	var deadline int64
+	if ttl > 0 {
+		deadline = peer.device.now().Add(ttl).UnixNano()
+	}
+	peer.expiry.deadline.Store(deadline)
+	peer.updateExpiring()
+}
+
+// Expires returns the time at which the TTL of the peer runs out, if it has one.
+func (peer *Peer) Expires() (time.Time, bool) {
+	deadline := peer.expiry.deadline.Load()
+	if deadline == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, deadline), true
+}
+
+// SetIdleTimeout makes the device remove the peer once nothing has been
+// received from it for timeout. A timeout of zero disables this.
+// It must not be called with device.peers locked.
+func (peer *Peer) SetIdleTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	if peer.expiry.idleTimeout.Swap(int64(timeout)) == 0 {
+		peer.expiry.lastActivity.Store(peer.device.now().UnixNano())
+	}
+	peer.updateExpiring()
+}
+
+// IdleTimeout returns the idle timeout of the peer.
+func (peer *Peer) IdleTimeout() time.Duration {
+	return time.Duration(peer.expiry.idleTimeout.Load())
+}
+
+// updateExpiring adds the peer to the peers checked for expiry, or removes it.
+func (peer *Peer) updateExpiring() {
+	device := peer.device
+	device.peers.Lock()
+	defer device.peers.Unlock()
+	if device.peers.keyMap[peer.handshake.remoteStatic] != peer {
+		return
+	}
+	if peer.expiry.deadline.Load() != 0 || peer.expiry.idleTimeout.Load() != 0 {
+		device.peers.expiring[peer] = struct{}{}
+	} else {
+		delete(device.peers.expiring, peer)
+	}
+}
+
+// markActive records that an authenticated packet was received from the peer.
+func (peer *Peer) markActive() {
+	if peer.expiry.idleTimeout.Load() != 0 {
+		peer.expiry.lastActivity.Store(peer.device.now().UnixNano())
+	}
+}
+
+// expired returns why the peer has expired at now, or "" if it has not.
+func (peer *Peer) expired(now int64) PeerRemovalReason {
+	if deadline := peer.expiry.deadline.Load(); deadline != 0 && now >= deadline {
+		return PeerRemovedTTL
+	}
+	if timeout := peer.expiry.idleTimeout.Load(); timeout != 0 && now-peer.expiry.lastActivity.Load() >= timeout {
+		return PeerRemovedIdle
+	}
+	return ""
+}
+
+// expirePeers removes the peers that have expired.
+func (device *Device) expirePeers() {
+	now := device.now()
+	var events []PeerRemovedEvent
+
+	device.peers.Lock()
+	for peer := range device.peers.expiring {
+		reason := peer.expired(now.UnixNano())
+		if reason == "" {
+			continue
+		}
+		key := peer.handshake.remoteStatic
+		device.log.Log(conn.SubsystemPeer, conn.LevelInfo, "Removing expired peer", conn.PeerField(peer), conn.Field{Key: "reason", Value: reason})
+		removePeerLocked(device, peer, key, reason)
+		events = append(events, PeerRemovedEvent{PublicKey: key, Time: now, Reason: reason})
+	}
+	device.peers.Unlock()
+
+	for _, event := range events {
+		device.peerRemovedEvents.publish(event)
+	}
+}
+
+func (device *Device) RoutineExpirePeers() {
+	ticker := time.NewTicker(ExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-device.closed:
+			return
+		case <-ticker.C:
+			device.expirePeers()
+		}
+	}
+}
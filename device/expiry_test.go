@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// manualClock is a Clock that only moves when advanced.
+type manualClock struct {
+	now atomic.Int64
+}
+
+func (c *manualClock) Now() time.Time { return time.Unix(0, c.now.Load()) }
+
+func (c *manualClock) advance(d time.Duration) { c.now.Add(int64(d)) }
+
+func TestPeerExpiry(t *testing.T) {
+	clock := new(manualClock)
+	clock.now.Store(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	device := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""), WithClock(clock))
+	defer device.Close()
+	sub := device.SubscribePeerRemovals(0)
+
+	var keys [3]NoisePublicKey
+	for i := range keys {
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		keys[i] = sk.publicKey()
+	}
+	err := device.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(keys[0][:]),
+		"ttl", "60",
+		"public_key", hex.EncodeToString(keys[1][:]),
+		"idle_timeout", "30",
+		"public_key", hex.EncodeToString(keys[2][:]),
+	))
+	assertNil(t, err)
+
+	cfg, err := device.IpcGet()
+	assertNil(t, err)
+	for _, line := range []string{"ttl=60\n", "idle_timeout=30\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("IpcGet output lacks %q:\n%s", line, cfg)
+		}
+	}
+
+	expect := func(pk NoisePublicKey, reason PeerRemovalReason) {
+		t.Helper()
+		device.expirePeers()
+		select {
+		case event := <-sub.C:
+			if event.PublicKey != pk || event.Reason != reason {
+				t.Errorf("removed %x for %q, want %x for %q", event.PublicKey[:4], event.Reason, pk[:4], reason)
+			}
+		default:
+			t.Fatalf("no removal of %x for %q", pk[:4], reason)
+		}
+		if device.LookupPeer(pk) != nil {
+			t.Errorf("peer %x not removed", pk[:4])
+		}
+	}
+
+	// Received packets keep an idle peer.
+	clock.advance(20 * time.Second)
+	device.LookupPeer(keys[1]).timersAnyAuthenticatedPacketReceived()
+	clock.advance(20 * time.Second)
+	device.expirePeers()
+	if device.LookupPeer(keys[1]) == nil {
+		t.Fatal("active peer removed")
+	}
+	clock.advance(10 * time.Second)
+	expect(keys[1], PeerRemovedIdle)
+
+	cfg, err = device.IpcGet()
+	assertNil(t, err)
+	if !strings.Contains(cfg, "ttl=10\n") {
+		t.Errorf("IpcGet output lacks remaining ttl:\n%s", cfg)
+	}
+
+	clock.advance(10 * time.Second)
+	expect(keys[0], PeerRemovedTTL)
+
+	// Peers without a TTL or idle timeout are kept.
+	clock.advance(24 * time.Hour)
+	device.expirePeers()
+	if device.LookupPeer(keys[2]) == nil {
+		t.Error("peer without expiry removed")
+	}
+	if len(device.peers.expiring) != 0 {
+		t.Errorf("%d peers still checked for expiry", len(device.peers.expiring))
+	}
+}
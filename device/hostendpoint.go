@@ -0,0 +1,210 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+/* Hostname endpoints
+ *
+ * The endpoint of a peer may be set to a hostname and port, which is
+ * resolved with the HostResolver of the device, before the set operation
+ * takes the configuration lock. The device keeps the
+ * hostname, and resolves it again in the background when its last lookup
+ * is older than a TTL or when handshakes keep failing, which is when a
+ * server that moved is noticed. A new address replaces the endpoint unless
+ * roaming is disabled for the peer; the current endpoint is kept as long as
+ * its address is still one of the answers, so that servers behind round
+ * robin names do not make the peer hop from one to the other.
+ */
+
+// A HostResolver returns the addresses of host.
+type HostResolver func(ctx context.Context, host string) ([]netip.Addr, error)
+
+// DefaultHostResolver resolves host with net.DefaultResolver.
+func DefaultHostResolver(ctx context.Context, host string) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// HostResolverOptions configure when hostname endpoints are resolved again.
+// Zero values select the defaults.
+type HostResolverOptions struct {
+	TTL      time.Duration // how long the addresses of a hostname are used
+	Failures int           // failed handshake attempts after which the hostname is resolved again
+	Timeout  time.Duration // how long a lookup may take
+}
+
+const (
+	DefaultHostResolverTTL      = 5 * time.Minute
+	DefaultHostResolverFailures = 3
+	DefaultHostResolverTimeout  = 10 * time.Second
+)
+
+type hostResolver struct {
+	resolve HostResolver
+	options HostResolverOptions
+}
+
+// SetHostResolver sets the resolver of hostname endpoints. A nil resolve
+// disables them, leaving the endpoints already resolved as they are.
+// Devices start with DefaultHostResolver.
+func (device *Device) SetHostResolver(resolve HostResolver, options HostResolverOptions) {
+	if resolve == nil {
+		device.hostResolver.Store(nil)
+		return
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultHostResolverTTL
+	}
+	if options.Failures <= 0 {
+		options.Failures = DefaultHostResolverFailures
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultHostResolverTimeout
+	}
+	device.hostResolver.Store(&hostResolver{resolve: resolve, options: options})
+}
+
+// A hostEndpoint is the hostname and port the endpoint of a peer is resolved from.
+type hostEndpoint struct {
+	host      string
+	port      uint16
+	lookedUp  atomic.Int64 // unix nanoseconds of the last lookup
+	resolving atomic.Bool
+}
+
+// parseHostEndpoint parses a hostname endpoint, host:port with a host that
+// is not an address, or returns nil.
+func parseHostEndpoint(s string) *hostEndpoint {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" {
+		return nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return nil
+	}
+	return &hostEndpoint{host: host, port: uint16(p)}
+}
+
+func (host *hostEndpoint) String() string {
+	return net.JoinHostPort(host.host, strconv.Itoa(int(host.port)))
+}
+
+// lookupHost returns the addresses of host, at least one.
+func (device *Device) lookupHost(host string) ([]netip.Addr, error) {
+	r := device.hostResolver.Load()
+	if r == nil {
+		return nil, errors.New("hostname endpoints are disabled")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.options.Timeout)
+	defer cancel()
+	addrs, err := r.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address for %s", host)
+	}
+	return addrs, nil
+}
+
+// resolveIpcHosts looks up the hostname endpoints of the lines of a set
+// operation, before the operation takes ipcMutex, and returns the first
+// address of each, by endpoint.
+func (device *Device) resolveIpcHosts(lines []ipcLine) (map[string]netip.AddrPort, error) {
+	var hosts map[string]netip.AddrPort
+	for _, line := range lines {
+		if line.key != "endpoint" && line.key != "endpoint_host" {
+			continue
+		}
+		host := parseHostEndpoint(line.value)
+		if host == nil {
+			continue
+		}
+		if _, ok := hosts[line.value]; ok {
+			continue
+		}
+		addrs, err := device.lookupHost(host.host)
+		if err != nil {
+			return nil, ipcErrorf(ipc.IpcErrorInvalid, "failed to resolve endpoint %v: %w", line.value, err)
+		}
+		if hosts == nil {
+			hosts = make(map[string]netip.AddrPort)
+		}
+		hosts[line.value] = netip.AddrPortFrom(addrs[0].Unmap(), host.port)
+	}
+	return hosts, nil
+}
+
+// resolveEndpoint looks up host and returns an endpoint of the current bind
+// for it: current if its address is among the answers, or the first answer.
+func (device *Device) resolveEndpoint(host *hostEndpoint, current conn.Endpoint) (conn.Endpoint, error) {
+	host.lookedUp.Store(device.now().UnixNano())
+	addrs, err := device.lookupHost(host.host)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		for _, addr := range addrs {
+			if addr.Unmap() == current.DstIP().Unmap() {
+				return current, nil
+			}
+		}
+	}
+	return device.Bind().ParseEndpoint(netip.AddrPortFrom(addrs[0].Unmap(), host.port).String())
+}
+
+// refreshEndpoint resolves the hostname endpoint of the peer again, in the
+// background, if its last lookup is older than the TTL or if the handshake
+// has failed for the configured number of attempts.
+func (peer *Peer) refreshEndpoint() {
+	peer.RLock()
+	host := peer.host
+	peer.RUnlock()
+	r := peer.device.hostResolver.Load()
+	if host == nil || r == nil {
+		return
+	}
+	attempts := int(peer.timers.handshakeAttempts.Load())
+	stale := peer.device.now().Sub(time.Unix(0, host.lookedUp.Load())) >= r.options.TTL
+	failing := attempts > 0 && attempts%r.options.Failures == 0
+	if (!stale && !failing) || !host.resolving.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer host.resolving.Store(false)
+		peer.RLock()
+		current := peer.endpoint
+		peer.RUnlock()
+		endpoint, err := peer.device.resolveEndpoint(host, current)
+		if err != nil {
+			peer.device.log.Errorf("%v - Failed to resolve endpoint %v: %v", peer, host, err)
+			return
+		}
+		peer.Lock()
+		changed := peer.host == host && !peer.disableRoaming && peer.setEndpointLocked(endpoint)
+		peer.Unlock()
+		if changed {
+			peer.device.log.Verbosef("%v - Endpoint %v resolved to %v", peer, host, endpoint.DstToString())
+			peer.notifyEndpointChanged(endpoint)
+		}
+	}()
+}
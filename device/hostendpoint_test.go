@@ -0,0 +1,220 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestParseHostEndpoint(t *testing.T) {
+	for s, want := range map[string]string{
+		"vpn.example.com:51820": "vpn.example.com:51820",
+		"localhost:1":           "localhost:1",
+		"192.0.2.1:51820":       "",
+		"[2001:db8::1]:51820":   "",
+		"vpn.example.com":       "",
+		"vpn.example.com:0":     "",
+		"vpn.example.com:wg":    "",
+		":51820":                "",
+	} {
+		var got string
+		if host := parseHostEndpoint(s); host != nil {
+			got = host.String()
+		}
+		if got != want {
+			t.Errorf("parseHostEndpoint(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+// fakeDNS is a HostResolver answering from a map.
+type fakeDNS struct {
+	sync.Mutex
+	hosts   map[string][]netip.Addr
+	lookups int
+}
+
+func (dns *fakeDNS) set(host string, addrs ...string) {
+	dns.Lock()
+	defer dns.Unlock()
+	dns.hosts[host] = nil
+	for _, addr := range addrs {
+		dns.hosts[host] = append(dns.hosts[host], netip.MustParseAddr(addr))
+	}
+}
+
+func (dns *fakeDNS) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	dns.Lock()
+	defer dns.Unlock()
+	dns.lookups++
+	if addrs, ok := dns.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (dns *fakeDNS) count() int {
+	dns.Lock()
+	defer dns.Unlock()
+	return dns.lookups
+}
+
+func TestHostEndpoint(t *testing.T) {
+	dns := &fakeDNS{hosts: make(map[string][]netip.Addr)}
+	dns.set("vpn.example.com", "192.0.2.1")
+	device := newDownDevice(t)
+	device.SetHostResolver(dns.resolve, HostResolverOptions{TTL: time.Hour, Failures: 2})
+	events := device.SubscribeEvents(16)
+	defer events.Close()
+
+	peerKey := randPublicKeyHex(t)
+	assertNil(t, device.IpcSet(uapiCfg(
+		"public_key", peerKey,
+		"endpoint", "vpn.example.com:51820",
+	)))
+	if n := dns.count(); n != 1 {
+		t.Errorf("%d lookups for a set operation, want one", n)
+	}
+	var pk NoisePublicKey
+	assertNil(t, pk.FromHex(peerKey))
+	peer := device.LookupPeer(pk)
+
+	hasEndpoint := func(want string) {
+		t.Helper()
+		cfg, err := device.IpcGet()
+		assertNil(t, err)
+		for _, line := range []string{"endpoint=" + want, "endpoint_host=vpn.example.com:51820"} {
+			if !strings.Contains(cfg, line+"\n") {
+				t.Errorf("configuration lacks %q:\n%s", line, cfg)
+			}
+		}
+	}
+	hasEndpoint("192.0.2.1:51820")
+
+	// refresh resolves the hostname again if it has to, and waits for the lookup.
+	refresh := func(attempts uint32) {
+		t.Helper()
+		peer.timers.handshakeAttempts.Store(attempts)
+		peer.refreshEndpoint()
+		peer.RLock()
+		host := peer.host
+		peer.RUnlock()
+		for deadline := time.Now().Add(5 * time.Second); host.resolving.Load(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("endpoint still resolving")
+			}
+		}
+	}
+
+	// Neither stale nor failing.
+	refresh(1)
+	if n := dns.count(); n != 1 {
+		t.Errorf("%d lookups without a reason, want one", n)
+	}
+
+	// The current address is kept while it is one of the answers.
+	dns.set("vpn.example.com", "192.0.2.2", "192.0.2.1")
+	refresh(2)
+	if n := dns.count(); n != 2 {
+		t.Errorf("%d lookups after failed handshakes, want two", n)
+	}
+	hasEndpoint("192.0.2.1:51820")
+
+	// The server moved.
+	dns.set("vpn.example.com", "192.0.2.3")
+	refresh(4)
+	hasEndpoint("192.0.2.3:51820")
+	var changed bool
+	for !changed {
+		select {
+		case event := <-events.C:
+			changed = event.Kind == EventEndpointChanged && event.Endpoint == "192.0.2.3:51820"
+		case <-time.After(5 * time.Second):
+			t.Fatal("no endpoint-changed event")
+		}
+	}
+
+	// Stale lookups are done again, but do not move peers that may not roam.
+	device.SetHostResolver(dns.resolve, HostResolverOptions{TTL: time.Nanosecond})
+	device.DisableSomeRoamingForBrokenMobileSemantics()
+	dns.set("vpn.example.com", "192.0.2.4")
+	refresh(0)
+	if n := dns.count(); n != 4 {
+		t.Errorf("%d lookups after the TTL, want four", n)
+	}
+	hasEndpoint("192.0.2.3:51820")
+
+	// Unknown hosts fail the set operation, whose hostnames are resolved
+	// before anything else is done.
+	for _, cfg := range []string{
+		uapiCfg("public_key", peerKey, "endpoint", "nowhere.example.com:51820"),
+		uapiCfg("public_key", peerKey, "endpoint", "vpn.example.com:51820", "allowed_ip", "10.0.0.300/32"),
+	} {
+		if err := device.IpcSet(cfg); err == nil {
+			t.Errorf("%q accepted", cfg)
+		}
+	}
+	if n := dns.count(); n != 6 {
+		t.Errorf("%d lookups after the failed set operations, want six", n)
+	}
+	hasEndpoint("192.0.2.3:51820")
+
+	// An address replaces the hostname.
+	assertNil(t, device.IpcSet(uapiCfg("public_key", peerKey, "endpoint", "192.0.2.9:51820")))
+	cfg, err := device.IpcGet()
+	assertNil(t, err)
+	if strings.Contains(cfg, "endpoint_host=") {
+		t.Errorf("hostname kept after setting an address:\n%s", cfg)
+	}
+
+	device.SetHostResolver(nil, HostResolverOptions{})
+	if err := device.IpcSet(uapiCfg("public_key", peerKey, "endpoint", "vpn.example.com:51820")); err == nil {
+		t.Error("hostname accepted without a resolver")
+	}
+}
+
+// TestHostEndpointStdBinds sets hostname and invalid endpoints on the
+// binds of conn.CreateStdNetBind, whose ParseEndpoint only takes addresses.
+func TestHostEndpointStdBinds(t *testing.T) {
+	dns := &fakeDNS{hosts: make(map[string][]netip.Addr)}
+	dns.set("vpn.example.com", "192.0.2.1")
+	for _, transport := range []string{"udp", "tcp"} {
+		t.Run(transport, func(t *testing.T) {
+			logger := NewLogger(LogLevelError, "")
+			device := NewDevice(tuntest.NewChannelTUN().TUN(), conn.CreateStdNetBind(transport, &logger.Logger, nil, nil), logger)
+			defer device.Close()
+			device.SetHostResolver(dns.resolve, HostResolverOptions{})
+			peerKey := randPublicKeyHex(t)
+
+			assertNil(t, device.IpcSet(uapiCfg("public_key", peerKey, "endpoint", "vpn.example.com:51820")))
+			cfg, err := device.IpcGet()
+			assertNil(t, err)
+			if !strings.Contains(cfg, "endpoint=192.0.2.1:51820\n") || !strings.Contains(cfg, "endpoint_host=vpn.example.com:51820\n") {
+				t.Errorf("hostname endpoint not resolved:\n%s", cfg)
+			}
+
+			for _, endpoint := range []string{"garbage", "192.0.2.1", "192.0.2.300:51820", "vpn.example.com:0"} {
+				if err := device.IpcSet(uapiCfg("public_key", peerKey, "endpoint", endpoint)); err == nil {
+					t.Errorf("endpoint %q accepted", endpoint)
+				}
+			}
+			cfg, err = device.IpcGet()
+			assertNil(t, err)
+			if !strings.Contains(cfg, "endpoint=192.0.2.1:51820\n") {
+				t.Errorf("endpoint changed by invalid endpoints:\n%s", cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/poly1305"
+
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+/* Hybrid handshake
+ *
+ * Peers may opt in to a variant of the handshake that adds an ML-KEM-768
+ * encapsulation to the X25519 exchange, so that recorded traffic stays
+ * confidential even if X25519 is broken later on:
+ *
+ *   the initiation carries an ephemeral ML-KEM encapsulation key,
+ *   which is mixed into the hash after the timestamp;
+ *
+ *   the response carries the ciphertext encapsulated to that key,
+ *   which is mixed into the hash, and the shared secret into the chain key,
+ *   after the ephemeral-static DH and before the preshared key.
+ *
+ * The hybrid messages have their own types and a separate construction name,
+ * so they never validate as classic messages and vice versa.
+ * Both sides must enable the hybrid mode for a peer; a peer in hybrid mode
+ * does not accept classic handshakes, which rules out downgrades.
+ */
+
+const (
+	HybridNoiseConstruction = "Noise_IKpsk2+MLKEM768_25519_ChaChaPoly_BLAKE2s"
+
+	MessageHybridInitiationType = 5
+	MessageHybridResponseType   = 6
+
+	MLKEMEncapsulationKeySize = 1184
+	MLKEMCiphertextSize       = 1088
+
+	MessageHybridInitiationSize = MessageInitiationSize + MLKEMEncapsulationKeySize // size of hybrid handshake initiation message
+	MessageHybridResponseSize   = MessageResponseSize + MLKEMCiphertextSize         // size of hybrid response message
+)
+
+var (
+	HybridInitialChainKey [blake2s.Size]byte
+	HybridInitialHash     [blake2s.Size]byte
+)
+
+var errHybridUnsupported = errors.New("hybrid handshake requires ML-KEM support (Go 1.24 or later)")
+
+type MessageHybridInitiation struct {
+	Type      uint32
+	Sender    uint32
+	Ephemeral NoisePublicKey
+	Static    [NoisePublicKeySize + poly1305.TagSize]byte
+	Timestamp [tai64n.TimestampSize + poly1305.TagSize]byte
+	KEMKey    [MLKEMEncapsulationKeySize]byte
+	MAC1      [blake2s.Size128]byte
+	MAC2      [blake2s.Size128]byte
+}
+
+type MessageHybridResponse struct {
+	Type          uint32
+	Sender        uint32
+	Receiver      uint32
+	Ephemeral     NoisePublicKey
+	KEMCiphertext [MLKEMCiphertextSize]byte
+	Empty         [poly1305.TagSize]byte
+	MAC1          [blake2s.Size128]byte
+	MAC2          [blake2s.Size128]byte
+}
+
+// A kemDecapsulationKey is the initiator's ephemeral ML-KEM key.
+type kemDecapsulationKey interface {
+	encapsulationKey() []byte
+	decapsulate(ciphertext []byte) (sharedSecret []byte, err error)
+}
+
+func init() {
+	HybridInitialChainKey = blake2s.Sum256([]byte(HybridNoiseConstruction))
+	mixHash(&HybridInitialHash, &HybridInitialChainKey, []byte(WGIdentifier))
+}
+
+func initialHandshakeState(hybrid bool) (chainKey, hash [blake2s.Size]byte) {
+	if hybrid {
+		return HybridInitialChainKey, HybridInitialHash
+	}
+	return InitialChainKey, InitialHash
+}
+
+// SetHybridHandshake enables or disables the hybrid ML-KEM handshake with the peer.
+// The peer must be configured the same way for handshakes to complete.
+func (peer *Peer) SetHybridHandshake(enabled bool) error {
+	if enabled && !hybridSupported {
+		return errHybridUnsupported
+	}
+	peer.hybrid.Store(enabled)
+	return nil
+}
+
+// HybridHandshake reports whether the hybrid handshake is enabled for the peer.
+func (peer *Peer) HybridHandshake() bool {
+	return peer.hybrid.Load()
+}
+
+func (device *Device) CreateMessageHybridInitiation(peer *Peer) (*MessageHybridInitiation, error) {
+	msg, kemKey, err := device.createMessageInitiation(peer, true)
+	if err != nil {
+		return nil, err
+	}
+	hybrid := &MessageHybridInitiation{
+		Type:      MessageHybridInitiationType,
+		Sender:    msg.Sender,
+		Ephemeral: msg.Ephemeral,
+		Static:    msg.Static,
+		Timestamp: msg.Timestamp,
+	}
+	copy(hybrid.KEMKey[:], kemKey)
+	return hybrid, nil
+}
+
+func (device *Device) ConsumeMessageHybridInitiation(msg *MessageHybridInitiation) *Peer {
+	return device.consumeMessageHybridInitiation(msg, nil, nil)
+}
+
+func (device *Device) consumeMessageHybridInitiation(msg *MessageHybridInitiation, unknown *NoisePublicKey, retired *retiredIdentity) *Peer {
+	if msg.Type != MessageHybridInitiationType {
+		return nil
+	}
+	return device.consumeMessageInitiation(&MessageInitiation{
+		Sender:    msg.Sender,
+		Ephemeral: msg.Ephemeral,
+		Static:    msg.Static,
+		Timestamp: msg.Timestamp,
+	}, msg.KEMKey[:], unknown, retired)
+}
+
+func (device *Device) CreateMessageHybridResponse(peer *Peer) (*MessageHybridResponse, error) {
+	msg, ciphertext, err := device.createMessageResponse(peer, true)
+	if err != nil {
+		return nil, err
+	}
+	hybrid := &MessageHybridResponse{
+		Type:      MessageHybridResponseType,
+		Sender:    msg.Sender,
+		Receiver:  msg.Receiver,
+		Ephemeral: msg.Ephemeral,
+		Empty:     msg.Empty,
+	}
+	copy(hybrid.KEMCiphertext[:], ciphertext)
+	return hybrid, nil
+}
+
+func (device *Device) ConsumeMessageHybridResponse(msg *MessageHybridResponse) *Peer {
+	if msg.Type != MessageHybridResponseType {
+		return nil
+	}
+	return device.consumeMessageResponse(&MessageResponse{
+		Sender:    msg.Sender,
+		Receiver:  msg.Receiver,
+		Ephemeral: msg.Ephemeral,
+		Empty:     msg.Empty,
+	}, msg.KEMCiphertext[:])
+}
@@ -0,0 +1,43 @@
+//go:build go1.24
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/mlkem"
+)
+
+const hybridSupported = true
+
+type mlkemDecapsulationKey struct {
+	key *mlkem.DecapsulationKey768
+}
+
+func (dk mlkemDecapsulationKey) encapsulationKey() []byte {
+	return dk.key.EncapsulationKey().Bytes()
+}
+
+func (dk mlkemDecapsulationKey) decapsulate(ciphertext []byte) ([]byte, error) {
+	return dk.key.Decapsulate(ciphertext)
+}
+
+func generateKEMKey() (kemDecapsulationKey, error) {
+	key, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	return mlkemDecapsulationKey{key}, nil
+}
+
+func kemEncapsulate(encapsulationKey []byte) (sharedSecret, ciphertext []byte, err error) {
+	key, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, ciphertext = key.Encapsulate()
+	return sharedSecret, ciphertext, nil
+}
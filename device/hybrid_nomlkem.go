@@ -0,0 +1,18 @@
+//go:build !go1.24
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+const hybridSupported = false
+
+func generateKEMKey() (kemDecapsulationKey, error) {
+	return nil, errHybridUnsupported
+}
+
+func kemEncapsulate(encapsulationKey []byte) (sharedSecret, ciphertext []byte, err error) {
+	return nil, nil, errHybridUnsupported
+}
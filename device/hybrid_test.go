@@ -0,0 +1,122 @@
+//go:build go1.24
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func TestHybridMessageSizes(t *testing.T) {
+	for _, msg := range []struct {
+		v    any
+		size int
+	}{
+		{MessageHybridInitiation{}, MessageHybridInitiationSize},
+		{MessageHybridResponse{}, MessageHybridResponseSize},
+	} {
+		if got := binary.Size(msg.v); got != msg.size {
+			t.Errorf("%T has size %d, want %d", msg.v, got, msg.size)
+		}
+	}
+}
+
+func TestHybridNoiseHandshake(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer1.Start()
+	peer2.Start()
+	assertNil(t, peer1.SetHybridHandshake(true))
+
+	// A classic initiation must not be accepted by a peer in hybrid mode.
+
+	classic, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(classic) != nil {
+		t.Fatal("hybrid peer accepted a classic initiation")
+	}
+
+	assertNil(t, peer2.SetHybridHandshake(true))
+
+	msg1, err := dev1.CreateMessageHybridInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageHybridInitiation(msg1) != peer1 {
+		t.Fatal("handshake failed at hybrid initiation message")
+	}
+	assertEqual(t, peer1.handshake.hash[:], peer2.handshake.hash[:])
+
+	msg2, err := dev2.CreateMessageHybridResponse(peer1)
+	assertNil(t, err)
+
+	// The KEM ciphertext is authenticated by the transcript.
+	tampered := *msg2
+	tampered.KEMCiphertext[0] ^= 1
+	if dev1.ConsumeMessageHybridResponse(&tampered) != nil {
+		t.Fatal("hybrid response with modified KEM ciphertext accepted")
+	}
+
+	if dev1.ConsumeMessageHybridResponse(msg2) != peer2 {
+		t.Fatal("handshake failed at hybrid response message")
+	}
+	assertEqual(t, peer1.handshake.chainKey[:], peer2.handshake.chainKey[:])
+	assertEqual(t, peer1.handshake.hash[:], peer2.handshake.hash[:])
+
+	assertNil(t, peer1.BeginSymmetricSession())
+	assertNil(t, peer2.BeginSymmetricSession())
+
+	testMsg := []byte("wireguard hybrid test message")
+	var nonce [12]byte
+	out := peer2.keypairs.current.send.Seal(nil, nonce[:], testMsg, nil)
+	out, err = peer1.keypairs.next.Load().receive.Open(out[:0], nonce[:], out, nil)
+	assertNil(t, err)
+	assertEqual(t, out, testMsg)
+}
+
+func TestHybridTwoDevicePing(t *testing.T) {
+	pair := genTestPair(t, true)
+	for i := range pair {
+		other := pair[i^1].dev
+		other.staticIdentity.RLock()
+		pk := other.staticIdentity.publicKey
+		other.staticIdentity.RUnlock()
+		err := pair[i].dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(pk[:]),
+			"hybrid_handshake", "true",
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := pair[i].dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains([]byte(cfg), []byte("hybrid_handshake=true\n")) {
+			t.Errorf("device %d does not report the hybrid handshake:\n%s", i, cfg)
+		}
+	}
+	t.Run("ping 1.0.0.1", func(t *testing.T) {
+		pair.Send(t, Ping, nil)
+	})
+	t.Run("ping 1.0.0.2", func(t *testing.T) {
+		pair.Send(t, Pong, nil)
+	})
+}
@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+// A StaticIdentity performs the X25519 operations that involve the static
+// private key of a device, so that the key can be kept out of process memory,
+// for instance in a platform keystore or in a separate key holder process.
+// Its methods may be called concurrently.
+type StaticIdentity interface {
+	// PublicKey returns the static public key. It must not change.
+	PublicKey() NoisePublicKey
+
+	// SharedSecret returns the X25519 shared secret of the static private key
+	// and pk, which is either the static public key of a peer or an ephemeral
+	// public key from a handshake message. It must fail if the result is zero.
+	SharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error)
+}
+
+// memoryIdentity is the StaticIdentity of a private key set with SetPrivateKey.
+type memoryIdentity struct {
+	privateKey NoisePrivateKey
+	publicKey  NoisePublicKey
+}
+
+func newMemoryIdentity(sk NoisePrivateKey) StaticIdentity {
+	if sk.IsZero() {
+		return nil
+	}
+	return &memoryIdentity{privateKey: sk, publicKey: sk.publicKey()}
+}
+
+func (id *memoryIdentity) PublicKey() NoisePublicKey {
+	return id.publicKey
+}
+
+func (id *memoryIdentity) SharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error) {
+	return id.privateKey.sharedSecret(pk)
+}
+
+// clearIdentity zeroes the private key of an identity that is no longer used,
+// if it is held in memory.
+func clearIdentity(id StaticIdentity) {
+	if id, ok := id.(*memoryIdentity); ok {
+		setZero(id.privateKey[:])
+	}
+}
+
+// sharedSecret returns the shared secret of the static identity id and pk.
+// A nil identity has no shared secrets.
+func sharedSecret(id StaticIdentity, pk NoisePublicKey) (ss [NoisePublicKeySize]byte, err error) {
+	if id == nil {
+		return ss, errInvalidPublicKey
+	}
+	return id.SharedSecret(pk)
+}
+
+// SetStaticIdentity replaces the static identity of the device, like SetPrivateKey
+// does with a private key held in memory. If id has the same public key as the
+// current identity, established sessions are kept.
+// A nil identity removes the static key.
+func (device *Device) SetStaticIdentity(id StaticIdentity) error {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+
+	if id == device.staticIdentity.identity {
+		return nil
+	}
+
+	if id != nil && device.staticIdentity.identity != nil && id.PublicKey() == device.staticIdentity.publicKey {
+		// Only the holder of the key changes.
+		clearIdentity(device.staticIdentity.identity)
+		device.staticIdentity.identity = id
+		device.staticIdentity.privateKey = NoisePrivateKey{}
+		if id, ok := id.(*memoryIdentity); ok {
+			device.staticIdentity.privateKey = id.privateKey
+		}
+		return nil
+	}
+
+	device.dropRetiredKeyLocked()
+	old := device.staticIdentity.identity
+	device.setIdentityLocked(id, true)
+	clearIdentity(old)
+	return nil
+}
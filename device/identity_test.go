@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveKeyHolder answers X25519 requests for sk on l, standing in for a key
+// holder process. Upon connecting, a client receives the public key; it then
+// sends public keys and receives a status byte and the shared secret for each.
+func serveKeyHolder(l net.Listener, sk NoisePrivateKey) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			pk := sk.publicKey()
+			if _, err := c.Write(pk[:]); err != nil {
+				return
+			}
+			var req NoisePublicKey
+			var resp [1 + NoisePublicKeySize]byte
+			for {
+				if _, err := io.ReadFull(c, req[:]); err != nil {
+					return
+				}
+				ss, err := sk.sharedSecret(req)
+				resp[0] = 0
+				if err != nil {
+					resp[0] = 1
+				}
+				copy(resp[1:], ss[:])
+				if _, err := c.Write(resp[:]); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// socketIdentity is a StaticIdentity whose key lives in a key holder process.
+type socketIdentity struct {
+	mu        sync.Mutex
+	conn      net.Conn
+	publicKey NoisePublicKey
+	calls     atomic.Int32
+}
+
+func dialKeyHolder(path string) (*socketIdentity, error) {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	id := &socketIdentity{conn: c}
+	if _, err := io.ReadFull(c, id.publicKey[:]); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return id, nil
+}
+
+func (id *socketIdentity) PublicKey() NoisePublicKey {
+	return id.publicKey
+}
+
+func (id *socketIdentity) SharedSecret(pk NoisePublicKey) (ss [NoisePublicKeySize]byte, err error) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.calls.Add(1)
+	if _, err := id.conn.Write(pk[:]); err != nil {
+		return ss, err
+	}
+	var resp [1 + NoisePublicKeySize]byte
+	if _, err := io.ReadFull(id.conn, resp[:]); err != nil {
+		return ss, err
+	}
+	if resp[0] != 0 {
+		return ss, errors.New("key holder refused the operation")
+	}
+	copy(ss[:], resp[1:])
+	return ss, nil
+}
+
+func TestSocketStaticIdentity(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+
+	// Unix socket paths are limited in length, so avoid t.TempDir.
+	dir, err := os.MkdirTemp("", "wg-identity")
+	assertNil(t, err)
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "key.sock"))
+	assertNil(t, err)
+	defer l.Close()
+
+	dev := pair[0].dev
+	dev.staticIdentity.RLock()
+	sk := dev.staticIdentity.privateKey
+	dev.staticIdentity.RUnlock()
+	go serveKeyHolder(l, sk)
+
+	id, err := dialKeyHolder(l.Addr().String())
+	assertNil(t, err)
+	defer id.conn.Close()
+
+	// Moving the same key to the key holder keeps the session.
+	assertNil(t, dev.SetStaticIdentity(id))
+	pair.Send(t, Pong, nil)
+
+	cfg, err := dev.IpcGet()
+	assertNil(t, err)
+	if strings.Contains(cfg, "private_key=") {
+		t.Errorf("IpcGet reports a private key for an external identity:\n%s", cfg)
+	}
+
+	// New sessions are negotiated through the key holder.
+	time.Sleep(20 * time.Millisecond) // tai64n timestamps have a 16ms granularity
+	for i := range pair {
+		pair[i].dev.peers.RLock()
+		for _, peer := range pair[i].dev.peers.keyMap {
+			peer.ExpireCurrentKeypairs()
+		}
+		pair[i].dev.peers.RUnlock()
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if id.calls.Load() == 0 {
+		t.Error("handshake did not use the key holder")
+	}
+}
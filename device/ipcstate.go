@@ -0,0 +1,263 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Set operation rollback
+ *
+ * A set operation is run by two ipcSetters. The first stages it, parsing and
+ * validating every line without changing the device, the timers of the peers
+ * included, which are checked against the device timers the operation sets.
+ * The second applies it for real, and if that fails midway, for instance because the
+ * listen port is in use, the state saved before applying it is restored.
+ *
+ * What cannot be restored is done once the operations that may fail are
+ * over: replace_peers removes the peers after the device settings are
+ * applied, and rotate_private_key rotates the key after everything else.
+ * Restoring brings back the configuration, not the sessions: peers removed
+ * by a failed operation, which only happens when a later peer cannot be
+ * created, are recreated and handshake anew, and a packet capture replaced
+ * by it is stopped rather than resumed. Only the peers the operation
+ * configured, added or removed are restored, leaving alone those that the
+ * resolver added or that expired in the meantime.
+ *
+ * The state=up of an operation is carried out after it is applied, and a
+ * device failing to come up restores the configuration saved before it, as
+ * long as no other operation was applied in between.
+ */
+
+// An ipcState is the configuration of a device that a set operation may change.
+type ipcState struct {
+	privateKey       NoisePrivateKey
+	identity         StaticIdentity // when not held in memory
+	publicKey        NoisePublicKey
+	keyRotationGrace time.Duration
+	port             uint16
+	fwmark           uint32
+	bind             conn.Bind
+	brokenRoaming    bool
+	sourceFilter     []netip.Prefix
+	replayWindow     uint64
+	protocolTimers   *ProtocolTimers
+	obfuscation      *obfuscation
+	captureOptions   CaptureOptions
+	capture          *packetCapture
+	peers            map[NoisePublicKey]*ipcPeerState
+
+	// touched are the peers the operation configured, added or removed.
+	touched map[NoisePublicKey]bool
+
+	// generation is the ipcGeneration of the operation that replaced the
+	// configuration, once applied.
+	generation uint64
+}
+
+// An ipcPeerState is the configuration of a peer that a set operation may change.
+type ipcPeerState struct {
+	peer                        *Peer
+	presharedKey                NoisePresharedKey
+	endpoint                    conn.Endpoint
+	host                        *hostEndpoint
+	disableRoaming              bool
+	persistentKeepaliveInterval uint32
+	allowedIPs                  []netip.Prefix
+	hybrid                      bool
+	timers                      *PeerTimers
+	replayWindow                uint64
+	sourceFilter                []netip.Prefix
+	deadline                    int64
+	idleTimeout                 int64
+}
+
+// saveIpcState returns the configuration of the device.
+// The caller must hold device.ipcMutex.
+func (device *Device) saveIpcState() *ipcState {
+	state := &ipcState{
+		keyRotationGrace: device.keyRotationGrace,
+		sourceFilter:     device.SourceFilter(),
+		replayWindow:     device.replayWindow.Load(),
+		protocolTimers:   device.protocolTimers.Load(),
+		obfuscation:      device.obfuscation.Load(),
+		captureOptions:   device.captureOptions,
+		capture:          device.capture.Load(),
+		peers:            make(map[NoisePublicKey]*ipcPeerState),
+	}
+
+	device.staticIdentity.RLock()
+	state.privateKey = device.staticIdentity.privateKey
+	if state.privateKey.IsZero() {
+		state.identity = device.staticIdentity.identity
+	}
+	state.publicKey = device.staticIdentity.publicKey
+	device.staticIdentity.RUnlock()
+
+	device.net.RLock()
+	state.port = device.net.port
+	state.fwmark = device.net.fwmark
+	state.bind = device.net.bind
+	state.brokenRoaming = device.net.brokenRoaming
+	device.net.RUnlock()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for key, peer := range device.peers.keyMap {
+		s := &ipcPeerState{
+			peer:                        peer,
+			persistentKeepaliveInterval: peer.persistentKeepaliveInterval.Load(),
+			hybrid:                      peer.hybrid.Load(),
+			timers:                      peer.timerOverrides.Load(),
+			replayWindow:                peer.replayWindow.Load(),
+			sourceFilter:                peer.SourceFilter(),
+			deadline:                    peer.expiry.deadline.Load(),
+			idleTimeout:                 peer.expiry.idleTimeout.Load(),
+		}
+		peer.handshake.mutex.RLock()
+		s.presharedKey = peer.handshake.presharedKey
+		peer.handshake.mutex.RUnlock()
+		peer.RLock()
+		s.endpoint = peer.endpoint
+		s.host = peer.host
+		s.disableRoaming = peer.disableRoaming
+		peer.RUnlock()
+		device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
+			s.allowedIPs = append(s.allowedIPs, prefix)
+			return true
+		})
+		state.peers[key] = s
+	}
+	return state
+}
+
+// restoreIpcState restores the configuration saved by saveIpcState.
+// The caller must hold device.ipcMutex.
+func (device *Device) restoreIpcState(state *ipcState) {
+	device.keyRotationGrace = state.keyRotationGrace
+	device.captureOptions = state.captureOptions
+	device.replayWindow.Store(state.replayWindow)
+	device.protocolTimers.Store(state.protocolTimers)
+	device.obfuscation.Store(state.obfuscation)
+	device.SetSourceFilter(state.sourceFilter)
+	if device.capture.Load() != state.capture {
+		device.StopCapture()
+	}
+
+	device.staticIdentity.RLock()
+	publicKey := device.staticIdentity.publicKey
+	device.staticIdentity.RUnlock()
+	if publicKey != state.publicKey {
+		if state.identity != nil {
+			device.SetStaticIdentity(state.identity)
+		} else {
+			device.SetPrivateKey(state.privateKey)
+		}
+	}
+
+	device.net.Lock()
+	portChanged := device.net.port != state.port
+	device.net.port = state.port
+	device.net.brokenRoaming = state.brokenRoaming
+	device.net.Unlock()
+	if portChanged {
+		if err := device.BindUpdate(); err != nil {
+			device.log.Log(conn.SubsystemUAPI, conn.LevelError, "Unable to restore listen port", conn.Field{Key: "port", Value: state.port}, conn.ErrorField(err))
+		}
+	}
+	if err := device.BindSetMark(state.fwmark); err != nil {
+		device.log.Log(conn.SubsystemUAPI, conn.LevelError, "Unable to restore fwmark", conn.Field{Key: "fwmark", Value: state.fwmark}, conn.ErrorField(err))
+	}
+
+	// Remove the peers added by the operation, and recreate those it removed.
+	// The peers it did not touch are left as they are, but for the allowed
+	// IPs the peers it touched took from them.
+	for key := range state.touched {
+		if state.peers[key] == nil {
+			device.RemovePeer(key)
+		}
+	}
+	for key, s := range state.peers {
+		peer := device.LookupPeer(key)
+		if !state.touched[key] {
+			if peer == s.peer {
+				for _, prefix := range s.allowedIPs {
+					device.allowedips.Insert(prefix, peer)
+				}
+			}
+			continue
+		}
+		if peer != s.peer {
+			if peer != nil {
+				device.RemovePeer(key)
+			}
+			var err error
+			peer, err = device.NewPeer(key)
+			if err != nil {
+				device.log.Log(conn.SubsystemUAPI, conn.LevelError, "Unable to restore peer", conn.PeerField(s.peer), conn.ErrorField(err))
+				continue
+			}
+		}
+		s.restore(peer)
+		if device.isUp() {
+			peer.Start()
+		}
+	}
+
+	// Bring back the previous transport once the endpoints are restored.
+	if device.Bind() != state.bind {
+		if err := device.swapBind(state.bind); err != nil {
+			device.log.Log(conn.SubsystemUAPI, conn.LevelError, "Unable to restore transport", conn.TransportField(conn.TransportOf(state.bind)), conn.ErrorField(err))
+		}
+	}
+}
+
+// rollbackIpcState restores the configuration replaced by a set operation
+// that failed after it was applied, unless another one has been applied since.
+func (device *Device) rollbackIpcState(state *ipcState) {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+	if device.ipcGeneration != state.generation {
+		device.log.Log(conn.SubsystemUAPI, conn.LevelError, "Not restoring configuration replaced by a later set operation")
+		return
+	}
+	device.log.Log(conn.SubsystemUAPI, conn.LevelInfo, "Restoring configuration after failed set operation")
+	device.restoreIpcState(state)
+}
+
+// restore applies the saved configuration to peer.
+func (s *ipcPeerState) restore(peer *Peer) {
+	device := peer.device
+
+	peer.handshake.mutex.Lock()
+	peer.handshake.presharedKey = s.presharedKey
+	peer.handshake.mutex.Unlock()
+	peer.Lock()
+	peer.endpoint = s.endpoint
+	peer.host = s.host
+	peer.disableRoaming = s.disableRoaming
+	peer.Unlock()
+
+	peer.persistentKeepaliveInterval.Store(s.persistentKeepaliveInterval)
+	peer.hybrid.Store(s.hybrid)
+	peer.timerOverrides.Store(s.timers)
+	peer.replayWindow.Store(s.replayWindow)
+	peer.SetSourceFilter(s.sourceFilter)
+
+	device.allowedips.RemoveByPeer(peer)
+	for _, prefix := range s.allowedIPs {
+		device.allowedips.Insert(prefix, peer)
+	}
+
+	peer.expiry.deadline.Store(s.deadline)
+	if peer.expiry.idleTimeout.Swap(s.idleTimeout) == 0 {
+		peer.expiry.lastActivity.Store(device.now().UnixNano())
+	}
+	peer.updateExpiring()
+}
@@ -0,0 +1,309 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// ipcConfig returns the configuration of device, with the peers in
+// a stable order and without their statistics.
+func ipcConfig(t *testing.T, device *Device) string {
+	t.Helper()
+	cfg, err := device.IpcGet()
+	assertNil(t, err)
+	sections := strings.Split(cfg, "public_key=")
+	for i, section := range sections {
+		var kept []string
+		for _, line := range strings.Split(section, "\n") {
+			switch key, _, _ := strings.Cut(line, "="); key {
+			case "last_handshake_time_sec", "last_handshake_time_nsec", "tx_bytes", "rx_bytes":
+			default:
+				kept = append(kept, line)
+			}
+		}
+		sections[i] = strings.Join(kept, "\n")
+	}
+	sort.Strings(sections[1:])
+	return strings.Join(sections, "public_key=")
+}
+
+func randPublicKeyHex(t *testing.T) string {
+	t.Helper()
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	return hex.EncodeToString(pk[:])
+}
+
+func TestIpcSetInvalidLeavesConfig(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+	before := ipcConfig(t, dev)
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	for name, cfg := range map[string]string{
+		"bad allowed_ip": uapiCfg(
+			"private_key", hex.EncodeToString(sk[:]),
+			"replace_peers", "true",
+			"public_key", randPublicKeyHex(t),
+			"allowed_ip", "10.0.0.0/8",
+			"public_key", randPublicKeyHex(t),
+			"allowed_ip", "10.0.0.300/32",
+		),
+		"unknown key": uapiCfg(
+			"fwmark", "42",
+			"public_key", randPublicKeyHex(t),
+			"persistent_keepalive_interval", "25",
+			"no_such_key", "1",
+		),
+		"invalid timers": uapiCfg(
+			"rekey_timeout", "0",
+			"replace_peers", "true",
+		),
+		"malformed line": "replace_peers=true\npublic_key\n",
+	} {
+		if err := dev.IpcSet(cfg); err == nil {
+			t.Errorf("%s: set succeeded", name)
+		}
+		if after := ipcConfig(t, dev); after != before {
+			t.Errorf("%s: configuration changed from\n%s\nto\n%s", name, before, after)
+		}
+	}
+
+	// The peer still works.
+	pair.Send(t, Ping, nil)
+}
+
+func TestIpcSetRollback(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+	assertNil(t, dev.IpcSet(uapiCfg(
+		"public_key", randPublicKeyHex(t),
+		"allowed_ip", "10.1.0.0/16",
+		"persistent_keepalive_interval", "25",
+		"idle_timeout", "3600",
+	)))
+	before := ipcConfig(t, dev)
+	existing := strings.TrimSpace(strings.SplitN(strings.SplitN(before, "public_key=", 2)[1], "\n", 2)[0])
+	var pk NoisePublicKey
+	assertNil(t, pk.FromHex(existing))
+	peer := dev.LookupPeer(pk)
+
+	// unchanged checks that the failed operation left the configuration and
+	// the peer, with its sessions, as they were.
+	unchanged := func() {
+		t.Helper()
+		if after := ipcConfig(t, dev); after != before {
+			t.Errorf("configuration not restored from\n%s\nto\n%s", after, before)
+		}
+		if dev.LookupPeer(pk) != peer {
+			t.Error("peer recreated by the failed operation")
+		}
+		if _, _, ok := dev.RetiredPublicKey(); ok {
+			t.Error("key retired by the failed operation")
+		}
+	}
+
+	// Peer timers are checked against the device timers set by the
+	// operation while staging it.
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	for _, cfg := range []string{
+		uapiCfg(
+			"private_key", hex.EncodeToString(sk[:]),
+			"replace_peers", "true",
+			"public_key", randPublicKeyHex(t),
+			"allowed_ip", "10.2.0.0/16",
+			"public_key", existing,
+			"replace_allowed_ips", "true",
+			"rekey_timeout", "15",
+			"rekey_attempt_time", "10",
+		),
+		uapiCfg(
+			"rekey_timeout", "10",
+			"rekey_attempt_time", "20",
+			"public_key", existing,
+			"rekey_timeout", "25",
+		),
+		uapiCfg(
+			"public_key", existing,
+			"rekey_attempt_time", "10",
+			"public_key", randPublicKeyHex(t),
+			"rekey_timeout", "15",
+			"rekey_attempt_time", "10",
+		),
+	} {
+		if err := dev.IpcSet(cfg); err == nil {
+			t.Errorf("set with inconsistent peer timers succeeded: %q", cfg)
+		}
+		unchanged()
+	}
+
+	// Binding a port in use fails when applied, before the peers are
+	// replaced and the key rotated.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	err = dev.IpcSet(uapiCfg(
+		"rotate_private_key", hex.EncodeToString(sk[:]),
+		"replace_peers", "true",
+		"listen_port", strconv.Itoa(port),
+		"public_key", existing,
+	))
+	if err == nil {
+		t.Fatal("set with listen port in use succeeded")
+	}
+	unchanged()
+
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
+
+func TestIpcHandleReadOnly(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+	before := ipcConfig(t, dev)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go dev.IpcHandle(ipc.LimitAccess(server, ipc.AccessReadOnly))
+	r := bufio.NewReader(client)
+
+	// reply sends an operation and returns the reply, up to the blank line.
+	reply := func(op string) string {
+		t.Helper()
+		if _, err := client.Write([]byte(op)); err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	got := reply("set=1\nreplace_peers=true\nlisten_port=0\n\n")
+	if want := fmt.Sprintf("errno=%d\n", ipc.IpcErrorDenied); got != want {
+		t.Errorf("set on a read-only connection replied %q, want %q", got, want)
+	}
+	if after := ipcConfig(t, dev); after != before {
+		t.Errorf("read-only set changed the configuration from\n%s\nto\n%s", before, after)
+	}
+
+	// The connection stays usable for get operations.
+	if got := reply("get=1\n\n"); !strings.HasSuffix(got, "errno=0\n") || !strings.Contains(got, "public_key=") {
+		t.Errorf("get on a read-only connection replied %q", got)
+	}
+}
+
+// parseCountingBind counts the endpoints parsed by its bind.
+type parseCountingBind struct {
+	conn.Bind
+	parsed int
+}
+
+func (bind *parseCountingBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	bind.parsed++
+	return bind.Bind.ParseEndpoint(s)
+}
+
+func TestIpcSetStagingLeavesBind(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	bind := &parseCountingBind{Bind: conn.NewDefaultBind()}
+	dev := NewDevice(tun.TUN(), bind, NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	pk := randPublicKeyHex(t)
+	err := dev.IpcSet(uapiCfg(
+		"public_key", pk,
+		"endpoint", "192.0.2.1:51820",
+		"no_such_key", "1",
+	))
+	if err == nil {
+		t.Fatal("set with unknown key succeeded")
+	}
+	if bind.parsed != 0 {
+		t.Errorf("failed set parsed %d endpoints with the bind", bind.parsed)
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", pk, "endpoint", "192.0.2.1:51820:1")); err == nil {
+		t.Error("set with invalid endpoint succeeded")
+	}
+
+	assertNil(t, dev.IpcSet(uapiCfg("public_key", pk, "endpoint", "192.0.2.1:51820")))
+	if bind.parsed != 1 {
+		t.Errorf("set parsed %d endpoints with the bind, want 1", bind.parsed)
+	}
+}
+
+func TestIpcRestoreTouchedPeers(t *testing.T) {
+	dev := newDownDevice(t)
+	var kept, other, expired, added, stealer NoisePublicKey
+	for _, key := range []*NoisePublicKey{&kept, &other, &expired, &added, &stealer} {
+		assertNil(t, key.FromHex(randPublicKeyHex(t)))
+	}
+	assertNil(t, dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(kept[:]),
+		"allowed_ip", "10.1.0.0/16",
+		"public_key", hex.EncodeToString(other[:]),
+		"allowed_ip", "10.2.0.0/16",
+		"public_key", hex.EncodeToString(expired[:]),
+		"allowed_ip", "10.3.0.0/16",
+	)))
+
+	// The operation changes a peer and adds one taking the allowed IPs of
+	// another, while a peer expires and the resolver adds one.
+	dev.ipcMutex.Lock()
+	defer dev.ipcMutex.Unlock()
+	state := dev.saveIpcState()
+	state.touched = map[NoisePublicKey]bool{kept: true, stealer: true}
+	dev.LookupPeer(kept).persistentKeepaliveInterval.Store(25)
+	peer, err := dev.NewPeer(stealer)
+	assertNil(t, err)
+	dev.allowedips.Insert(netip.MustParsePrefix("10.2.0.0/16"), peer)
+	dev.RemovePeer(expired)
+	_, err = dev.NewPeer(added)
+	assertNil(t, err)
+
+	dev.restoreIpcState(state)
+	if dev.LookupPeer(kept).persistentKeepaliveInterval.Load() != 0 {
+		t.Error("touched peer not restored")
+	}
+	if dev.LookupPeer(stealer) != nil {
+		t.Error("peer added by the operation not removed")
+	}
+	if dev.allowedips.Lookup(netip.MustParseAddr("10.2.0.1").AsSlice()) != dev.LookupPeer(other) {
+		t.Error("allowed IPs taken by the operation not given back")
+	}
+	if dev.LookupPeer(expired) != nil {
+		t.Error("peer removed meanwhile recreated")
+	}
+	if dev.LookupPeer(added) == nil {
+		t.Error("peer added meanwhile removed")
+	}
+}
@@ -30,6 +30,7 @@ type Keypair struct {
 	created      time.Time
 	localIndex   uint32
 	remoteIndex  uint32
+	pskEpoch     uint64 // epoch of the preshared key used in the handshake
 }
 
 type Keypairs struct {
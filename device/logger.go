@@ -6,16 +6,17 @@
 package device
 
 import (
-	"golang.zx2c4.com/wireguard/conn"
 	"log"
 	"os"
+
+	"golang.zx2c4.com/wireguard/conn"
 )
 
 // A Logger provides logging for a Device.
-// The functions are Printf-style functions.
-// They must be safe for concurrent use.
-// They do not require a trailing newline in the format.
-// If nil, that level of logging will be silent.
+// Verbosef and Errorf are Printf-style functions for free-form lines.
+// Log writes structured records tagged with a subsystem and fields
+// such as the peer, endpoint, transport and state.
+// See conn.Logger for details.
 type Logger struct {
 	conn.Logger
 }
@@ -28,7 +29,7 @@ const (
 )
 
 // Function for use in Logger for discarding logged lines.
-func DiscardLogf(format string, args ...any) {}
+var DiscardLogf = conn.DiscardLogf
 
 // NewLogger constructs a Logger that writes to stdout.
 // It logs at the specified log level and above.
@@ -46,3 +47,10 @@ func NewLogger(level int, prepend string) *Logger {
 	}
 	return logger
 }
+
+// NewHandlerLogger constructs a Logger that sends all records to handler,
+// for example a conn.SlogHandler wrapped in a conn.LevelFilter.
+// Lines written with Verbosef and Errorf are tagged with the device subsystem.
+func NewHandlerLogger(handler conn.LogHandler) *Logger {
+	return &Logger{conn.NewHandlerLogger(handler, conn.SubsystemDevice)}
+}
@@ -8,11 +8,18 @@ package device
 // DisableSomeRoamingForBrokenMobileSemantics should ideally be called before peers are created,
 // though it will try to deal with it, and race maybe, if called after.
 func (device *Device) DisableSomeRoamingForBrokenMobileSemantics() {
-	device.net.brokenRoaming = true
+	device.setBrokenRoaming(true)
+}
+
+// setBrokenRoaming sets whether roaming is disabled for the peers with an endpoint.
+func (device *Device) setBrokenRoaming(broken bool) {
+	device.net.Lock()
+	device.net.brokenRoaming = broken
+	device.net.Unlock()
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.Lock()
-		peer.disableRoaming = peer.endpoint != nil
+		peer.disableRoaming = broken && peer.endpoint != nil
 		peer.Unlock()
 	}
 	device.peers.RUnlock()
@@ -15,6 +15,7 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/poly1305"
 
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/tai64n"
 )
 
@@ -66,7 +67,7 @@ const (
 	MessageTransportHeaderSize = 16                                            // size of data preceding content in transport message
 	MessageTransportSize       = MessageTransportHeaderSize + poly1305.TagSize // size of empty transport
 	MessageKeepaliveSize       = MessageTransportSize                          // size of keepalive
-	MessageHandshakeSize       = MessageInitiationSize                         // size of largest handshake related message
+	MessageHandshakeSize       = MessageHybridInitiationSize                   // size of largest handshake related message
 )
 
 const (
@@ -118,9 +119,13 @@ type MessageCookieReply struct {
 type Handshake struct {
 	state                     handshakeState
 	mutex                     sync.RWMutex
-	hash                      [blake2s.Size]byte       // hash value
-	chainKey                  [blake2s.Size]byte       // chain key
-	presharedKey              NoisePresharedKey        // psk
+	hash                      [blake2s.Size]byte // hash value
+	chainKey                  [blake2s.Size]byte // chain key
+	presharedKey              NoisePresharedKey  // static psk, configured with UAPI
+	sessionPresharedKey       NoisePresharedKey  // psk of the handshake in progress
+	sessionPresharedKeyEpoch  uint64
+	localKEM                  kemDecapsulationKey      // ephemeral ML-KEM key of a hybrid initiation
+	remoteKEMKey              []byte                   // ML-KEM encapsulation key of a consumed hybrid initiation
 	localEphemeral            NoisePrivateKey          // ephemeral secret key
 	localIndex                uint32                   // used to clear hash-table
 	remoteIndex               uint32                   // index for sending
@@ -155,6 +160,9 @@ func (h *Handshake) Clear() {
 	setZero(h.remoteEphemeral[:])
 	setZero(h.chainKey[:])
 	setZero(h.hash[:])
+	setZero(h.sessionPresharedKey[:])
+	h.localKEM = nil
+	h.remoteKEMKey = nil
 	h.localIndex = 0
 	h.state = handshakeZeroed
 }
@@ -175,6 +183,15 @@ func init() {
 }
 
 func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, error) {
+	msg, _, err := device.createMessageInitiation(peer, false)
+	return msg, err
+}
+
+// createMessageInitiation creates a classic or hybrid initiation.
+// For a hybrid initiation, it also returns the ML-KEM encapsulation key to send.
+func (device *Device) createMessageInitiation(peer *Peer, hybrid bool) (*MessageInitiation, []byte, error) {
+	psk, pskEpoch := device.presharedKey(peer)
+
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
@@ -182,13 +199,16 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
 
+	handshake.sessionPresharedKey = psk
+	handshake.sessionPresharedKeyEpoch = pskEpoch
+	setZero(psk[:])
+
 	// create ephemeral key
 	var err error
-	handshake.hash = InitialHash
-	handshake.chainKey = InitialChainKey
+	handshake.chainKey, handshake.hash = initialHandshakeState(hybrid)
 	handshake.localEphemeral, err = newPrivateKey()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	handshake.mixHash(handshake.remoteStatic[:])
@@ -204,7 +224,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	// encrypt static key
 	ss, err := handshake.localEphemeral.sharedSecret(handshake.remoteStatic)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	var key [chacha20poly1305.KeySize]byte
 	KDF2(
@@ -219,7 +239,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 
 	// encrypt timestamp
 	if isZero(handshake.precomputedStaticStatic[:]) {
-		return nil, errInvalidPublicKey
+		return nil, nil, errInvalidPublicKey
 	}
 	KDF2(
 		&handshake.chainKey,
@@ -227,48 +247,91 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		handshake.chainKey[:],
 		handshake.precomputedStaticStatic[:],
 	)
-	timestamp := tai64n.Now()
+	timestamp, err := device.timestamps.Load().Now()
+	if err != nil {
+		return nil, nil, err
+	}
 	aead, _ = chacha20poly1305.New(key[:])
 	aead.Seal(msg.Timestamp[:0], ZeroNonce[:], timestamp[:], handshake.hash[:])
 
+	// create ephemeral ML-KEM key
+	handshake.localKEM = nil
+	var kemKey []byte
+	if hybrid {
+		handshake.localKEM, err = generateKEMKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		kemKey = handshake.localKEM.encapsulationKey()
+	}
+
 	// assign index
 	device.indexTable.Delete(handshake.localIndex)
 	msg.Sender, err = device.indexTable.NewIndexForHandshake(peer, handshake)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	handshake.localIndex = msg.Sender
 
 	handshake.mixHash(msg.Timestamp[:])
+	if hybrid {
+		handshake.mixHash(kemKey)
+	}
 	handshake.state = handshakeInitiationCreated
-	return &msg, nil
+	return &msg, kemKey, nil
 }
 
+// ConsumeMessageInitiation consumes an initiation addressed to the current
+// static key. The receive path also accepts initiations addressed to a retired
+// key, which it tells apart by their mac1.
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	if msg.Type != MessageInitiationType {
+		return nil
+	}
+	return device.consumeMessageInitiation(msg, nil, nil, nil)
+}
+
+// consumeMessageInitiation consumes a classic initiation,
+// or a hybrid one if kemKey holds the ML-KEM encapsulation key it carried.
+// It is addressed to the retired identity if not nil, as told by its mac1,
+// and to the current one otherwise.
+// If the initiation comes from an authenticated sender that is not a peer,
+// its public key is stored in unknown, if not nil.
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation, kemKey []byte, unknown *NoisePublicKey, retired *retiredIdentity) *Peer {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
 
-	if msg.Type != MessageInitiationType {
-		return nil
-	}
+	hybrid := kemKey != nil
+	initialChainKey, initialHash := initialHandshakeState(hybrid)
 
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
-	mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
+	id, pk := device.staticIdentity.identity, &device.staticIdentity.publicKey
+	if retired != nil {
+		// the retired key may have been dropped since the mac1 was checked
+		if device.retiredKey() != retired {
+			return nil
+		}
+		id, pk = retired.identity, &retired.publicKey
+	}
+
+	mixHash(&hash, &initialHash, pk[:])
 	mixHash(&hash, &hash, msg.Ephemeral[:])
-	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
+	mixKey(&chainKey, &initialChainKey, msg.Ephemeral[:])
 
 	// decrypt static key
+
 	var peerPK NoisePublicKey
 	var key [chacha20poly1305.KeySize]byte
-	ss, err := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
+	ss, err := sharedSecret(id, msg.Ephemeral)
 	if err != nil {
 		return nil
 	}
 	KDF2(&chainKey, &key, chainKey[:], ss[:])
+	setZero(ss[:])
 	aead, _ := chacha20poly1305.New(key[:])
 	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
 	if err != nil {
@@ -279,7 +342,17 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	// lookup peer
 
 	peer := device.LookupPeer(peerPK)
-	if peer == nil || !peer.isRunning.Load() {
+	if peer == nil {
+		if unknown != nil && device.authenticateInitiation(msg, id, peerPK, &chainKey, &hash) {
+			*unknown = peerPK
+		}
+		return nil
+	}
+	if !peer.isRunning.Load() {
+		return nil
+	}
+	if peer.hybrid.Load() != hybrid {
+		device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Handshake mode mismatch", conn.PeerField(peer), conn.Field{Key: "hybrid", Value: hybrid})
 		return nil
 	}
 
@@ -288,10 +361,17 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	// verify identity
 
 	var timestamp tai64n.Timestamp
+	var staticStatic [NoisePublicKeySize]byte
+	if retired != nil {
+		staticStatic, _ = sharedSecret(retired.identity, peerPK)
+	}
 
 	handshake.mutex.RLock()
 
-	if isZero(handshake.precomputedStaticStatic[:]) {
+	if retired == nil {
+		staticStatic = handshake.precomputedStaticStatic
+	}
+	if isZero(staticStatic[:]) {
 		handshake.mutex.RUnlock()
 		return nil
 	}
@@ -299,8 +379,9 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 		&chainKey,
 		&key,
 		chainKey[:],
-		handshake.precomputedStaticStatic[:],
+		staticStatic[:],
 	)
+	setZero(staticStatic[:])
 	aead, _ = chacha20poly1305.New(key[:])
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
@@ -308,20 +389,30 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 		return nil
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
+	if hybrid {
+		mixHash(&hash, &hash, kemKey)
+	}
 
 	// protect against replay & flood
 
-	replay := !timestamp.After(handshake.lastTimestamp)
-	flood := time.Since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
+	lastTimestamp := handshake.lastTimestamp
+	replay := !timestamp.After(lastTimestamp)
+	flood := device.now().Sub(handshake.lastInitiationConsumption) <= HandshakeInitationRate
 	handshake.mutex.RUnlock()
 	if replay {
-		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake replay @ %v", peer, timestamp)
+		device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Handshake replay", conn.PeerField(peer), conn.Field{Key: "timestamp", Value: timestamp})
+		peer.notifyHandshake(HandshakeRejected, HandshakeFailStaleTimestamp, fmt.Errorf("timestamp %v is not after %v", timestamp, lastTimestamp))
 		return nil
 	}
 	if flood {
-		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake flood", peer)
+		device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Handshake flood", conn.PeerField(peer))
 		return nil
 	}
+	if retired != nil {
+		device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Handshake initiation addressed to retired static key", conn.PeerField(peer))
+	}
+
+	psk, pskEpoch := device.presharedKey(peer)
 
 	// update handshake state
 
@@ -329,12 +420,18 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	handshake.hash = hash
 	handshake.chainKey = chainKey
+	handshake.sessionPresharedKey = psk
+	handshake.sessionPresharedKeyEpoch = pskEpoch
 	handshake.remoteIndex = msg.Sender
 	handshake.remoteEphemeral = msg.Ephemeral
+	handshake.remoteKEMKey = nil
+	if hybrid {
+		handshake.remoteKEMKey = append([]byte(nil), kemKey...)
+	}
 	if timestamp.After(handshake.lastTimestamp) {
 		handshake.lastTimestamp = timestamp
 	}
-	now := time.Now()
+	now := device.now()
 	if now.After(handshake.lastInitiationConsumption) {
 		handshake.lastInitiationConsumption = now
 	}
@@ -344,17 +441,29 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	setZero(hash[:])
 	setZero(chainKey[:])
+	setZero(psk[:])
 
 	return peer
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
+	msg, _, err := device.createMessageResponse(peer, false)
+	return msg, err
+}
+
+// createMessageResponse creates a response to a consumed initiation, which must be
+// hybrid if and only if hybrid is set. For a hybrid response, it also returns
+// the ML-KEM ciphertext to send.
+func (device *Device) createMessageResponse(peer *Peer, hybrid bool) (*MessageResponse, []byte, error) {
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
 
 	if handshake.state != handshakeInitiationConsumed {
-		return nil, errors.New("handshake initiation must be consumed first")
+		return nil, nil, errors.New("handshake initiation must be consumed first")
+	}
+	if (handshake.remoteKEMKey != nil) != hybrid {
+		return nil, nil, errors.New("response does not match the mode of the initiation")
 	}
 
 	// assign index
@@ -363,7 +472,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	device.indexTable.Delete(handshake.localIndex)
 	handshake.localIndex, err = device.indexTable.NewIndexForHandshake(peer, handshake)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var msg MessageResponse
@@ -375,7 +484,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 
 	handshake.localEphemeral, err = newPrivateKey()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	msg.Ephemeral = handshake.localEphemeral.publicKey()
 	handshake.mixHash(msg.Ephemeral[:])
@@ -383,15 +492,29 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 
 	ss, err := handshake.localEphemeral.sharedSecret(handshake.remoteEphemeral)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	handshake.mixKey(ss[:])
 	ss, err = handshake.localEphemeral.sharedSecret(handshake.remoteStatic)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	handshake.mixKey(ss[:])
 
+	// encapsulate to the ML-KEM key of the initiator
+
+	var kemCiphertext []byte
+	if hybrid {
+		var kemSecret []byte
+		kemSecret, kemCiphertext, err = kemEncapsulate(handshake.remoteKEMKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		handshake.mixHash(kemCiphertext)
+		handshake.mixKey(kemSecret)
+		setZero(kemSecret)
+	}
+
 	// add preshared key
 
 	var tau [blake2s.Size]byte
@@ -402,7 +525,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 		&tau,
 		&key,
 		handshake.chainKey[:],
-		handshake.presharedKey[:],
+		handshake.sessionPresharedKey[:],
 	)
 
 	handshake.mixHash(tau[:])
@@ -413,13 +536,20 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 
 	handshake.state = handshakeResponseCreated
 
-	return &msg, nil
+	return &msg, kemCiphertext, nil
 }
 
 func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	if msg.Type != MessageResponseType {
 		return nil
 	}
+	return device.consumeMessageResponse(msg, nil)
+}
+
+// consumeMessageResponse consumes a classic response,
+// or a hybrid one if kemCiphertext holds the ML-KEM ciphertext it carried.
+func (device *Device) consumeMessageResponse(msg *MessageResponse, kemCiphertext []byte) *Peer {
+	hybrid := kemCiphertext != nil
 
 	// lookup handshake by receiver
 
@@ -440,7 +570,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		handshake.mutex.RLock()
 		defer handshake.mutex.RUnlock()
 
-		if handshake.state != handshakeInitiationCreated {
+		if handshake.state != handshakeInitiationCreated || (handshake.localKEM != nil) != hybrid {
 			return false
 		}
 
@@ -461,13 +591,25 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		mixKey(&chainKey, &chainKey, ss[:])
 		setZero(ss[:])
 
-		ss, err = device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
+		ss, err = sharedSecret(device.staticIdentity.identity, msg.Ephemeral)
 		if err != nil {
 			return false
 		}
 		mixKey(&chainKey, &chainKey, ss[:])
 		setZero(ss[:])
 
+		// decapsulate the ML-KEM shared secret
+
+		if hybrid {
+			kemSecret, err := handshake.localKEM.decapsulate(kemCiphertext)
+			if err != nil {
+				return false
+			}
+			mixHash(&hash, &hash, kemCiphertext)
+			mixKey(&chainKey, &chainKey, kemSecret)
+			setZero(kemSecret)
+		}
+
 		// add preshared key (psk)
 
 		var tau [blake2s.Size]byte
@@ -477,7 +619,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 			&tau,
 			&key,
 			chainKey[:],
-			handshake.presharedKey[:],
+			handshake.sessionPresharedKey[:],
 		)
 		mixHash(&hash, &hash, tau[:])
 
@@ -553,6 +695,9 @@ func (peer *Peer) BeginSymmetricSession() error {
 	setZero(handshake.chainKey[:])
 	setZero(handshake.hash[:]) // Doesn't necessarily need to be zeroed. Could be used for something interesting down the line.
 	setZero(handshake.localEphemeral[:])
+	setZero(handshake.sessionPresharedKey[:])
+	handshake.localKEM = nil
+	handshake.remoteKEMKey = nil
 	peer.handshake.state = handshakeZeroed
 
 	// create AEAD instances
@@ -564,11 +709,12 @@ func (peer *Peer) BeginSymmetricSession() error {
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
-	keypair.created = time.Now()
-	keypair.replayFilter.Reset()
+	keypair.created = peer.device.now()
+	keypair.replayFilter.SetWindowSize(peer.replayWindowSize())
 	keypair.isInitiator = isInitiator
 	keypair.localIndex = peer.handshake.localIndex
 	keypair.remoteIndex = peer.handshake.remoteIndex
+	keypair.pskEpoch = handshake.sessionPresharedKeyEpoch
 
 	// remap index
 
@@ -601,6 +747,7 @@ func (peer *Peer) BeginSymmetricSession() error {
 		keypairs.previous = nil
 		device.DeleteKeypair(previous)
 	}
+	device.publishEvent(Event{Kind: EventKeypairRotated, PublicKey: handshake.remoteStatic})
 
 	return nil
 }
@@ -76,3 +76,30 @@ func (key NoisePublicKey) Equals(tar NoisePublicKey) bool {
 func (key *NoisePresharedKey) FromHex(src string) error {
 	return loadExactHex(key[:], src)
 }
+
+// MarshalText encodes the key in hex, as in the configuration protocol.
+func (key NoisePublicKey) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(key[:])), nil
+}
+
+func (key *NoisePublicKey) UnmarshalText(text []byte) error {
+	return key.FromHex(string(text))
+}
+
+// MarshalText encodes the key in hex, as in the configuration protocol.
+func (key NoisePrivateKey) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(key[:])), nil
+}
+
+func (key *NoisePrivateKey) UnmarshalText(text []byte) error {
+	return key.FromMaybeZeroHex(string(text))
+}
+
+// MarshalText encodes the key in hex, as in the configuration protocol.
+func (key NoisePresharedKey) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(key[:])), nil
+}
+
+func (key *NoisePresharedKey) UnmarshalText(text []byte) error {
+	return key.FromHex(string(text))
+}
@@ -32,14 +32,14 @@ func TestCurveWrappers(t *testing.T) {
 	}
 }
 
-func randDevice(t *testing.T) *Device {
+func randDevice(t *testing.T, opts ...Option) *Device {
 	sk, err := newPrivateKey()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tun := tuntest.NewChannelTUN()
 	logger := NewLogger(LogLevelError, "")
-	device := NewDevice(tun.TUN(), conn.NewDefaultBind(), logger, make(chan HandshakeState))
+	device := NewDevice(tun.TUN(), conn.NewDefaultBind(), logger, opts...)
 	device.SetPrivateKey(sk)
 	return device
 }
@@ -0,0 +1,249 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/* Obfuscation
+ *
+ * The fixed message types and sizes of the protocol make it easy to
+ * fingerprint. A device may be given an obfuscation profile, which
+ *
+ *   replaces the message types with other values on the wire;
+ *
+ *   prepends a random amount of random bytes to handshake messages
+ *   (initiations, responses and cookie replies); the receiver finds
+ *   the message at the end of the datagram, as its size is known;
+ *
+ *   sends a few datagrams of random bytes before each handshake initiation.
+ *
+ * This does not add any security, and both sides must use the same profile.
+ * Without a profile, the device is compatible with standard WireGuard.
+ */
+
+const (
+	MaxJunkPrefixSize = 512  // largest junk prefix, unless handshakes with it do not fit into MaxSegmentSize
+	MaxDecoys         = 64   // largest number of decoy datagrams before an initiation
+	MaxDecoySize      = 1280 // largest decoy datagram
+)
+
+// An ObfuscationProfile configures the obfuscation of the messages of a device.
+// The zero value disables obfuscation.
+type ObfuscationProfile struct {
+	// Values sent in place of the message types. Zero keeps the standard value.
+	InitiationType       uint32
+	ResponseType         uint32
+	CookieReplyType      uint32
+	TransportType        uint32
+	HybridInitiationType uint32
+	HybridResponseType   uint32
+
+	// JunkPrefixMax is the largest number of random bytes prepended
+	// to a handshake message.
+	JunkPrefixMax int
+
+	// Decoys is the number of datagrams of random bytes sent before each
+	// handshake initiation, each between DecoySizeMin and DecoySizeMax bytes long.
+	Decoys       int
+	DecoySizeMin int
+	DecoySizeMax int
+}
+
+// handshakeMessageSizes lists the sizes of the fixed-size messages.
+var handshakeMessageSizes = [...]struct {
+	msgType uint32
+	size    int
+}{
+	{MessageInitiationType, MessageInitiationSize},
+	{MessageResponseType, MessageResponseSize},
+	{MessageCookieReplyType, MessageCookieReplySize},
+	{MessageHybridInitiationType, MessageHybridInitiationSize},
+	{MessageHybridResponseType, MessageHybridResponseSize},
+}
+
+// An obfuscation is a validated ObfuscationProfile ready for use on the data path.
+type obfuscation struct {
+	profile ObfuscationProfile
+	types   [MessageHybridResponseType + 1]uint32 // wire value of each message type
+}
+
+func newObfuscation(p ObfuscationProfile) (*obfuscation, error) {
+	if p == (ObfuscationProfile{}) {
+		return nil, nil
+	}
+	if p.JunkPrefixMax < 0 || p.JunkPrefixMax > maxJunkPrefix() {
+		return nil, fmt.Errorf("junk prefix size must be between 0 and %d", maxJunkPrefix())
+	}
+	if p.Decoys < 0 || p.Decoys > MaxDecoys {
+		return nil, fmt.Errorf("number of decoys must be between 0 and %d", MaxDecoys)
+	}
+	if p.DecoySizeMin < 0 || p.DecoySizeMin > p.DecoySizeMax || p.DecoySizeMax > MaxDecoySize {
+		return nil, fmt.Errorf("decoy sizes must satisfy 0 <= min <= max <= %d", MaxDecoySize)
+	}
+	if p.Decoys > 0 && p.DecoySizeMax == 0 {
+		return nil, errors.New("decoys need a maximum size")
+	}
+
+	o := &obfuscation{profile: p}
+	for i, t := range []uint32{
+		MessageInitiationType:       p.InitiationType,
+		MessageResponseType:         p.ResponseType,
+		MessageCookieReplyType:      p.CookieReplyType,
+		MessageTransportType:        p.TransportType,
+		MessageHybridInitiationType: p.HybridInitiationType,
+		MessageHybridResponseType:   p.HybridResponseType,
+	} {
+		if t == 0 {
+			t = uint32(i)
+		}
+		o.types[i] = t
+	}
+	for i := MessageInitiationType; i < len(o.types); i++ {
+		for j := i + 1; j < len(o.types); j++ {
+			if o.types[i] == o.types[j] {
+				return nil, fmt.Errorf("message types %d and %d are both sent as %d", i, j, o.types[i])
+			}
+		}
+	}
+	return o, nil
+}
+
+// maxJunkPrefix returns the largest junk prefix on this platform: a hybrid
+// initiation, the largest handshake message, must fit into MaxSegmentSize
+// with its junk prefix, which it does not with MaxJunkPrefixSize on iOS.
+func maxJunkPrefix() int {
+	if n := MaxSegmentSize - MessageHandshakeSize; n < MaxJunkPrefixSize {
+		return n
+	}
+	return MaxJunkPrefixSize
+}
+
+// SetObfuscationProfile sets the obfuscation profile of the device.
+// A nil or zero profile disables obfuscation.
+func (device *Device) SetObfuscationProfile(p *ObfuscationProfile) error {
+	var profile ObfuscationProfile
+	if p != nil {
+		profile = *p
+	}
+	o, err := newObfuscation(profile)
+	if err != nil {
+		return err
+	}
+	device.obfuscation.Store(o)
+	return nil
+}
+
+// ObfuscationProfile returns the obfuscation profile of the device,
+// or nil if obfuscation is disabled.
+func (device *Device) ObfuscationProfile() *ObfuscationProfile {
+	o := device.obfuscation.Load()
+	if o == nil {
+		return nil
+	}
+	p := o.profile
+	return &p
+}
+
+// transportType returns the wire value of the transport message type.
+func (o *obfuscation) transportType() uint32 {
+	if o == nil {
+		return MessageTransportType
+	}
+	return o.types[MessageTransportType]
+}
+
+// wrap returns the handshake message packet as sent on the wire.
+func (o *obfuscation) wrap(packet []byte) ([]byte, error) {
+	junk, err := randIntn(o.profile.JunkPrefixMax + 1)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, junk+len(packet))
+	if _, err := rand.Read(out[:junk]); err != nil {
+		return nil, err
+	}
+	copy(out[junk:], packet)
+	msgType := binary.LittleEndian.Uint32(packet)
+	binary.LittleEndian.PutUint32(out[junk:], o.types[msgType])
+	return out, nil
+}
+
+// unwrap restores the message within the datagram packet in place,
+// or returns nil if the datagram does not hold any message.
+func (o *obfuscation) unwrap(packet []byte) []byte {
+	if binary.LittleEndian.Uint32(packet) == o.types[MessageTransportType] {
+		binary.LittleEndian.PutUint32(packet, MessageTransportType)
+		return packet
+	}
+	for _, msg := range handshakeMessageSizes {
+		junk := len(packet) - msg.size
+		if junk < 0 || junk > o.profile.JunkPrefixMax {
+			continue
+		}
+		if binary.LittleEndian.Uint32(packet[junk:]) == o.types[msg.msgType] {
+			packet = packet[junk:]
+			binary.LittleEndian.PutUint32(packet, msg.msgType)
+			return packet
+		}
+	}
+	return nil
+}
+
+// decoy returns a decoy datagram.
+func (o *obfuscation) decoy() ([]byte, error) {
+	size, err := randIntn(o.profile.DecoySizeMax - o.profile.DecoySizeMin + 1)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, o.profile.DecoySizeMin+size)
+	_, err = rand.Read(packet)
+	return packet, err
+}
+
+// randIntn returns a random number in [0, n).
+// The modulo bias is of no concern for obfuscation.
+func randIntn(n int) (int, error) {
+	if n <= 1 {
+		return 0, nil
+	}
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int(binary.LittleEndian.Uint32(b[:]) % uint32(n)), nil
+}
+
+// sendObfuscated sends the handshake message packet to the peer,
+// obfuscated according to the profile of the device.
+// Initiations are preceded by decoys.
+func (peer *Peer) sendObfuscated(packet []byte) error {
+	o := peer.device.obfuscation.Load()
+	if o == nil {
+		return peer.SendBuffer(packet)
+	}
+	msgType := binary.LittleEndian.Uint32(packet)
+	if msgType == MessageInitiationType || msgType == MessageHybridInitiationType {
+		for i := 0; i < o.profile.Decoys; i++ {
+			decoy, err := o.decoy()
+			if err != nil {
+				return err
+			}
+			if err := peer.SendBuffer(decoy); err != nil {
+				return err
+			}
+		}
+	}
+	packet, err := o.wrap(packet)
+	if err != nil {
+		return err
+	}
+	return peer.SendBuffer(packet)
+}
@@ -0,0 +1,162 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestObfuscationProfileValidation(t *testing.T) {
+	for _, p := range []ObfuscationProfile{
+		{InitiationType: 2},
+		{ResponseType: 77, TransportType: 77},
+		{JunkPrefixMax: MaxJunkPrefixSize + 1},
+		{JunkPrefixMax: MaxSegmentSize - MessageHandshakeSize + 1},
+		{Decoys: 1},
+		{Decoys: 1, DecoySizeMin: 10, DecoySizeMax: 5},
+		{Decoys: MaxDecoys + 1, DecoySizeMax: 10},
+	} {
+		if _, err := newObfuscation(p); err == nil {
+			t.Errorf("profile %+v accepted", p)
+		}
+	}
+	if o, err := newObfuscation(ObfuscationProfile{}); o != nil || err != nil {
+		t.Errorf("zero profile = %v, %v, want disabled", o, err)
+	}
+}
+
+func TestObfuscationWrap(t *testing.T) {
+	o, err := newObfuscation(ObfuscationProfile{
+		InitiationType:  0x1c2a9d31,
+		ResponseType:    0x6e0b44f2,
+		CookieReplyType: 0x0a7d5513,
+		TransportType:   0x55f3e0c4,
+		JunkPrefixMax:   64,
+		Decoys:          2,
+		DecoySizeMin:    20,
+		DecoySizeMax:    40,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range handshakeMessageSizes {
+		packet := make([]byte, msg.size)
+		binary.LittleEndian.PutUint32(packet, msg.msgType)
+		for i := 4; i < len(packet); i++ {
+			packet[i] = byte(i)
+		}
+		for i := 0; i < 16; i++ {
+			wire, err := o.wrap(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(wire) < len(packet) || len(wire) > len(packet)+64 {
+				t.Fatalf("type %d: wrapped size %d out of range", msg.msgType, len(wire))
+			}
+			if got := binary.LittleEndian.Uint32(wire[len(wire)-len(packet):]); got != o.types[msg.msgType] {
+				t.Fatalf("type %d sent as %d, want %d", msg.msgType, got, o.types[msg.msgType])
+			}
+			if got := o.unwrap(wire); !bytes.Equal(got, packet) {
+				t.Fatalf("type %d: unwrapped message differs", msg.msgType)
+			}
+		}
+	}
+
+	transport := make([]byte, MessageKeepaliveSize)
+	binary.LittleEndian.PutUint32(transport, o.transportType())
+	if got := o.unwrap(transport); got == nil || binary.LittleEndian.Uint32(got) != MessageTransportType {
+		t.Error("transport message not restored")
+	}
+
+	standard := make([]byte, MessageInitiationSize)
+	binary.LittleEndian.PutUint32(standard, MessageInitiationType)
+	if o.unwrap(standard) != nil {
+		t.Error("message with standard type accepted")
+	}
+
+	decoy, err := o.decoy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoy) < 20 || len(decoy) > 40 {
+		t.Errorf("decoy size %d out of range", len(decoy))
+	}
+}
+
+func TestObfuscationTwoDevicePing(t *testing.T) {
+	pair := genTestPair(t, true)
+	cfg := uapiCfg(
+		"obfuscation_decoy_max", "200",
+		"obfuscation_decoys", "3",
+		"obfuscation_decoy_min", "50",
+		"obfuscation_initiation_type", "3473890211",
+		"obfuscation_response_type", "1288117734",
+		"obfuscation_cookie_reply_type", "2961107522",
+		"obfuscation_transport_type", "907415309",
+		"obfuscation_junk_max", "128",
+	)
+	for i := range pair {
+		if err := pair[i].dev.IpcSet(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"obfuscation_transport_type=907415309\n", "obfuscation_decoy_min=50\n", "obfuscation_junk_max=128\n"} {
+		if !strings.Contains(got, line) {
+			t.Errorf("IpcGet output lacks %q:\n%s", line, got)
+		}
+	}
+	if err := pair[0].dev.IpcSet(uapiCfg("obfuscation_transport_type", "3473890211")); err == nil {
+		t.Error("ambiguous message types accepted")
+	}
+
+	t.Run("ping 1.0.0.1", func(t *testing.T) {
+		pair.Send(t, Ping, nil)
+	})
+	t.Run("ping 1.0.0.2", func(t *testing.T) {
+		pair.Send(t, Pong, nil)
+	})
+}
+
+func TestObfuscationHybridTwoDevicePing(t *testing.T) {
+	pair := genTestPair(t, true)
+	junk := strconv.Itoa(maxJunkPrefix())
+	for i := range pair {
+		other := pair[i^1].dev
+		other.staticIdentity.RLock()
+		pk := other.staticIdentity.publicKey
+		other.staticIdentity.RUnlock()
+		err := pair[i].dev.IpcSet(uapiCfg(
+			"obfuscation_hybrid_initiation_type", "2718281828",
+			"obfuscation_hybrid_response_type", "3141592653",
+			"obfuscation_junk_max", junk,
+			"public_key", hex.EncodeToString(pk[:]),
+			"hybrid_handshake", "true",
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if MessageHybridInitiationSize+maxJunkPrefix() > MaxSegmentSize {
+		t.Errorf("hybrid initiation with %s bytes of junk exceeds %d bytes", junk, MaxSegmentSize)
+	}
+
+	t.Run("ping 1.0.0.1", func(t *testing.T) {
+		pair.Send(t, Ping, nil)
+	})
+	t.Run("ping 1.0.0.2", func(t *testing.T) {
+		pair.Send(t, Pong, nil)
+	})
+}
@@ -0,0 +1,258 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSubscriptionBuffer is the number of events a subscription holds
+// when created with a buffer size of zero.
+const DefaultSubscriptionBuffer = 64
+
+// A Subscription delivers events published by a Device.
+//
+// Publishing never waits for subscribers. When a subscriber falls behind and
+// its buffer is full, the oldest buffered event is dropped to make room.
+type Subscription[T any] struct {
+	// C receives the events. It is closed by Close, and when the device is closed.
+	C <-chan T
+
+	c        chan T
+	dropped  atomic.Uint64
+	registry *eventRegistry[T]
+}
+
+// Dropped returns the number of events dropped because the subscriber fell behind.
+func (sub *Subscription[T]) Dropped() uint64 {
+	return sub.dropped.Load()
+}
+
+// Close stops the delivery of events and closes C.
+func (sub *Subscription[T]) Close() {
+	sub.registry.remove(sub)
+}
+
+func (sub *Subscription[T]) deliver(event T) {
+	for {
+		select {
+		case sub.c <- event:
+			return
+		default:
+		}
+		select {
+		case <-sub.c:
+			sub.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// An eventRegistry fans events out to any number of subscriptions.
+type eventRegistry[T any] struct {
+	sync.RWMutex
+	subs   map[*Subscription[T]]struct{}
+	closed bool
+}
+
+func (registry *eventRegistry[T]) subscribe(buffer int) *Subscription[T] {
+	if buffer <= 0 {
+		buffer = DefaultSubscriptionBuffer
+	}
+	c := make(chan T, buffer)
+	sub := &Subscription[T]{C: c, c: c, registry: registry}
+
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.closed {
+		close(c)
+		return sub
+	}
+	if registry.subs == nil {
+		registry.subs = make(map[*Subscription[T]]struct{})
+	}
+	registry.subs[sub] = struct{}{}
+	return sub
+}
+
+func (registry *eventRegistry[T]) remove(sub *Subscription[T]) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.subs[sub]; ok {
+		delete(registry.subs, sub)
+		close(sub.c)
+	}
+}
+
+func (registry *eventRegistry[T]) publish(event T) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for sub := range registry.subs {
+		sub.deliver(event)
+	}
+}
+
+// active reports whether anyone is subscribed, so that publishers can skip building events.
+func (registry *eventRegistry[T]) active() bool {
+	registry.RLock()
+	defer registry.RUnlock()
+	return len(registry.subs) != 0
+}
+
+// close closes all subscriptions; later ones are closed right away.
+func (registry *eventRegistry[T]) close() {
+	registry.Lock()
+	defer registry.Unlock()
+	for sub := range registry.subs {
+		close(sub.c)
+	}
+	registry.subs = nil
+	registry.closed = true
+}
+
+// A HandshakeFailReason tells why a handshake failed or was rejected.
+type HandshakeFailReason string
+
+const (
+	HandshakeFailTimeout     HandshakeFailReason = "timeout"      // no response in time, retrying
+	HandshakeFailMaxAttempts HandshakeFailReason = "max-attempts" // no response after all retries, giving up
+	HandshakeFailSend        HandshakeFailReason = "send"         // the initiation could not be sent
+
+	// HandshakeFailStaleTimestamp reports an initiation rejected because its
+	// timestamp is not after the last one of the peer, because of a replay or
+	// because the clock of the peer went backwards.
+	HandshakeFailStaleTimestamp HandshakeFailReason = "stale-timestamp"
+)
+
+// A HandshakeEvent reports the progress of a handshake.
+type HandshakeEvent struct {
+	State HandshakeState
+	Time  time.Time
+
+	// PublicKey and Endpoint identify the peer. They are zero for events
+	// about the device as a whole, such as the HandshakeInit sent when it comes up.
+	PublicKey NoisePublicKey
+	Endpoint  string
+
+	// Reason and Err describe a HandshakeFail or HandshakeRejected.
+	Reason HandshakeFailReason
+	Err    error
+}
+
+// SubscribeHandshakes returns a subscription to handshake events
+// holding up to buffer events; zero selects DefaultSubscriptionBuffer.
+func (device *Device) SubscribeHandshakes(buffer int) *Subscription[HandshakeEvent] {
+	return device.handshakeEvents.subscribe(buffer)
+}
+
+// UpdateHandshakeState publishes a handshake event about the device as a whole.
+func (device *Device) UpdateHandshakeState(state HandshakeState) {
+	if !device.handshakeEvents.active() {
+		return
+	}
+	device.handshakeEvents.publish(HandshakeEvent{State: state, Time: device.now()})
+}
+
+// notifyHandshake publishes a handshake event about peer.
+// It must not be called with the peer lock held.
+func (peer *Peer) notifyHandshake(state HandshakeState, reason HandshakeFailReason, err error) {
+	device := peer.device
+	if !device.handshakeEvents.active() && !device.events.active() {
+		return
+	}
+	event := HandshakeEvent{
+		State:     state,
+		Time:      device.now(),
+		PublicKey: peer.handshake.remoteStatic,
+		Reason:    reason,
+		Err:       err,
+	}
+	peer.RLock()
+	if peer.endpoint != nil {
+		event.Endpoint = peer.endpoint.DstToString()
+	}
+	peer.RUnlock()
+	device.handshakeEvents.publish(event)
+
+	switch state {
+	case HandshakeSuccess:
+		device.publishEvent(Event{Kind: EventHandshakeComplete, PublicKey: event.PublicKey, Endpoint: event.Endpoint})
+	case HandshakeFail:
+		device.publishEvent(Event{Kind: EventHandshakeFailed, PublicKey: event.PublicKey, Endpoint: event.Endpoint, Reason: string(reason)})
+	case HandshakeRejected:
+		device.publishEvent(Event{Kind: EventHandshakeRejected, PublicKey: event.PublicKey, Endpoint: event.Endpoint, Reason: string(reason)})
+	}
+}
+
+// forwardHandshakeStates copies the states of handshake events to ch,
+// for users of WithHandshakeStateChan, which only know the states a handshake
+// of the device goes through. It closes ch once sub or closed is closed,
+// even if nobody reads from ch anymore.
+func forwardHandshakeStates(sub *Subscription[HandshakeEvent], ch chan<- HandshakeState, closed <-chan struct{}) {
+	defer close(ch)
+	for event := range sub.C {
+		if event.State == HandshakeRejected {
+			continue
+		}
+		select {
+		case ch <- event.State:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// An EventKind tells what an Event reports.
+type EventKind string
+
+const (
+	EventHandshakeComplete EventKind = "handshake-complete"
+	EventHandshakeFailed   EventKind = "handshake-failed"
+	EventHandshakeRejected EventKind = "handshake-rejected"
+	EventEndpointChanged   EventKind = "endpoint-changed"
+	EventKeypairRotated    EventKind = "keypair-rotated"
+	EventPeerAdded         EventKind = "peer-added"
+	EventPeerRemoved       EventKind = "peer-removed"
+	EventStateChanged      EventKind = "state-changed"
+)
+
+// An Event reports a change of the device or of one of its peers.
+// It is what the UAPI watch operation streams.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+
+	// PublicKey identifies the peer. It is zero for EventStateChanged.
+	PublicKey NoisePublicKey
+
+	// Endpoint is the endpoint of the peer, for handshake and endpoint events.
+	Endpoint string
+
+	// Reason tells why a handshake failed or was rejected, as a HandshakeFailReason,
+	// or why a peer was removed, as a PeerRemovalReason; it is empty
+	// for peers removed by the user.
+	Reason string
+
+	// State is the new state of the device: "up", "down" or "closed".
+	State string
+}
+
+// SubscribeEvents returns a subscription to all the events of the device
+// holding up to buffer events; zero selects DefaultSubscriptionBuffer.
+func (device *Device) SubscribeEvents(buffer int) *Subscription[Event] {
+	return device.events.subscribe(buffer)
+}
+
+// publishEvent publishes event, timestamped now.
+func (device *Device) publishEvent(event Event) {
+	if !device.events.active() {
+		return
+	}
+	event.Time = device.now()
+	device.events.publish(event)
+}
@@ -0,0 +1,223 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestEventRegistryDropsOldest(t *testing.T) {
+	var registry eventRegistry[int]
+	slow := registry.subscribe(2)
+	fast := registry.subscribe(8)
+	for i := 1; i <= 5; i++ {
+		registry.publish(i)
+	}
+	if got := slow.Dropped(); got != 3 {
+		t.Errorf("slow subscriber dropped %d events, want 3", got)
+	}
+	if got := fast.Dropped(); got != 0 {
+		t.Errorf("fast subscriber dropped %d events, want 0", got)
+	}
+	if a, b := <-slow.C, <-slow.C; a != 4 || b != 5 {
+		t.Errorf("slow subscriber got %d, %d, want the newest events 4, 5", a, b)
+	}
+
+	slow.Close()
+	slow.Close()
+	if _, ok := <-slow.C; ok {
+		t.Error("closed subscription still delivers events")
+	}
+	registry.publish(6)
+
+	registry.close()
+	var got []int
+	for i := range fast.C {
+		got = append(got, i)
+	}
+	if len(got) != 6 {
+		t.Errorf("fast subscriber got %v, want all 6 events", got)
+	}
+	if _, ok := <-registry.subscribe(1).C; ok {
+		t.Error("subscription to a closed registry is open")
+	}
+}
+
+func TestForwardHandshakeStatesUnread(t *testing.T) {
+	var registry eventRegistry[HandshakeEvent]
+	sub := registry.subscribe(4)
+	ch := make(chan HandshakeState)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		forwardHandshakeStates(sub, ch, closed)
+		close(done)
+	}()
+
+	registry.publish(HandshakeEvent{State: HandshakeInit})
+	registry.publish(HandshakeEvent{State: HandshakeSuccess})
+	close(closed)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarding blocked on a channel nobody reads")
+	}
+	if _, ok := <-ch; ok {
+		t.Error("channel not closed")
+	}
+}
+
+func TestHandshakeEvents(t *testing.T) {
+	pair := genTestPair(t, true)
+	subs := [2]*Subscription[HandshakeEvent]{
+		pair[0].dev.SubscribeHandshakes(0),
+		pair[1].dev.SubscribeHandshakes(0),
+	}
+	pair.Send(t, Ping, nil)
+
+	for i, sub := range subs {
+		other := pair[i^1].dev
+		other.staticIdentity.RLock()
+		want := other.staticIdentity.publicKey
+		other.staticIdentity.RUnlock()
+
+		timeout := time.After(5 * time.Second)
+		for done := false; !done; {
+			select {
+			case event := <-sub.C:
+				if event.State != HandshakeSuccess {
+					continue
+				}
+				if event.PublicKey != want {
+					t.Errorf("device %d: handshake event for unexpected peer", i)
+				}
+				if event.Endpoint == "" {
+					t.Errorf("device %d: handshake event without endpoint", i)
+				}
+				done = true
+			case <-timeout:
+				t.Fatalf("device %d: no handshake event", i)
+			}
+		}
+	}
+
+	pair[0].dev.Close()
+	for range subs[0].C {
+	}
+}
+
+func TestIpcWatch(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+	client, server := net.Pipe()
+	defer client.Close()
+	go dev.IpcHandle(server)
+
+	if _, err := client.Write([]byte("watch=1\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 64)
+	go func() {
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	for !dev.events.active() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// expect waits for a line with all of fields, skipping the others.
+	expect := func(fields ...string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("watch ended waiting for %q", fields)
+				}
+				matched := true
+				for _, field := range fields {
+					matched = matched && strings.Contains(" "+line+" ", " "+field+" ")
+				}
+				if matched {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no event with %q", fields)
+			}
+		}
+	}
+
+	added := randPublicKeyHex(t)
+	assertNil(t, dev.IpcSet(uapiCfg("public_key", added, "endpoint", "127.0.0.1:1")))
+	expect("event=peer-added", "public_key="+added)
+	expect("event=endpoint-changed", "public_key="+added, "endpoint=127.0.0.1:1")
+
+	pair.Send(t, Ping, nil)
+	expect("event=handshake-complete")
+	expect("event=keypair-rotated")
+
+	assertNil(t, dev.IpcSet(uapiCfg("public_key", added, "remove", "true")))
+	expect("event=peer-removed", "public_key="+added)
+
+	dev.Close()
+	expect("event=state-changed", "state=closed")
+	expect("errno=0")
+}
+
+func TestEndpointChangedFromPacket(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := device.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, b conn.Endpoint = conn.StdNetEndpoint(netip.MustParseAddrPort("192.0.2.1:51820")),
+		conn.StdNetEndpoint(netip.MustParseAddrPort("192.0.2.1:51821"))
+
+	// Without subscribers, the endpoint is only stored.
+	peer.SetEndpointFromPacket(a)
+	if peer.endpoint != a {
+		t.Fatalf("endpoint %v, want %v", peer.endpoint, a)
+	}
+
+	events := device.SubscribeEvents(8)
+	defer events.Close()
+	allocs := testing.AllocsPerRun(100, func() {
+		peer.SetEndpointFromPacket(a)
+	})
+	if allocs != 0 {
+		t.Errorf("packets from the same endpoint allocate %v times", allocs)
+	}
+	peer.SetEndpointFromPacket(b)
+	select {
+	case event := <-events.C:
+		if event.Kind != EventEndpointChanged || event.Endpoint != "192.0.2.1:51821" {
+			t.Errorf("got %+v, want the endpoint to change to 192.0.2.1:51821", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no endpoint-changed event")
+	}
+	select {
+	case event := <-events.C:
+		t.Errorf("unexpected event %+v", event)
+	default:
+	}
+}
@@ -0,0 +1,157 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// An Option configures a Device created by NewDevice.
+type Option func(*deviceOptions)
+
+type deviceOptions struct {
+	handshakeStateChan chan<- HandshakeState
+	sourceFilter       []netip.Prefix
+	sourceFilterErr    error
+	queueSizes         QueueSizes
+	workers            int
+	logHandler         conn.LogHandler
+	clock              Clock
+	bindFactory        BindFactory
+	captureDir         string
+}
+
+// QueueSizes are the capacities of the queues of a Device.
+// Zero fields keep the platform defaults.
+type QueueSizes struct {
+	Staged    int // packets staged per peer while waiting for a handshake
+	Outbound  int // packets waiting for encryption, and per peer for transmission
+	Inbound   int // packets waiting for decryption, and per peer for the TUN device
+	Handshake int // handshake messages waiting to be processed
+}
+
+// withDefaults returns sizes with zero fields set to the platform defaults.
+func (sizes QueueSizes) withDefaults() QueueSizes {
+	if sizes.Staged <= 0 {
+		sizes.Staged = QueueStagedSize
+	}
+	if sizes.Outbound <= 0 {
+		sizes.Outbound = QueueOutboundSize
+	}
+	if sizes.Inbound <= 0 {
+		sizes.Inbound = QueueInboundSize
+	}
+	if sizes.Handshake <= 0 {
+		sizes.Handshake = QueueHandshakeSize
+	}
+	return sizes
+}
+
+// A Clock tells the time used for handshakes, keypair expiry and statistics.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// WithHandshakeStateChan makes the device report handshake progress on ch.
+// The device closes ch when it is closed.
+// It is a simpler form of Device.SubscribeHandshakes.
+func WithHandshakeStateChan(ch chan<- HandshakeState) Option {
+	return func(o *deviceOptions) { o.handshakeStateChan = ch }
+}
+
+// WithSourceFilter sets the initial device source filter; see Device.SetSourceFilter.
+// An invalid prefix is an error of CreateDevice.
+func WithSourceFilter(prefixes ...netip.Prefix) Option {
+	return func(o *deviceOptions) { o.sourceFilter = append(o.sourceFilter, prefixes...) }
+}
+
+// WithAllowedSrcAddresses sets the initial device source filter from a comma
+// separated list of addresses or prefixes, as NewDevice once took it.
+// An empty list sets no filter, and an invalid entry is an error of CreateDevice.
+func WithAllowedSrcAddresses(addresses string) Option {
+	return func(o *deviceOptions) {
+		prefixes, err := ParseSourceFilter(addresses)
+		if err != nil {
+			o.sourceFilterErr = err
+			return
+		}
+		o.sourceFilter = append(o.sourceFilter, prefixes...)
+	}
+}
+
+// WithQueueSizes sets the capacities of the device queues.
+func WithQueueSizes(sizes QueueSizes) Option {
+	return func(o *deviceOptions) { o.queueSizes = sizes }
+}
+
+// WithWorkers sets the number of encryption, decryption and handshake workers.
+// The default is one of each per CPU.
+func WithWorkers(n int) Option {
+	return func(o *deviceOptions) { o.workers = n }
+}
+
+// WithLogHandler sends the structured records of the device to handler,
+// while lines written with Verbosef and Errorf still go to the device Logger.
+func WithLogHandler(handler conn.LogHandler) Option {
+	return func(o *deviceOptions) { o.logHandler = handler }
+}
+
+// WithClock replaces the system clock, mostly for tests.
+func WithClock(clock Clock) Option {
+	return func(o *deviceOptions) { o.clock = clock }
+}
+
+// WithBindFactory sets how the device creates a Bind when its transport is
+// changed. The default creates the binds of conn.CreateStdNetBindWithOptions
+// with the error channel and socket protection of the current bind, and
+// refuses to replace binds that do not implement conn.BindHooks.
+func WithBindFactory(factory BindFactory) Option {
+	return func(o *deviceOptions) { o.bindFactory = factory }
+}
+
+// WithCaptureDir lets the capture_file UAPI key write captures into dir,
+// under the name it is given. Without it, the key is refused, since any
+// UAPI writer could otherwise create or overwrite files as the device.
+func WithCaptureDir(dir string) Option {
+	return func(o *deviceOptions) { o.captureDir = dir }
+}
+
+func newDeviceOptions(opts []Option) deviceOptions {
+	var o deviceOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.queueSizes = o.queueSizes.withDefaults()
+	if o.workers <= 0 {
+		o.workers = runtime.NumCPU()
+	}
+	if o.clock == nil {
+		o.clock = systemClock{}
+	}
+	return o
+}
+
+// validate returns the first error of the options that can be invalid.
+func (o *deviceOptions) validate() error {
+	if o.sourceFilterErr != nil {
+		return fmt.Errorf("invalid allowed source addresses: %w", o.sourceFilterErr)
+	}
+	return validateSourceFilter(o.sourceFilter)
+}
+
+// now returns the current time according to the device clock.
+func (device *Device) now() time.Time {
+	return device.clock.Now()
+}
@@ -0,0 +1,59 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestNewDeviceOptions(t *testing.T) {
+	epoch := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	prefix := netip.MustParsePrefix("10.0.0.0/8")
+	device := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""),
+		WithQueueSizes(QueueSizes{Staged: 7, Handshake: 64}),
+		WithWorkers(2),
+		WithClock(fixedClock(epoch)),
+		WithSourceFilter(prefix),
+	)
+	defer device.Close()
+
+	if got := cap(device.queue.handshake.c); got != 64 {
+		t.Errorf("handshake queue size = %d, want 64", got)
+	}
+	if got := cap(device.queue.encryption.c); got != QueueOutboundSize {
+		t.Errorf("encryption queue size = %d, want default %d", got, QueueOutboundSize)
+	}
+	if got := device.queueSizes.Staged; got != 7 {
+		t.Errorf("staged queue size = %d, want 7", got)
+	}
+	if got := device.now(); !got.Equal(epoch) {
+		t.Errorf("device time = %v, want %v", got, epoch)
+	}
+	if got := device.SourceFilter(); len(got) != 1 || got[0] != prefix {
+		t.Errorf("source filter = %v, want [%v]", got, prefix)
+	}
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := device.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cap(peer.queue.staged); got != 7 {
+		t.Errorf("peer staged queue size = %d, want 7", got)
+	}
+}
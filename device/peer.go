@@ -22,12 +22,22 @@ type Peer struct {
 	handshake         Handshake
 	device            *Device
 	endpoint          conn.Endpoint
+	host              *hostEndpoint  // the hostname endpoint is resolved from, if any
 	stopping          sync.WaitGroup // routines pending stop
 	txBytes           atomic.Uint64  // bytes send to peer (endpoint)
 	rxBytes           atomic.Uint64  // bytes received from peer
 	lastHandshakeNano atomic.Int64   // nano seconds since epoch
 
 	disableRoaming bool
+	hybrid         atomic.Bool // use the hybrid ML-KEM handshake
+	timerOverrides atomic.Pointer[PeerTimers]
+	replayWindow   atomic.Uint64 // minimum anti-replay window in messages, zero for the device window
+
+	expiry struct {
+		deadline     atomic.Int64 // unix nanoseconds at which the TTL runs out, zero for none
+		idleTimeout  atomic.Int64 // nanoseconds, zero for none
+		lastActivity atomic.Int64 // unix nanoseconds of the last authenticated packet
+	}
 
 	timers struct {
 		retransmitHandshake     *Timer
@@ -52,10 +62,18 @@ type Peer struct {
 
 	cookieGenerator             CookieGenerator
 	trieEntries                 list.List
+	sourceFilter                sourceFilter
 	persistentKeepaliveInterval atomic.Uint32
 }
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
+	return device.newPeer(pk, nil)
+}
+
+// newPeer creates the peer with public key pk. Unless setup is nil, it is
+// called with the new peer, which is locked, and with device.peers locked,
+// before the peer can be looked up.
+func (device *Device) newPeer(pk NoisePublicKey, setup func(*Peer)) (*Peer, error) {
 	if device.isClosed() {
 		return nil, errors.New("device closed")
 	}
@@ -81,7 +99,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	peer.device = device
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
 	peer.queue.inbound = newAutodrainingInboundQueue(device)
-	peer.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
+	peer.queue.staged = make(chan *QueueOutboundElement, device.queueSizes.Staged)
 
 	// map public key
 	_, ok := device.peers.keyMap[pk]
@@ -92,7 +110,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	// pre-compute DH
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
-	handshake.precomputedStaticStatic, _ = device.staticIdentity.privateKey.sharedSecret(pk)
+	handshake.precomputedStaticStatic, _ = sharedSecret(device.staticIdentity.identity, pk)
 	handshake.remoteStatic = pk
 	handshake.mutex.Unlock()
 
@@ -102,8 +120,13 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	// init timers
 	peer.timersInit()
 
+	if setup != nil {
+		setup(peer)
+	}
+
 	// add
 	device.peers.keyMap[pk] = peer
+	device.publishEvent(Event{Kind: EventPeerAdded, PublicKey: pk})
 
 	return peer, nil
 }
@@ -126,6 +149,9 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 	err := peer.device.net.bind.Send(buffer, peer.endpoint)
 	if err == nil {
 		peer.txBytes.Add(uint64(len(buffer)))
+		if c := peer.device.capture.Load(); c != nil {
+			c.bindPacket(buffer, peer.endpoint, false)
+		}
 	}
 	return err
 }
@@ -171,14 +197,14 @@ func (peer *Peer) Start() {
 	}
 
 	device := peer.device
-	device.log.Verbosef("%v - Starting", peer)
+	device.log.Log(conn.SubsystemPeer, conn.LevelDebug, "Starting", conn.PeerField(peer))
 
 	// reset routine state
 	peer.stopping.Wait()
 	peer.stopping.Add(2)
 
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(peer.protocolTimers().RekeyTimeout + time.Second))
 	peer.handshake.mutex.Unlock()
 
 	peer.device.queue.encryption.wg.Add(1) // keep encryption queue open for our writes
@@ -224,7 +250,7 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	handshake.mutex.Lock()
 	peer.device.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(peer.protocolTimers().RekeyTimeout + time.Second))
 	handshake.mutex.Unlock()
 
 	keypairs := &peer.keypairs
@@ -246,7 +272,7 @@ func (peer *Peer) Stop() {
 		return
 	}
 
-	peer.device.log.Verbosef("%v - Stopping", peer)
+	peer.device.log.Log(conn.SubsystemPeer, conn.LevelDebug, "Stopping", conn.PeerField(peer))
 
 	peer.timersStop()
 	// Signal that RoutineSequentialSender and RoutineSequentialReceiver should exit.
@@ -258,11 +284,58 @@ func (peer *Peer) Stop() {
 	peer.ZeroAndFlushAll()
 }
 
+// endpointField returns the peer's current endpoint as a structured log field.
+func (peer *Peer) endpointField() conn.Field {
+	peer.RLock()
+	defer peer.RUnlock()
+	return conn.EndpointField(peer.endpoint)
+}
+
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	if peer.disableRoaming {
 		return
 	}
 	peer.Lock()
-	peer.endpoint = endpoint
+	if !peer.device.events.active() {
+		// nobody to tell about a change, so skip comparing on every packet
+		peer.endpoint = endpoint
+		peer.Unlock()
+		return
+	}
+	changed := peer.setEndpointLocked(endpoint)
 	peer.Unlock()
+	if changed {
+		peer.notifyEndpointChanged(endpoint)
+	}
+}
+
+// setEndpointLocked sets the endpoint of the peer and reports whether it
+// changed. The caller must hold the peer lock.
+func (peer *Peer) setEndpointLocked(endpoint conn.Endpoint) bool {
+	changed := !sameEndpoint(peer.endpoint, endpoint)
+	peer.endpoint = endpoint
+	return changed
+}
+
+// sameEndpoint reports whether a and b have the same destination. Endpoints
+// implementing conn.EndpointAddrPort are compared without allocating.
+func sameEndpoint(a, b conn.Endpoint) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	ea, okA := a.(conn.EndpointAddrPort)
+	eb, okB := b.(conn.EndpointAddrPort)
+	if okA && okB {
+		return ea.DstAddrPort() == eb.DstAddrPort()
+	}
+	return a.DstToString() == b.DstToString()
+}
+
+// notifyEndpointChanged publishes the change of the endpoint of the peer to endpoint.
+func (peer *Peer) notifyEndpointChanged(endpoint conn.Endpoint) {
+	var dst string
+	if endpoint != nil {
+		dst = endpoint.DstToString()
+	}
+	peer.device.publishEvent(Event{Kind: EventEndpointChanged, PublicKey: peer.handshake.remoteStatic, Endpoint: dst})
 }
@@ -0,0 +1,169 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+)
+
+/* Protocol timers
+ *
+ * The timing constants of the protocol may be changed per device,
+ * for instance to rekey less often on battery powered devices or to wait
+ * longer for handshake responses on high latency links.
+ *
+ * RekeyAfterTime and RejectAfterTime also bound the lifetime of the keys
+ * used by the other side, so they should be changed on both sides alike.
+ * The other values only affect the local side and can also be set per peer.
+ */
+
+// ProtocolTimers holds the timing parameters of the protocol.
+type ProtocolTimers struct {
+	RekeyAfterTime   time.Duration // age of a session after which the initiator rekeys
+	RejectAfterTime  time.Duration // age of a session after which it is no longer used
+	RekeyTimeout     time.Duration // time to wait for a handshake response
+	RekeyAttemptTime time.Duration // time after which handshake attempts are given up
+	KeepaliveTimeout time.Duration // time after which received data is acknowledged with a keepalive
+}
+
+// PeerTimers holds the protocol timers that may be set per peer.
+// Zero values use the value of the device.
+type PeerTimers struct {
+	RekeyTimeout     time.Duration
+	RekeyAttemptTime time.Duration
+	KeepaliveTimeout time.Duration
+}
+
+// Bounds of the protocol timers.
+const (
+	MinRekeyAfterTime   = time.Second * 30
+	MaxRekeyAfterTime   = time.Hour * 24
+	MaxRejectAfterTime  = time.Hour * 48
+	MinRekeyTimeout     = time.Second
+	MaxRekeyTimeout     = time.Minute * 2
+	MaxRekeyAttemptTime = time.Hour
+	MinKeepaliveTimeout = time.Second
+	MaxKeepaliveTimeout = time.Minute * 10
+)
+
+// DefaultProtocolTimers returns the timers of the specification.
+func DefaultProtocolTimers() ProtocolTimers {
+	return ProtocolTimers{
+		RekeyAfterTime:   RekeyAfterTime,
+		RejectAfterTime:  RejectAfterTime,
+		RekeyTimeout:     RekeyTimeout,
+		RekeyAttemptTime: RekeyAttemptTime,
+		KeepaliveTimeout: KeepaliveTimeout,
+	}
+}
+
+// Validate reports whether the timers are within their bounds and consistent.
+func (t ProtocolTimers) Validate() error {
+	for _, bound := range []struct {
+		name     string
+		value    time.Duration
+		min, max time.Duration
+	}{
+		{"rekey after time", t.RekeyAfterTime, MinRekeyAfterTime, MaxRekeyAfterTime},
+		{"rekey timeout", t.RekeyTimeout, MinRekeyTimeout, MaxRekeyTimeout},
+		{"rekey attempt time", t.RekeyAttemptTime, t.RekeyTimeout, MaxRekeyAttemptTime},
+		{"keepalive timeout", t.KeepaliveTimeout, MinKeepaliveTimeout, MaxKeepaliveTimeout},
+		// The responder must accept a session until the initiator has had
+		// the chance to rekey, after waiting for a keepalive and a response.
+		{"reject after time", t.RejectAfterTime, t.RekeyAfterTime + t.KeepaliveTimeout + t.RekeyTimeout, MaxRejectAfterTime},
+	} {
+		if bound.value < bound.min || bound.value > bound.max {
+			return fmt.Errorf("%s %v is not between %v and %v", bound.name, bound.value, bound.min, bound.max)
+		}
+	}
+	return nil
+}
+
+// maxHandshakes returns the number of handshake retransmissions
+// before giving up.
+func (t *ProtocolTimers) maxHandshakes() uint32 {
+	return uint32(t.RekeyAttemptTime / t.RekeyTimeout)
+}
+
+// withPeer returns the timers t with the overrides of a peer.
+func (t ProtocolTimers) withPeer(p *PeerTimers) ProtocolTimers {
+	if p == nil {
+		return t
+	}
+	if p.RekeyTimeout != 0 {
+		t.RekeyTimeout = p.RekeyTimeout
+	}
+	if p.RekeyAttemptTime != 0 {
+		t.RekeyAttemptTime = p.RekeyAttemptTime
+	}
+	if p.KeepaliveTimeout != 0 {
+		t.KeepaliveTimeout = p.KeepaliveTimeout
+	}
+	return t
+}
+
+// SetProtocolTimers sets the protocol timers of the device.
+// It fails if the timers, or the timers of any peer with its overrides,
+// are not valid.
+func (device *Device) SetProtocolTimers(t ProtocolTimers) error {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	if err := device.checkProtocolTimersLocked(t); err != nil {
+		return err
+	}
+	device.protocolTimers.Store(&t)
+	return nil
+}
+
+// checkProtocolTimersLocked reports whether t is valid for the device and
+// each of its peers. The caller must hold device.peers.
+func (device *Device) checkProtocolTimersLocked(t ProtocolTimers) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	for _, peer := range device.peers.keyMap {
+		if err := t.withPeer(peer.timerOverrides.Load()).Validate(); err != nil {
+			return fmt.Errorf("%v: %w", peer, err)
+		}
+	}
+	return nil
+}
+
+// ProtocolTimers returns the protocol timers of the device.
+func (device *Device) ProtocolTimers() ProtocolTimers {
+	return *device.timers()
+}
+
+func (device *Device) timers() *ProtocolTimers {
+	return device.protocolTimers.Load()
+}
+
+// SetTimers overrides protocol timers of the device for the peer.
+func (peer *Peer) SetTimers(t PeerTimers) error {
+	if err := peer.device.timers().withPeer(&t).Validate(); err != nil {
+		return err
+	}
+	if t == (PeerTimers{}) {
+		peer.timerOverrides.Store(nil)
+	} else {
+		peer.timerOverrides.Store(&t)
+	}
+	return nil
+}
+
+// Timers returns the protocol timers overridden for the peer.
+func (peer *Peer) Timers() PeerTimers {
+	if t := peer.timerOverrides.Load(); t != nil {
+		return *t
+	}
+	return PeerTimers{}
+}
+
+// protocolTimers returns the protocol timers that apply to the peer.
+func (peer *Peer) protocolTimers() ProtocolTimers {
+	return peer.device.timers().withPeer(peer.timerOverrides.Load())
+}
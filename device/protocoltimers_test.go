@@ -0,0 +1,111 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProtocolTimersValidate(t *testing.T) {
+	if err := DefaultProtocolTimers().Validate(); err != nil {
+		t.Fatalf("default timers rejected: %v", err)
+	}
+
+	mobile := DefaultProtocolTimers()
+	mobile.RekeyAfterTime = time.Hour
+	mobile.RejectAfterTime = time.Hour + 2*time.Minute
+	mobile.KeepaliveTimeout = time.Minute
+	if err := mobile.Validate(); err != nil {
+		t.Errorf("long rekey interval rejected: %v", err)
+	}
+
+	for name, change := range map[string]func(*ProtocolTimers){
+		"short rekey after time": func(t *ProtocolTimers) { t.RekeyAfterTime = MinRekeyAfterTime - 1 },
+		"long rekey after time":  func(t *ProtocolTimers) { t.RekeyAfterTime = MaxRekeyAfterTime + 1 },
+		"short reject after time": func(t *ProtocolTimers) {
+			t.RejectAfterTime = t.RekeyAfterTime + t.KeepaliveTimeout + t.RekeyTimeout - 1
+		},
+		"long reject after time":   func(t *ProtocolTimers) { t.RejectAfterTime = MaxRejectAfterTime + 1 },
+		"short rekey timeout":      func(t *ProtocolTimers) { t.RekeyTimeout = MinRekeyTimeout - 1 },
+		"long rekey timeout":       func(t *ProtocolTimers) { t.RekeyTimeout = MaxRekeyTimeout + 1 },
+		"short rekey attempt time": func(t *ProtocolTimers) { t.RekeyAttemptTime = t.RekeyTimeout - 1 },
+		"long rekey attempt time":  func(t *ProtocolTimers) { t.RekeyAttemptTime = MaxRekeyAttemptTime + 1 },
+		"short keepalive timeout":  func(t *ProtocolTimers) { t.KeepaliveTimeout = MinKeepaliveTimeout - 1 },
+		"long keepalive timeout":   func(t *ProtocolTimers) { t.KeepaliveTimeout = MaxKeepaliveTimeout + 1 },
+		"zero":                     func(t *ProtocolTimers) { *t = ProtocolTimers{} },
+	} {
+		timers := DefaultProtocolTimers()
+		change(&timers)
+		if err := timers.Validate(); err == nil {
+			t.Errorf("%s: %+v accepted", name, timers)
+		}
+	}
+}
+
+func TestProtocolTimersUAPI(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	peerKey := hex.EncodeToString(pk[:])
+
+	// Keys of a section apply together, so rekey_after_time may come before
+	// the reject_after_time it needs.
+	err = device.IpcSet(uapiCfg(
+		"rekey_after_time", "600",
+		"reject_after_time", "700",
+		"keepalive_timeout", "25",
+		"public_key", peerKey,
+		"rekey_timeout", "15",
+		"rekey_attempt_time", "60",
+	))
+	assertNil(t, err)
+
+	peer := device.LookupPeer(pk)
+	if got := peer.protocolTimers(); got.RekeyAfterTime != 600*time.Second || got.RekeyTimeout != 15*time.Second ||
+		got.KeepaliveTimeout != 25*time.Second || got.maxHandshakes() != 4 {
+		t.Errorf("peer timers = %+v", got)
+	}
+
+	cfg, err := device.IpcGet()
+	assertNil(t, err)
+	for _, line := range []string{
+		"rekey_after_time=600\n",
+		"reject_after_time=700\n",
+		"keepalive_timeout=25\n",
+		"rekey_timeout=15\n",
+		"rekey_attempt_time=60\n",
+	} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("IpcGet output lacks %q:\n%s", line, cfg)
+		}
+	}
+
+	// Invalid settings are rejected and leave the timers unchanged.
+	if err := device.IpcSet(uapiCfg("public_key", peerKey, "rekey_attempt_time", "10")); err == nil {
+		t.Error("rekey attempt time below rekey timeout accepted")
+	}
+	if err := device.IpcSet(uapiCfg("reject_after_time", "610")); err == nil {
+		t.Error("device timers inconsistent with peer overrides accepted")
+	}
+	if err := device.IpcSet(uapiCfg("rekey_timeout", "0")); err == nil {
+		t.Error("zero rekey timeout accepted")
+	}
+	if got := peer.protocolTimers(); got.RejectAfterTime != 700*time.Second || got.RekeyAttemptTime != 60*time.Second {
+		t.Errorf("timers changed by rejected settings: %+v", got)
+	}
+
+	// Zero overrides fall back to the device.
+	assertNil(t, peer.SetTimers(PeerTimers{}))
+	if got := peer.protocolTimers(); got != device.ProtocolTimers() {
+		t.Errorf("peer timers = %+v, want device timers %+v", got, device.ProtocolTimers())
+	}
+}
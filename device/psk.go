@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+// A PresharedKeyProvider supplies the preshared keys mixed into handshakes,
+// typically post-quantum secrets negotiated out of band and rotated periodically.
+//
+// PresharedKey is consulted once per handshake: by the initiator when it creates
+// the initiation, and by the responder when it consumes the initiation.
+// Both sides must return the same key for the handshake to complete.
+// Each key is tagged with an epoch, which is recorded in the resulting keypair
+// so that callers can tell which key protects a session.
+//
+// PresharedKey is called from handshake workers and must not block
+// or call back into the Device.
+type PresharedKeyProvider interface {
+	// PresharedKey returns the current key for the peer with public key pk.
+	// If ok is false, the peer's static preshared key is used, with epoch 0.
+	PresharedKey(pk NoisePublicKey) (psk NoisePresharedKey, epoch uint64, ok bool)
+}
+
+type presharedKeyProviderHolder struct {
+	PresharedKeyProvider
+}
+
+// SetPresharedKeyProvider installs provider for all peers of the device.
+// A nil provider restores the static preshared keys.
+// Handshakes already in progress keep the key they started with.
+func (device *Device) SetPresharedKeyProvider(provider PresharedKeyProvider) {
+	if provider == nil {
+		device.pskProvider.Store(nil)
+		return
+	}
+	device.pskProvider.Store(&presharedKeyProviderHolder{provider})
+}
+
+// presharedKey returns the key for the next handshake with peer and its epoch.
+// It must not be called with the peer's handshake mutex held.
+func (device *Device) presharedKey(peer *Peer) (psk NoisePresharedKey, epoch uint64) {
+	if holder := device.pskProvider.Load(); holder != nil {
+		if psk, epoch, ok := holder.PresharedKey(peer.handshake.remoteStatic); ok {
+			return psk, epoch
+		}
+	}
+	peer.handshake.mutex.RLock()
+	psk = peer.handshake.presharedKey
+	peer.handshake.mutex.RUnlock()
+	return psk, 0
+}
+
+// PresharedKeyEpoch returns the epoch of the preshared key
+// that protects the current session with the peer.
+func (peer *Peer) PresharedKeyEpoch() uint64 {
+	keypair := peer.keypairs.Current()
+	if keypair == nil {
+		return 0
+	}
+	return keypair.pskEpoch
+}
@@ -0,0 +1,130 @@
+//go:build go1.24
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/mlkem"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mlkemPSKProvider is a reference PresharedKeyProvider in the style of Rosenpass:
+// peers run an ML-KEM-768 exchange out of band and use the shared secret
+// as the preshared key of the next epoch.
+type mlkemPSKProvider struct {
+	mu   sync.Mutex
+	keys map[NoisePublicKey]mlkemPSK
+}
+
+type mlkemPSK struct {
+	psk   NoisePresharedKey
+	epoch uint64
+}
+
+func (p *mlkemPSKProvider) PresharedKey(pk NoisePublicKey) (NoisePresharedKey, uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[pk]
+	return key.psk, key.epoch, ok
+}
+
+func (p *mlkemPSKProvider) install(pk NoisePublicKey, secret []byte) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys == nil {
+		p.keys = make(map[NoisePublicKey]mlkemPSK)
+	}
+	key := mlkemPSK{epoch: p.keys[pk].epoch + 1}
+	copy(key.psk[:], secret)
+	p.keys[pk] = key
+	return key.epoch
+}
+
+// rotateMLKEM runs an ML-KEM exchange between the providers of two devices over
+// a loopback connection. initiator knows the other side as peer pkR, and responder
+// knows it as peer pkI.
+func rotateMLKEM(t *testing.T, initiator, responder *mlkemPSKProvider, pkR, pkI NoisePublicKey) {
+	t.Helper()
+	connI, connR := net.Pipe()
+	defer connI.Close()
+	defer connR.Close()
+
+	errc := make(chan error, 1)
+	epochR := make(chan uint64, 1)
+	go func() {
+		encapsulationKey := make([]byte, mlkem.EncapsulationKeySize768)
+		if _, err := io.ReadFull(connR, encapsulationKey); err != nil {
+			errc <- err
+			return
+		}
+		ek, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+		if err != nil {
+			errc <- err
+			return
+		}
+		secret, ciphertext := ek.Encapsulate()
+		epochR <- responder.install(pkI, secret)
+		_, err = connR.Write(ciphertext)
+		errc <- err
+	}()
+
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connI.Write(dk.EncapsulationKey().Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := make([]byte, mlkem.CiphertextSize768)
+	if _, err := io.ReadFull(connI, ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	secret, err := dk.Decapsulate(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epoch := initiator.install(pkR, secret); epoch != <-epochR {
+		t.Fatalf("providers disagree on epoch")
+	}
+}
+
+func TestPresharedKeyProvider(t *testing.T) {
+	pair := genTestPair(t, true)
+	var providers [2]mlkemPSKProvider
+	var keys [2]NoisePublicKey
+	for i := range pair {
+		pair[i].dev.staticIdentity.RLock()
+		keys[i] = pair[i].dev.staticIdentity.publicKey
+		pair[i].dev.staticIdentity.RUnlock()
+		pair[i].dev.SetPresharedKeyProvider(&providers[i])
+	}
+	peers := [2]*Peer{pair[0].dev.LookupPeer(keys[1]), pair[1].dev.LookupPeer(keys[0])}
+
+	for epoch := uint64(1); epoch <= 2; epoch++ {
+		rotateMLKEM(t, &providers[0], &providers[1], keys[1], keys[0])
+		// Force a new handshake. Initiations sent within the 16ms granularity
+		// of handshake timestamps would be rejected as replays.
+		time.Sleep(20 * time.Millisecond)
+		for _, peer := range peers {
+			peer.ExpireCurrentKeypairs()
+		}
+		pair.Send(t, Ping, nil)
+		pair.Send(t, Pong, nil)
+		for i, peer := range peers {
+			if got := peer.PresharedKeyEpoch(); got != epoch {
+				t.Errorf("device %d: session uses preshared key epoch %d, want %d", i, got, epoch)
+			}
+		}
+	}
+}
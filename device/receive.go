@@ -55,7 +55,8 @@ func (peer *Peer) keepKeyFreshReceiving() {
 		return
 	}
 	keypair := peer.keypairs.Current()
-	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
+	t := peer.protocolTimers()
+	if keypair != nil && keypair.isInitiator && peer.device.now().Sub(keypair.created) > (t.RejectAfterTime-t.KeepaliveTimeout-t.RekeyTimeout) {
 		peer.timers.sentLastMinuteHandshake.Store(true)
 		peer.SendHandshakeInitiation(false)
 	}
@@ -110,6 +111,10 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 		}
 		deathSpiral = 0
 
+		if c := device.capture.Load(); c != nil {
+			c.bindPacket(buffer[:size], endpoint, true)
+		}
+
 		if size < MinMessageSize {
 			continue
 		}
@@ -117,6 +122,11 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 		// check size of packet
 
 		packet := buffer[:size]
+		if o := device.obfuscation.Load(); o != nil {
+			if packet = o.unwrap(packet); packet == nil {
+				continue
+			}
+		}
 		msgType := binary.LittleEndian.Uint32(packet[:4])
 
 		var okay bool
@@ -146,7 +156,7 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 
 			// check keypair expiry
 
-			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+			if keypair.created.Add(device.timers().RejectAfterTime).Before(device.now()) {
 				continue
 			}
 
@@ -179,6 +189,12 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 		case MessageResponseType:
 			okay = len(packet) == MessageResponseSize
 
+		case MessageHybridInitiationType:
+			okay = len(packet) == MessageHybridInitiationSize
+
+		case MessageHybridResponseType:
+			okay = len(packet) == MessageHybridResponseSize
+
 		case MessageCookieReplyType:
 			okay = len(packet) == MessageCookieReplySize
 
@@ -241,6 +257,9 @@ func (device *Device) RoutineHandshake(id int) {
 
 	for elem := range device.queue.handshake.c {
 
+		// the retired static key an initiation is addressed to, if any
+		var retired *retiredIdentity
+
 		// handle cookie fields and ratelimiting
 
 		switch elem.msgType {
@@ -276,12 +295,14 @@ func (device *Device) RoutineHandshake(id int) {
 
 			goto skip
 
-		case MessageInitiationType, MessageResponseType:
+		case MessageInitiationType, MessageResponseType, MessageHybridInitiationType, MessageHybridResponseType:
 
 			// check mac fields and maybe ratelimit
 
-			if !device.cookieChecker.CheckMAC1(elem.packet) {
-				device.log.Verbosef("Received packet with invalid mac1")
+			var cookieChecker *CookieChecker
+			cookieChecker, retired = device.cookieCheckerFor(elem.packet)
+			if cookieChecker == nil {
+				device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Received packet with invalid mac1", conn.EndpointField(elem.endpoint))
 				goto skip
 			}
 
@@ -291,7 +312,7 @@ func (device *Device) RoutineHandshake(id int) {
 
 				// verify MAC2 field
 
-				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+				if !cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
 					device.SendHandshakeCookie(&elem)
 					goto skip
 				}
@@ -311,23 +332,44 @@ func (device *Device) RoutineHandshake(id int) {
 		// handle handshake initiation/response content
 
 		switch elem.msgType {
-		case MessageInitiationType:
+		case MessageInitiationType, MessageHybridInitiationType:
 
-			// unmarshal
+			// unmarshal and consume initiation
 
-			var msg MessageInitiation
+			var consume func(unknown *NoisePublicKey) *Peer
 			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
-			if err != nil {
-				device.log.Errorf("Failed to decode initiation message")
-				goto skip
+			if elem.msgType == MessageHybridInitiationType {
+				var msg MessageHybridInitiation
+				if err := binary.Read(reader, binary.LittleEndian, &msg); err != nil {
+					device.log.Errorf("Failed to decode initiation message")
+					goto skip
+				}
+				consume = func(unknown *NoisePublicKey) *Peer {
+					return device.consumeMessageHybridInitiation(&msg, unknown, retired)
+				}
+			} else {
+				var msg MessageInitiation
+				if err := binary.Read(reader, binary.LittleEndian, &msg); err != nil {
+					device.log.Errorf("Failed to decode initiation message")
+					goto skip
+				}
+				if msg.Type != MessageInitiationType {
+					goto skip
+				}
+				consume = func(unknown *NoisePublicKey) *Peer {
+					return device.consumeMessageInitiation(&msg, nil, unknown, retired)
+				}
 			}
 
-			// consume initiation
+			// provision unknown senders through the peer resolver
 
-			peer := device.ConsumeMessageInitiation(&msg)
+			var unknown NoisePublicKey
+			peer := consume(&unknown)
+			if peer == nil && !unknown.IsZero() && device.provisionPeer(unknown) {
+				peer = consume(nil)
+			}
 			if peer == nil {
-				device.log.Verbosef("Received invalid initiation message from %s", elem.endpoint.DstToString())
+				device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Received invalid initiation message", conn.EndpointField(elem.endpoint))
 				goto skip
 			}
 
@@ -339,37 +381,43 @@ func (device *Device) RoutineHandshake(id int) {
 			// update endpoint
 			peer.SetEndpointFromPacket(elem.endpoint)
 
-			device.UpdateHandshakeState(HandshakeSuccess)
-			device.log.Verbosef("%v - Received handshake initiation", peer)
+			peer.notifyHandshake(HandshakeSuccess, "", nil)
+			device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Received handshake initiation", conn.PeerField(peer), conn.EndpointField(elem.endpoint))
 			peer.rxBytes.Add(uint64(len(elem.packet)))
 
 			peer.SendHandshakeResponse()
 
-		case MessageResponseType:
+		case MessageResponseType, MessageHybridResponseType:
 
-			// unmarshal
+			// unmarshal and consume response
 
-			var msg MessageResponse
+			var peer *Peer
 			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
-			if err != nil {
-				device.log.Errorf("Failed to decode response message")
-				goto skip
+			if elem.msgType == MessageHybridResponseType {
+				var msg MessageHybridResponse
+				if err := binary.Read(reader, binary.LittleEndian, &msg); err != nil {
+					device.log.Errorf("Failed to decode response message")
+					goto skip
+				}
+				peer = device.ConsumeMessageHybridResponse(&msg)
+			} else {
+				var msg MessageResponse
+				if err := binary.Read(reader, binary.LittleEndian, &msg); err != nil {
+					device.log.Errorf("Failed to decode response message")
+					goto skip
+				}
+				peer = device.ConsumeMessageResponse(&msg)
 			}
-
-			// consume response
-
-			peer := device.ConsumeMessageResponse(&msg)
 			if peer == nil {
-				device.log.Verbosef("Received invalid response message from %s", elem.endpoint.DstToString())
+				device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Received invalid response message", conn.EndpointField(elem.endpoint))
 				goto skip
 			}
 
 			// update endpoint
 			peer.SetEndpointFromPacket(elem.endpoint)
 
-			device.UpdateHandshakeState(HandshakeSuccess)
-			device.log.Verbosef("%v - Received handshake response", peer)
+			peer.notifyHandshake(HandshakeSuccess, "", nil)
+			device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Received handshake response", conn.PeerField(peer), conn.EndpointField(elem.endpoint))
 			peer.rxBytes.Add(uint64(len(elem.packet)))
 
 			// update timers
@@ -379,10 +427,10 @@ func (device *Device) RoutineHandshake(id int) {
 
 			// derive keypair
 
-			err = peer.BeginSymmetricSession()
+			err := peer.BeginSymmetricSession()
 
 			if err != nil {
-				device.log.Errorf("%v - Failed to derive keypair: %v", peer, err)
+				device.log.Log(conn.SubsystemHandshake, conn.LevelError, "Failed to derive keypair", conn.PeerField(peer), conn.ErrorField(err))
 				goto skip
 			}
 
@@ -474,6 +522,9 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			goto skip
 		}
 
+		if c := device.capture.Load(); c != nil {
+			c.tunPacket(elem.packet, true)
+		}
 		_, err = device.tun.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent)
 		if err != nil && !device.isClosed() {
 			device.log.Errorf("Failed to write packet to TUN device: %v", err)
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"golang.zx2c4.com/wireguard/replay"
+)
+
+/* Replay window
+ *
+ * The anti-replay filter of a keypair accepts messages up to a window of
+ * counters behind the highest one received. Links that reorder heavily,
+ * such as multipath transports, may need a window larger than
+ * replay.DefaultWindowSize, which can be set per device and per peer.
+ * Changes apply to the keypairs of the next handshakes.
+ */
+
+// SetReplayWindowSize sets the minimum anti-replay window of the peers of
+// the device, in messages. Zero selects replay.DefaultWindowSize.
+func (device *Device) SetReplayWindowSize(size uint64) {
+	device.replayWindow.Store(clampReplayWindow(size))
+}
+
+// ReplayWindowSize returns the anti-replay window set for the device,
+// or zero for the default.
+func (device *Device) ReplayWindowSize() uint64 {
+	return device.replayWindow.Load()
+}
+
+// SetReplayWindowSize sets the minimum anti-replay window of the peer,
+// in messages. Zero uses the window of the device.
+func (peer *Peer) SetReplayWindowSize(size uint64) {
+	peer.replayWindow.Store(clampReplayWindow(size))
+}
+
+// ReplayWindowSize returns the anti-replay window set for the peer,
+// or zero if it uses the window of the device.
+func (peer *Peer) ReplayWindowSize() uint64 {
+	return peer.replayWindow.Load()
+}
+
+// replayWindowSize returns the anti-replay window for new keypairs of the peer.
+func (peer *Peer) replayWindowSize() uint64 {
+	if size := peer.replayWindow.Load(); size != 0 {
+		return size
+	}
+	return peer.device.replayWindow.Load()
+}
+
+func clampReplayWindow(size uint64) uint64 {
+	if size > replay.MaxWindowSize {
+		return replay.MaxWindowSize
+	}
+	return size
+}
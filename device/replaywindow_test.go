@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/replay"
+)
+
+func TestReplayWindowSize(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev0, dev1 := pair[0].dev, pair[1].dev
+
+	assertNil(t, dev0.IpcSet(uapiCfg("replay_window", "100000")))
+	dev1.staticIdentity.RLock()
+	pk1 := dev1.staticIdentity.publicKey
+	dev1.staticIdentity.RUnlock()
+	peer := dev0.LookupPeer(pk1)
+	pair.Send(t, Ping, nil)
+
+	keypair := peer.keypairs.Current()
+	if got := keypair.replayFilter.WindowSize(); got < 100000 {
+		t.Errorf("replay window = %d, want at least 100000", got)
+	}
+
+	// A window set for the peer takes precedence.
+	peer.SetReplayWindowSize(replay.MaxWindowSize + 1)
+	if got := peer.replayWindowSize(); got != replay.MaxWindowSize {
+		t.Errorf("peer replay window = %d, want %d", got, replay.MaxWindowSize)
+	}
+
+	cfg, err := dev0.IpcGet()
+	assertNil(t, err)
+	for _, line := range []string{
+		"replay_window=100000\n",
+		"replay_window=4194240\n",
+	} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("IpcGet output lacks %q:\n%s", line, cfg)
+		}
+	}
+}
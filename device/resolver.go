@@ -0,0 +1,239 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+/* Peer resolver
+ *
+ * Instead of knowing all of its peers in advance, a device may look up the
+ * senders of handshake initiations it does not know with a PeerResolver,
+ * for instance in a database, and add them as peers on the fly.
+ *
+ * The resolver is only asked about senders that proved ownership of their
+ * static key, is rate limited, and its answers are cached for a while,
+ * including the unknown keys.
+ */
+
+// A PeerResolver returns the configuration of the peer with public key pk,
+// or nil if pk is not a peer. It is called from the handshake workers of
+// the device, so it should be reasonably fast, and must not block on the device.
+type PeerResolver func(pk NoisePublicKey) (*ResolvedPeer, error)
+
+// A ResolvedPeer is the configuration of a peer returned by a PeerResolver.
+type ResolvedPeer struct {
+	AllowedIPs                  []netip.Prefix
+	PresharedKey                NoisePresharedKey
+	PersistentKeepaliveInterval uint16 // in seconds, zero to disable
+	HybridHandshake             bool
+	IdleTimeout                 time.Duration // removes the peer once idle, zero to keep it
+}
+
+// PeerResolverOptions configure the rate limit and cache of a PeerResolver.
+// Zero values select the defaults.
+type PeerResolverOptions struct {
+	Rate      int           // calls to the resolver per second
+	Burst     int           // calls to the resolver in a burst
+	CacheSize int           // number of cached answers
+	CacheTTL  time.Duration // how long answers are cached
+}
+
+const (
+	DefaultResolverRate      = 100
+	DefaultResolverCacheSize = 4096
+	DefaultResolverCacheTTL  = time.Minute
+)
+
+type peerResolver struct {
+	resolve PeerResolver
+	options PeerResolverOptions
+
+	sync.Mutex
+	tokens  float64
+	refill  time.Time
+	entries map[NoisePublicKey]*list.Element
+	lru     list.List // of *resolverEntry, most recently used first
+}
+
+type resolverEntry struct {
+	pk      NoisePublicKey
+	peer    *ResolvedPeer // nil for unknown keys
+	expires time.Time
+}
+
+// SetPeerResolver sets the resolver of unknown initiators,
+// or removes it if resolve is nil.
+func (device *Device) SetPeerResolver(resolve PeerResolver, options PeerResolverOptions) {
+	if resolve == nil {
+		device.peerResolver.Store(nil)
+		return
+	}
+	if options.Rate <= 0 {
+		options.Rate = DefaultResolverRate
+	}
+	if options.Burst <= 0 {
+		options.Burst = options.Rate
+	}
+	if options.CacheSize <= 0 {
+		options.CacheSize = DefaultResolverCacheSize
+	}
+	if options.CacheTTL <= 0 {
+		options.CacheTTL = DefaultResolverCacheTTL
+	}
+	device.peerResolver.Store(&peerResolver{
+		resolve: resolve,
+		options: options,
+		tokens:  float64(options.Burst),
+		refill:  device.now(),
+		entries: make(map[NoisePublicKey]*list.Element),
+	})
+}
+
+// lookup returns the cached answer for pk.
+func (r *peerResolver) lookup(pk NoisePublicKey, now time.Time) (peer *ResolvedPeer, ok bool) {
+	r.Lock()
+	defer r.Unlock()
+	elem, ok := r.entries[pk]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*resolverEntry)
+	if !now.Before(entry.expires) {
+		r.lru.Remove(elem)
+		delete(r.entries, pk)
+		return nil, false
+	}
+	r.lru.MoveToFront(elem)
+	return entry.peer, true
+}
+
+// allow takes a token from the bucket, if there is one.
+func (r *peerResolver) allow(now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+	r.tokens += now.Sub(r.refill).Seconds() * float64(r.options.Rate)
+	r.refill = now
+	if r.tokens > float64(r.options.Burst) {
+		r.tokens = float64(r.options.Burst)
+	}
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+func (r *peerResolver) store(pk NoisePublicKey, peer *ResolvedPeer, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	entry := &resolverEntry{pk: pk, peer: peer, expires: now.Add(r.options.CacheTTL)}
+	if elem, ok := r.entries[pk]; ok {
+		elem.Value = entry
+		r.lru.MoveToFront(elem)
+		return
+	}
+	r.entries[pk] = r.lru.PushFront(entry)
+	if r.lru.Len() > r.options.CacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*resolverEntry).pk)
+	}
+}
+
+// authenticateInitiation reports whether the sender of an initiation owns pk,
+// by decrypting its timestamp with the static-static shared secret.
+// chainKey and hash are the handshake state after the static key.
+// The caller must hold device.staticIdentity for reading.
+func (device *Device) authenticateInitiation(msg *MessageInitiation, id StaticIdentity, pk NoisePublicKey, chainKey, hash *[blake2s.Size]byte) bool {
+	if device.peerResolver.Load() == nil {
+		return false
+	}
+	ss, err := sharedSecret(id, pk)
+	if err != nil {
+		return false
+	}
+	var ck [blake2s.Size]byte
+	var key [chacha20poly1305.KeySize]byte
+	KDF2(&ck, &key, chainKey[:], ss[:])
+	setZero(ss[:])
+	setZero(ck[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	var timestamp tai64n.Timestamp
+	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
+	return err == nil
+}
+
+// provisionPeer adds the peer with public key pk from the peer resolver,
+// and reports whether pk is now a peer.
+func (device *Device) provisionPeer(pk NoisePublicKey) bool {
+	r := device.peerResolver.Load()
+	if r == nil {
+		return false
+	}
+	now := device.now()
+	resolved, ok := r.lookup(pk, now)
+	if !ok {
+		if !r.allow(now) {
+			device.log.Log(conn.SubsystemPeer, conn.LevelDebug, "Peer resolver rate limit exceeded")
+			return false
+		}
+		var err error
+		resolved, err = r.resolve(pk)
+		if err != nil {
+			device.log.Log(conn.SubsystemPeer, conn.LevelError, "Failed to resolve peer", conn.ErrorField(err))
+			return false
+		}
+		r.store(pk, resolved, now)
+	}
+	if resolved == nil {
+		return false
+	}
+
+	// The peer is configured before it can be looked up, so that no handshake
+	// sees it without its preshared key, and with ipcMutex held, as a set
+	// operation configures peers.
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+	peer, err := device.newPeer(pk, func(peer *Peer) {
+		peer.handshake.mutex.Lock()
+		peer.handshake.presharedKey = resolved.PresharedKey
+		peer.handshake.mutex.Unlock()
+		for _, prefix := range resolved.AllowedIPs {
+			device.allowedips.Insert(prefix, peer)
+		}
+		peer.persistentKeepaliveInterval.Store(uint32(resolved.PersistentKeepaliveInterval))
+		if resolved.HybridHandshake {
+			if err := peer.SetHybridHandshake(true); err != nil {
+				device.log.Log(conn.SubsystemPeer, conn.LevelError, "Failed to enable hybrid handshake", conn.PeerField(peer), conn.ErrorField(err))
+			}
+		}
+		if resolved.IdleTimeout > 0 {
+			peer.expiry.idleTimeout.Store(int64(resolved.IdleTimeout))
+			peer.expiry.lastActivity.Store(device.now().UnixNano())
+			device.peers.expiring[peer] = struct{}{}
+		}
+	})
+	if err != nil {
+		// Another handshake worker may have added it in the meantime.
+		return device.LookupPeer(pk) != nil
+	}
+	device.log.Log(conn.SubsystemPeer, conn.LevelInfo, "Provisioned by peer resolver", conn.PeerField(peer))
+	if device.isUp() {
+		peer.Start()
+	}
+	return true
+}
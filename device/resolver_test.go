@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerResolverProvisioning(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev0, dev1 := pair[0].dev, pair[1].dev
+
+	dev1.staticIdentity.RLock()
+	pk1 := dev1.staticIdentity.publicKey
+	dev1.staticIdentity.RUnlock()
+
+	// dev0 forgets dev1 and learns about it from the resolver instead.
+	dev0.RemovePeer(pk1)
+	var calls atomic.Int32
+	dev0.SetPeerResolver(func(pk NoisePublicKey) (*ResolvedPeer, error) {
+		calls.Add(1)
+		if pk != pk1 {
+			return nil, nil
+		}
+		return &ResolvedPeer{
+			AllowedIPs:                  []netip.Prefix{netip.MustParsePrefix("1.0.0.2/32")},
+			PersistentKeepaliveInterval: 25,
+		}, nil
+	}, PeerResolverOptions{})
+
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	peer := dev0.LookupPeer(pk1)
+	if peer == nil {
+		t.Fatal("peer not provisioned")
+	}
+	if got := peer.persistentKeepaliveInterval.Load(); got != 25 {
+		t.Errorf("persistent keepalive interval = %d, want 25", got)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("resolver called %d times, want 1", got)
+	}
+
+	// The answer is cached once the peer is gone.
+	dev0.RemovePeer(pk1)
+	if !dev0.provisionPeer(pk1) {
+		t.Fatal("cached peer not provisioned")
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("resolver called %d times, want 1", got)
+	}
+}
+
+func TestPeerResolverProvisionedConfig(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	psk := NoisePresharedKey{1, 2, 3}
+	device.SetPeerResolver(func(NoisePublicKey) (*ResolvedPeer, error) {
+		return &ResolvedPeer{
+			PresharedKey: psk,
+			AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("10.9.0.0/16")},
+			IdleTimeout:  time.Hour,
+		}, nil
+	}, PeerResolverOptions{})
+
+	// A set operation in progress holds back the provisioning.
+	device.ipcMutex.Lock()
+	done := make(chan bool)
+	go func() { done <- device.provisionPeer(pk) }()
+	time.Sleep(10 * time.Millisecond)
+	if device.LookupPeer(pk) != nil {
+		t.Error("peer provisioned during a set operation")
+	}
+	device.ipcMutex.Unlock()
+	if !<-done {
+		t.Fatal("peer not provisioned")
+	}
+
+	peer := device.LookupPeer(pk)
+	peer.handshake.mutex.RLock()
+	got := peer.handshake.presharedKey
+	peer.handshake.mutex.RUnlock()
+	if got != psk {
+		t.Error("preshared key not set")
+	}
+	if device.allowedips.Lookup(netip.MustParseAddr("10.9.1.1").AsSlice()) != peer {
+		t.Error("allowed IPs not set")
+	}
+	device.peers.RLock()
+	_, expiring := device.peers.expiring[peer]
+	device.peers.RUnlock()
+	if !expiring {
+		t.Error("peer with idle timeout not checked for expiry")
+	}
+}
+
+func TestPeerResolverCache(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	epoch := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	device.clock = fixedClock(epoch)
+
+	var calls atomic.Int32
+	device.SetPeerResolver(func(pk NoisePublicKey) (*ResolvedPeer, error) {
+		calls.Add(1)
+		return nil, nil
+	}, PeerResolverOptions{Rate: 1, Burst: 2, CacheSize: 2, CacheTTL: time.Minute})
+
+	var keys [3]NoisePublicKey
+	for i := range keys {
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		keys[i] = sk.publicKey()
+	}
+
+	// Unknown keys are cached too.
+	for i := 0; i < 2; i++ {
+		if device.provisionPeer(keys[0]) {
+			t.Fatal("unknown key provisioned")
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("resolver called %d times, want 1", got)
+	}
+
+	// The burst is used up by the second key.
+	device.provisionPeer(keys[1])
+	device.provisionPeer(keys[2])
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("resolver called %d times past its rate limit, want 2", got)
+	}
+
+	// The bucket refills with time, and the cache keeps the most recent keys.
+	device.clock = fixedClock(epoch.Add(time.Second))
+	device.provisionPeer(keys[2])
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("resolver called %d times, want 3", got)
+	}
+	r := device.peerResolver.Load()
+	if _, ok := r.lookup(keys[0], device.now()); ok {
+		t.Error("least recently used key still cached")
+	}
+	if _, ok := r.lookup(keys[2], device.now()); !ok {
+		t.Error("most recently used key not cached")
+	}
+	if _, ok := r.lookup(keys[2], epoch.Add(2*time.Minute)); ok {
+		t.Error("expired answer still cached")
+	}
+}
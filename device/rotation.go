@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+// DefaultKeyRotationGrace is the grace period used by the rotate_private_key
+// UAPI key unless key_rotation_grace is set. Peers that keep using the old
+// public key for longer lose connectivity once it expires.
+const DefaultKeyRotationGrace = RejectAfterTime
+
+// A retiredIdentity is a static identity replaced by RotatePrivateKey
+// that is still accepted for handshake initiations until it expires.
+type retiredIdentity struct {
+	identity      StaticIdentity
+	publicKey     NoisePublicKey
+	expires       time.Time
+	cookieChecker CookieChecker
+	timer         *time.Timer
+}
+
+// RotatePrivateKey replaces the static private key of the device like SetPrivateKey,
+// but keeps answering handshake initiations addressed to the old public key for the
+// duration of grace, and leaves established sessions in place.
+// Peers can thus be moved to the new public key without an outage.
+// Rotating again during the grace period retires the intermediate key and
+// forgets the one before it. A grace of zero is equivalent to SetPrivateKey.
+func (device *Device) RotatePrivateKey(sk NoisePrivateKey, grace time.Duration) error {
+	device.staticIdentity.RLock()
+	unchanged := sk.Equals(device.staticIdentity.privateKey) && sk.IsZero() == (device.staticIdentity.identity == nil)
+	device.staticIdentity.RUnlock()
+	if unchanged {
+		return nil
+	}
+	return device.RotateStaticIdentity(newMemoryIdentity(sk), grace)
+}
+
+// RotateStaticIdentity is like RotatePrivateKey for a StaticIdentity.
+func (device *Device) RotateStaticIdentity(id StaticIdentity, grace time.Duration) error {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+
+	if id == device.staticIdentity.identity {
+		return nil
+	}
+
+	device.dropRetiredKeyLocked()
+	old := device.staticIdentity.identity
+	if grace <= 0 || old == nil {
+		device.setIdentityLocked(id, true)
+		clearIdentity(old)
+		return nil
+	}
+
+	retired := &retiredIdentity{
+		identity:  old,
+		publicKey: device.staticIdentity.publicKey,
+		expires:   device.now().Add(grace),
+	}
+	retired.cookieChecker.Init(retired.publicKey)
+	retired.timer = time.AfterFunc(grace, func() {
+		device.staticIdentity.Lock()
+		defer device.staticIdentity.Unlock()
+		if device.staticIdentity.previous.Load() == retired {
+			device.dropRetiredKeyLocked()
+		}
+	})
+	device.staticIdentity.previous.Store(retired)
+
+	device.setIdentityLocked(id, false)
+	return nil
+}
+
+// RetiredPublicKey returns the public key replaced by the last RotatePrivateKey
+// and when it stops being accepted, if it is still within its grace period.
+func (device *Device) RetiredPublicKey() (pk NoisePublicKey, expires time.Time, ok bool) {
+	retired := device.retiredKey()
+	if retired == nil {
+		return pk, expires, false
+	}
+	return retired.publicKey, retired.expires, true
+}
+
+// retiredKey returns the retired static key pair, or nil if there is none
+// or its grace period is over.
+func (device *Device) retiredKey() *retiredIdentity {
+	retired := device.staticIdentity.previous.Load()
+	if retired == nil || !device.now().Before(retired.expires) {
+		return nil
+	}
+	return retired
+}
+
+// dropRetiredKeyLocked forgets the retired static key pair.
+// The caller must hold device.staticIdentity locked for writing.
+func (device *Device) dropRetiredKeyLocked() {
+	retired := device.staticIdentity.previous.Swap(nil)
+	if retired == nil {
+		return
+	}
+	retired.timer.Stop()
+	clearIdentity(retired.identity)
+}
+
+// cookieCheckerFor returns the cookie checker for the static key that the
+// handshake message msg is addressed to, or nil if its mac1 is not valid
+// for either the current or the retired key. For the retired key, it also
+// returns the retired identity the message is to be consumed with.
+func (device *Device) cookieCheckerFor(msg []byte) (*CookieChecker, *retiredIdentity) {
+	if device.cookieChecker.CheckMAC1(msg) {
+		return &device.cookieChecker, nil
+	}
+	if retired := device.retiredKey(); retired != nil && retired.cookieChecker.CheckMAC1(msg) {
+		return &retired.cookieChecker, retired
+	}
+	return nil, nil
+}
@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatePrivateKey(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+
+	defer dev1.Close()
+	defer dev2.Close()
+
+	epoch := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	dev2.clock = fixedClock(epoch)
+
+	oldPK := dev2.staticIdentity.publicKey
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	assertNil(t, err)
+	peer2, err := dev1.NewPeer(oldPK)
+	assertNil(t, err)
+	peer1.Start()
+	peer2.Start()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev2.RotatePrivateKey(sk, time.Minute))
+
+	if pk, expires, ok := dev2.RetiredPublicKey(); !ok || pk != oldPK || !expires.Equal(epoch.Add(time.Minute)) {
+		t.Fatalf("RetiredPublicKey() = %x, %v, %v", pk, expires, ok)
+	}
+
+	// dev1 still knows dev2 by its old public key.
+
+	initiation := func() (*MessageInitiation, []byte) {
+		msg, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, msg)
+		packet := buf.Bytes()
+		peer2.cookieGenerator.AddMacs(packet)
+		return msg, packet
+	}
+
+	msg1, packet := initiation()
+	checker, retired := dev2.cookieCheckerFor(packet)
+	if checker == nil || checker == &dev2.cookieChecker || retired == nil {
+		t.Fatal("mac1 of initiation to retired key not accepted with the retired key")
+	}
+	if dev2.ConsumeMessageInitiation(msg1) != nil {
+		t.Fatal("initiation to retired key accepted with the current key")
+	}
+	if dev2.consumeMessageInitiation(msg1, nil, nil, retired) != peer1 {
+		t.Fatal("initiation to retired key rejected during grace period")
+	}
+	msg2, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	if dev1.ConsumeMessageResponse(msg2) != peer2 {
+		t.Fatal("response to initiation to retired key rejected")
+	}
+	assertNil(t, peer1.BeginSymmetricSession())
+	assertNil(t, peer2.BeginSymmetricSession())
+
+	testMsg := []byte("wireguard rotation test message")
+	var nonce [12]byte
+	out := peer2.keypairs.current.send.Seal(nil, nonce[:], testMsg, nil)
+	out, err = peer1.keypairs.next.Load().receive.Open(out[:0], nonce[:], out, nil)
+	assertNil(t, err)
+	assertEqual(t, out, testMsg)
+
+	// After the grace period, the old key is no longer accepted.
+
+	time.Sleep(20 * time.Millisecond) // tai64n timestamps have a 16ms granularity
+	dev2.clock = fixedClock(epoch.Add(time.Minute))
+	msg1, packet = initiation()
+	if checker, _ := dev2.cookieCheckerFor(packet); checker != nil {
+		t.Fatal("mac1 of initiation to retired key accepted after grace period")
+	}
+	if dev2.consumeMessageInitiation(msg1, nil, nil, retired) != nil {
+		t.Fatal("initiation to retired key accepted after grace period")
+	}
+	if _, _, ok := dev2.RetiredPublicKey(); ok {
+		t.Fatal("retired key reported after grace period")
+	}
+}
+
+func TestRotatePrivateKeyUAPI(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	err = pair[0].dev.IpcSet(uapiCfg(
+		"key_rotation_grace", "30",
+		"rotate_private_key", hex.EncodeToString(sk[:]),
+	))
+	assertNil(t, err)
+
+	cfg, err := pair[0].dev.IpcGet()
+	assertNil(t, err)
+	for _, line := range []string{
+		"private_key=" + hex.EncodeToString(sk[:]) + "\n",
+		"key_rotation_grace=30\n",
+	} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("IpcGet output lacks %q:\n%s", line, cfg)
+		}
+	}
+	if _, expires, ok := pair[0].dev.RetiredPublicKey(); !ok || time.Until(expires) > 30*time.Second {
+		t.Errorf("RetiredPublicKey() = %v, %v", expires, ok)
+	}
+
+	// Established sessions survive the rotation.
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
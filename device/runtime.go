@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+)
+
+/* Runtime state
+ *
+ * The configuration of a device is set by its user, but some of its state
+ * is learned while running: the endpoints peers roam to, the traffic
+ * counters and the time of the last handshakes. A RuntimeState holds that
+ * state, without any secret, so that it can be saved when the process is
+ * about to be killed and imported by the next one, once the peers are
+ * configured again. It encodes to JSON with encoding/json.
+ */
+
+// A RuntimeState is the state a device learned while running.
+type RuntimeState struct {
+	Peers []PeerRuntimeState
+}
+
+// A PeerRuntimeState is the state a device learned about a peer.
+type PeerRuntimeState struct {
+	PublicKey         NoisePublicKey
+	Endpoint          string    // the last endpoint of the peer, empty if none
+	TxBytes           uint64    // bytes sent to the peer
+	RxBytes           uint64    // bytes received from the peer
+	LastHandshakeTime time.Time // zero if there was none
+}
+
+// ExportRuntimeState returns the runtime state of the peers of the device.
+func (device *Device) ExportRuntimeState() *RuntimeState {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	state := &RuntimeState{Peers: make([]PeerRuntimeState, 0, len(device.peers.keyMap))}
+	for key, peer := range device.peers.keyMap {
+		s := PeerRuntimeState{
+			PublicKey: key,
+			TxBytes:   peer.txBytes.Load(),
+			RxBytes:   peer.rxBytes.Load(),
+		}
+		if nano := peer.lastHandshakeNano.Load(); nano != 0 {
+			s.LastHandshakeTime = time.Unix(0, nano)
+		}
+		peer.RLock()
+		if peer.endpoint != nil {
+			s.Endpoint = peer.endpoint.DstToString()
+		}
+		peer.RUnlock()
+		state.Peers = append(state.Peers, s)
+	}
+	return state
+}
+
+// ImportRuntimeState restores the runtime state of the peers of the device.
+// The counters of the state are added to those of the peers, the latest
+// handshake time is kept, and the endpoint replaces the configured one,
+// unless roaming is disabled for the peer. Peers the device does not have
+// are ignored. The state of the other peers is imported even if an endpoint
+// is invalid, and the first invalid endpoint is reported.
+func (device *Device) ImportRuntimeState(state *RuntimeState) error {
+	bind := device.Bind()
+	var firstErr error
+	for _, s := range state.Peers {
+		peer := device.LookupPeer(s.PublicKey)
+		if peer == nil {
+			continue
+		}
+		peer.txBytes.Add(s.TxBytes)
+		peer.rxBytes.Add(s.RxBytes)
+		if !s.LastHandshakeTime.IsZero() {
+			nano := s.LastHandshakeTime.UnixNano()
+			for current := peer.lastHandshakeNano.Load(); current < nano; current = peer.lastHandshakeNano.Load() {
+				if peer.lastHandshakeNano.CompareAndSwap(current, nano) {
+					break
+				}
+			}
+		}
+
+		if s.Endpoint == "" {
+			continue
+		}
+		endpoint, err := bind.ParseEndpoint(s.Endpoint)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("invalid endpoint of %v: %w", peer, err)
+			}
+			continue
+		}
+		peer.Lock()
+		changed := !peer.disableRoaming && peer.setEndpointLocked(endpoint)
+		peer.Unlock()
+		if changed {
+			peer.notifyEndpointChanged(endpoint)
+		}
+	}
+	return firstErr
+}
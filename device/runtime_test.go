@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuntimeState(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	exported := pair[0].dev.ExportRuntimeState()
+	if len(exported.Peers) != 1 {
+		t.Fatalf("exported %d peers, want 1", len(exported.Peers))
+	}
+	s := exported.Peers[0]
+	if s.Endpoint == "" || s.TxBytes == 0 || s.RxBytes == 0 || s.LastHandshakeTime.IsZero() {
+		t.Fatalf("exported %+v", s)
+	}
+
+	// The state survives encoding, and holds no secret.
+	text, err := json.Marshal(exported)
+	assertNil(t, err)
+	pair[0].dev.staticIdentity.RLock()
+	privateKey := hex.EncodeToString(pair[0].dev.staticIdentity.privateKey[:])
+	pair[0].dev.staticIdentity.RUnlock()
+	if strings.Contains(string(text), privateKey) {
+		t.Error("runtime state holds the private key")
+	}
+	var state RuntimeState
+	assertNil(t, json.Unmarshal(text, &state))
+
+	// A new device with the same peer picks up where the other left off.
+	dev := randDevice(t)
+	defer dev.Close()
+	assertNil(t, dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(s.PublicKey[:]),
+		"endpoint", "192.0.2.1:51820",
+	)))
+	state.Peers = append(state.Peers, PeerRuntimeState{PublicKey: NoisePublicKey{1}, Endpoint: "192.0.2.2:1"})
+	assertNil(t, dev.ImportRuntimeState(&state))
+	assertNil(t, dev.ImportRuntimeState(&RuntimeState{Peers: []PeerRuntimeState{{
+		PublicKey:         s.PublicKey,
+		TxBytes:           1,
+		LastHandshakeTime: s.LastHandshakeTime.Add(-time.Hour),
+	}}}))
+
+	imported := dev.ExportRuntimeState()
+	want := s
+	want.TxBytes++
+	if len(imported.Peers) != 1 || !imported.Peers[0].LastHandshakeTime.Equal(want.LastHandshakeTime) {
+		t.Fatalf("imported %+v, want %+v", imported.Peers, want)
+	}
+	imported.Peers[0].LastHandshakeTime = want.LastHandshakeTime
+	if imported.Peers[0] != want {
+		t.Errorf("imported %+v, want %+v", imported.Peers[0], want)
+	}
+
+	if err := dev.ImportRuntimeState(&RuntimeState{Peers: []PeerRuntimeState{{PublicKey: s.PublicKey, Endpoint: "nowhere"}}}); err == nil {
+		t.Error("imported an invalid endpoint")
+	}
+}
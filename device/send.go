@@ -12,11 +12,11 @@ import (
 	"net"
 	"os"
 	"sync"
-	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/conn"
 )
 
 /* Outbound flow
@@ -94,29 +94,37 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	}
 
 	peer.handshake.mutex.RLock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.device.now().Sub(peer.handshake.lastSentHandshake) < peer.protocolTimers().RekeyTimeout {
 		peer.handshake.mutex.RUnlock()
 		return nil
 	}
 	peer.handshake.mutex.RUnlock()
 
 	peer.handshake.mutex.Lock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.device.now().Sub(peer.handshake.lastSentHandshake) < peer.protocolTimers().RekeyTimeout {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
 
-	peer.device.log.Verbosef("%v - Sending handshake initiation", peer)
+	peer.refreshEndpoint()
 
-	msg, err := peer.device.CreateMessageInitiation(peer)
+	peer.device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Sending handshake initiation", conn.PeerField(peer), peer.endpointField())
+
+	var msg any
+	var err error
+	if peer.hybrid.Load() {
+		msg, err = peer.device.CreateMessageHybridInitiation(peer)
+	} else {
+		msg, err = peer.device.CreateMessageInitiation(peer)
+	}
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to create initiation message: %v", peer, err)
+		peer.device.log.Log(conn.SubsystemHandshake, conn.LevelError, "Failed to create initiation message", conn.PeerField(peer), conn.ErrorField(err))
 		return err
 	}
 
-	var buff [MessageInitiationSize]byte
+	var buff [MessageHandshakeSize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, msg)
 	packet := writer.Bytes()
@@ -125,10 +133,10 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
-	err = peer.SendBuffer(packet)
+	err = peer.sendObfuscated(packet)
 	if err != nil {
-		peer.device.UpdateHandshakeState(HandshakeFail)
-		peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, err)
+		peer.notifyHandshake(HandshakeFail, HandshakeFailSend, err)
+		peer.device.log.Log(conn.SubsystemHandshake, conn.LevelError, "Failed to send handshake initiation", conn.PeerField(peer), peer.endpointField(), conn.ErrorField(err))
 	}
 	peer.timersHandshakeInitiated()
 
@@ -137,18 +145,24 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 
 func (peer *Peer) SendHandshakeResponse() error {
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
 
-	peer.device.log.Verbosef("%v - Sending handshake response", peer)
+	peer.device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Sending handshake response", conn.PeerField(peer), peer.endpointField())
 
-	response, err := peer.device.CreateMessageResponse(peer)
+	var response any
+	var err error
+	if peer.hybrid.Load() {
+		response, err = peer.device.CreateMessageHybridResponse(peer)
+	} else {
+		response, err = peer.device.CreateMessageResponse(peer)
+	}
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to create response message: %v", peer, err)
+		peer.device.log.Log(conn.SubsystemHandshake, conn.LevelError, "Failed to create response message", conn.PeerField(peer), conn.ErrorField(err))
 		return err
 	}
 
-	var buff [MessageResponseSize]byte
+	var buff [MessageHandshakeSize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, response)
 	packet := writer.Bytes()
@@ -156,7 +170,7 @@ func (peer *Peer) SendHandshakeResponse() error {
 
 	err = peer.BeginSymmetricSession()
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to derive keypair: %v", peer, err)
+		peer.device.log.Log(conn.SubsystemHandshake, conn.LevelError, "Failed to derive keypair", conn.PeerField(peer), conn.ErrorField(err))
 		return err
 	}
 
@@ -164,18 +178,22 @@ func (peer *Peer) SendHandshakeResponse() error {
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
-	err = peer.SendBuffer(packet)
+	err = peer.sendObfuscated(packet)
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to send handshake response: %v", peer, err)
+		peer.device.log.Log(conn.SubsystemHandshake, conn.LevelError, "Failed to send handshake response", conn.PeerField(peer), peer.endpointField(), conn.ErrorField(err))
 	}
 	return err
 }
 
 func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
-	device.log.Verbosef("Sending cookie response for denied handshake message for %v", initiatingElem.endpoint.DstToString())
+	device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Sending cookie response for denied handshake message", conn.EndpointField(initiatingElem.endpoint))
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
-	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
+	cookieChecker, _ := device.cookieCheckerFor(initiatingElem.packet)
+	if cookieChecker == nil {
+		cookieChecker = &device.cookieChecker
+	}
+	reply, err := cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
 	if err != nil {
 		device.log.Errorf("Failed to create cookie reply: %v", err)
 		return err
@@ -184,7 +202,18 @@ func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement)
 	var buff [MessageCookieReplySize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, reply)
-	device.net.bind.Send(writer.Bytes(), initiatingElem.endpoint)
+	packet := writer.Bytes()
+	if o := device.obfuscation.Load(); o != nil {
+		packet, err = o.wrap(packet)
+		if err != nil {
+			device.log.Errorf("Failed to obfuscate cookie reply: %v", err)
+			return err
+		}
+	}
+	device.net.bind.Send(packet, initiatingElem.endpoint)
+	if c := device.capture.Load(); c != nil {
+		c.bindPacket(packet, initiatingElem.endpoint, false)
+	}
 	return nil
 }
 
@@ -194,7 +223,7 @@ func (peer *Peer) keepKeyFreshSending() {
 		return
 	}
 	nonce := keypair.sendNonce.Load()
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	if nonce > RekeyAfterMessages || (keypair.isInitiator && peer.device.now().Sub(keypair.created) > peer.device.timers().RekeyAfterTime) {
 		peer.SendHandshakeInitiation(false)
 	}
 }
@@ -243,6 +272,9 @@ func (device *Device) RoutineReadFromTUN() {
 		}
 
 		elem.packet = elem.buffer[offset : offset+size]
+		if c := device.capture.Load(); c != nil {
+			c.tunPacket(elem.packet, false)
+		}
 
 		// lookup peer
 
@@ -273,9 +305,7 @@ func (device *Device) RoutineReadFromTUN() {
 			continue
 		}
 
-		// Drop packets with unexpected src IP.
-		if device.allowedSrcAddresses != nil && device.isUnexpectedSrcIP(src) {
-			//device.log.Verbosef("Dropping packet with unexpected src IP: %v (allowed = %v)", src, device.allowedSrcAddresses)
+		if !device.allowsSource(peer, src) {
 			continue
 		}
 
@@ -287,15 +317,6 @@ func (device *Device) RoutineReadFromTUN() {
 	}
 }
 
-func (device *Device) isUnexpectedSrcIP(src []byte) bool {
-	for _, allowed := range device.allowedSrcAddresses {
-		if allowed.Equal(src) {
-			return false
-		}
-	}
-	return true
-}
-
 func (peer *Peer) StagePacket(elem *QueueOutboundElement) {
 	for {
 		select {
@@ -319,7 +340,7 @@ top:
 	}
 
 	keypair := peer.keypairs.Current()
-	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || time.Since(keypair.created) >= RejectAfterTime {
+	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || peer.device.now().Sub(keypair.created) >= peer.device.timers().RejectAfterTime {
 		peer.SendHandshakeInitiation(false)
 		return
 	}
@@ -392,6 +413,8 @@ func (device *Device) RoutineEncryption(id int) {
 	device.log.Verbosef("Routine: encryption worker %d - started", id)
 
 	for elem := range device.queue.encryption.c {
+		transportType := device.obfuscation.Load().transportType()
+
 		// populate header fields
 		header := elem.buffer[:MessageTransportHeaderSize]
 
@@ -399,7 +422,7 @@ func (device *Device) RoutineEncryption(id int) {
 		fieldReceiver := header[4:8]
 		fieldNonce := header[8:16]
 
-		binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
+		binary.LittleEndian.PutUint32(fieldType, transportType)
 		binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
 		binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
@@ -0,0 +1,164 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+/* Source filter
+ *
+ * Packets read from the TUN device can be restricted to source addresses
+ * within a set of prefixes before they are sent to a peer.
+ *
+ * The device has a filter that applies to every peer, and each peer may
+ * have its own filter which takes precedence over the device one.
+ * A missing or empty filter lets all packets through.
+ *
+ * Filters are immutable once built and are swapped atomically,
+ * so the data path never sees a partially updated filter.
+ */
+
+type sourceFilter struct {
+	filter  atomic.Pointer[prefixSet] // nil if no filter is configured
+	dropped atomic.Uint64             // packets dropped by the filter
+}
+
+// A prefixSet is an immutable set of IPv4 and IPv6 prefixes.
+// It is stored in the same trie as the AllowedIPs, with a placeholder
+// peer marking the prefixes that belong to the set.
+type prefixSet struct {
+	table  AllowedIPs
+	member *Peer
+}
+
+func newPrefixSet(prefixes []netip.Prefix) *prefixSet {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	set := &prefixSet{member: new(Peer)}
+	for _, prefix := range prefixes {
+		set.table.Insert(prefix, set.member)
+	}
+	return set
+}
+
+func (set *prefixSet) contains(ip []byte) bool {
+	return set.table.Lookup(ip) == set.member
+}
+
+// prefixes returns the masked prefixes in the set.
+func (set *prefixSet) prefixes() []netip.Prefix {
+	if set == nil {
+		return nil
+	}
+	var prefixes []netip.Prefix
+	set.table.EntriesForPeer(set.member, func(prefix netip.Prefix) bool {
+		prefixes = append(prefixes, prefix)
+		return true
+	})
+	return prefixes
+}
+
+// ParseSourceFilter parses a comma separated list of prefixes, such as
+// "10.0.0.0/24,fd00::/64". Bare addresses are accepted as single host prefixes.
+func ParseSourceFilter(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := parseSourcePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func parseSourcePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if addr.Zone() != "" {
+			return netip.Prefix{}, fmt.Errorf("invalid source prefix %q: zones are not allowed", s)
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(s)
+}
+
+func validateSourceFilter(prefixes []netip.Prefix) error {
+	for _, prefix := range prefixes {
+		if !prefix.IsValid() {
+			return fmt.Errorf("invalid source prefix %v", prefix)
+		}
+	}
+	return nil
+}
+
+// SetSourceFilter restricts the source addresses of packets sent to any peer
+// without a filter of its own. An empty list removes the restriction.
+func (device *Device) SetSourceFilter(prefixes []netip.Prefix) error {
+	if err := validateSourceFilter(prefixes); err != nil {
+		return err
+	}
+	device.sourceFilter.filter.Store(newPrefixSet(prefixes))
+	return nil
+}
+
+// SourceFilter returns the prefixes of the device source filter.
+func (device *Device) SourceFilter() []netip.Prefix {
+	return device.sourceFilter.filter.Load().prefixes()
+}
+
+// SourceFilterDropped returns the number of packets dropped by source filters.
+func (device *Device) SourceFilterDropped() uint64 {
+	return device.sourceFilter.dropped.Load()
+}
+
+// SetSourceFilter restricts the source addresses of packets sent to the peer,
+// replacing the device source filter for it. An empty list removes the restriction
+// and makes the device source filter apply again.
+func (peer *Peer) SetSourceFilter(prefixes []netip.Prefix) error {
+	if err := validateSourceFilter(prefixes); err != nil {
+		return err
+	}
+	peer.sourceFilter.filter.Store(newPrefixSet(prefixes))
+	return nil
+}
+
+// SourceFilter returns the prefixes of the peer source filter.
+func (peer *Peer) SourceFilter() []netip.Prefix {
+	return peer.sourceFilter.filter.Load().prefixes()
+}
+
+// SourceFilterDropped returns the number of packets to the peer dropped by source filters.
+func (peer *Peer) SourceFilterDropped() uint64 {
+	return peer.sourceFilter.dropped.Load()
+}
+
+// allowsSource reports whether a packet from src may be sent to peer,
+// counting the packet as dropped if not.
+func (device *Device) allowsSource(peer *Peer, src []byte) bool {
+	filter := peer.sourceFilter.filter.Load()
+	if filter == nil {
+		filter = device.sourceFilter.filter.Load()
+	}
+	if filter == nil || filter.contains(src) {
+		return true
+	}
+	device.sourceFilter.dropped.Add(1)
+	peer.sourceFilter.dropped.Add(1)
+	return false
+}
@@ -0,0 +1,190 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestParseSourceFilter(t *testing.T) {
+	prefixes, err := ParseSourceFilter(" 10.0.0.1, fd00::/64,,192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.1/32"),
+		netip.MustParsePrefix("fd00::/64"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+	}
+	if len(prefixes) != len(want) {
+		t.Fatalf("got %v, want %v", prefixes, want)
+	}
+	for i := range want {
+		if prefixes[i] != want[i] {
+			t.Errorf("prefix %d = %v, want %v", i, prefixes[i], want[i])
+		}
+	}
+
+	if prefixes, err := ParseSourceFilter(""); err != nil || prefixes != nil {
+		t.Errorf("empty filter parsed as %v, %v", prefixes, err)
+	}
+	for _, bad := range []string{"10.0.0.1,bogus", "10.0.0.0/33", "fe80::1%eth0"} {
+		if _, err := ParseSourceFilter(bad); err == nil {
+			t.Errorf("ParseSourceFilter(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSourceFilter(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := device.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	allows := func(src string) bool {
+		addr := netip.MustParseAddr(src)
+		return device.allowsSource(peer, addr.AsSlice())
+	}
+
+	device.SetSourceFilter(nil)
+	if !allows("192.0.2.1") || !allows("2001:db8::1") {
+		t.Error("packets dropped without a source filter")
+	}
+
+	device.SetSourceFilter([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")})
+	if !allows("10.1.2.3") || !allows("fd12::1") {
+		t.Error("device source filter dropped matching packets")
+	}
+	if allows("192.0.2.1") || allows("2001:db8::1") {
+		t.Error("device source filter let non-matching packets through")
+	}
+
+	// A peer filter takes precedence over the device one.
+	peer.SetSourceFilter([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+	if !allows("192.0.2.1") || allows("10.1.2.3") {
+		t.Error("peer source filter not applied")
+	}
+
+	if got := device.SourceFilterDropped(); got != 3 {
+		t.Errorf("device dropped %d packets, want 3", got)
+	}
+	if got := peer.SourceFilterDropped(); got != 3 {
+		t.Errorf("peer dropped %d packets, want 3", got)
+	}
+}
+
+func TestSourceFilterInvalidOption(t *testing.T) {
+	for _, opt := range []Option{
+		WithSourceFilter(netip.MustParsePrefix("10.0.0.0/8"), netip.Prefix{}),
+		WithAllowedSrcAddresses("10.0.0.2,bogus"),
+	} {
+		device, err := CreateDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), NewLogger(LogLevelSilent, ""), opt)
+		if err == nil {
+			device.Close()
+			t.Error("device created with an invalid source filter")
+		}
+	}
+}
+
+func TestAllowedSrcAddressesOption(t *testing.T) {
+	for _, tt := range []struct {
+		addresses string
+		allowed   []string
+		dropped   []string
+		reported  string
+	}{
+		{"10.0.0.2,fd00::2", []string{"10.0.0.2", "fd00::2"}, []string{"10.0.0.3", "192.0.2.1"}, "source_filter=10.0.0.2/32\nsource_filter=fd00::2/128\n"},
+		{"10.0.0.0/8", []string{"10.1.2.3"}, []string{"192.0.2.1"}, "source_filter=10.0.0.0/8\n"},
+		{"", []string{"10.0.0.2", "2001:db8::1"}, nil, ""},
+	} {
+		device, err := CreateDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), NewLogger(LogLevelSilent, ""),
+			WithAllowedSrcAddresses(tt.addresses))
+		assertNil(t, err)
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		peer, err := device.NewPeer(sk.publicKey())
+		assertNil(t, err)
+		for _, src := range tt.allowed {
+			if !device.allowsSource(peer, netip.MustParseAddr(src).AsSlice()) {
+				t.Errorf("allowed source addresses %q dropped a packet from %s", tt.addresses, src)
+			}
+		}
+		for _, src := range tt.dropped {
+			if device.allowsSource(peer, netip.MustParseAddr(src).AsSlice()) {
+				t.Errorf("allowed source addresses %q let through a packet from %s", tt.addresses, src)
+			}
+		}
+		cfg := ipcConfig(t, device)
+		if got := strings.Join(regexp.MustCompile(`(?m)^source_filter=.*\n`).FindAllString(cfg, -1), ""); got != tt.reported {
+			t.Errorf("allowed source addresses %q reported as %q, want %q", tt.addresses, got, tt.reported)
+		}
+		device.Close()
+	}
+}
+
+func TestSourceFilterUAPI(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+
+	err = device.IpcSet(uapiCfg(
+		"replace_source_filter", "true",
+		"source_filter", "10.0.0.0/8",
+		"source_filter", "fd00::1",
+		"public_key", hex.EncodeToString(pk[:]),
+		"source_filter", "192.0.2.7/24",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := device.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.peers.RLock()
+	peer := device.peers.keyMap[pk]
+	device.peers.RUnlock()
+	if got := peer.SourceFilter(); len(got) != 1 || got[0] != netip.MustParsePrefix("192.0.2.0/24") {
+		t.Errorf("peer source filter = %v", got)
+	}
+	for _, line := range []string{"source_filter=10.0.0.0/8\n", "source_filter=fd00::1/128\n", "source_filter=192.0.2.0/24\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("IpcGet output lacks %q:\n%s", line, cfg)
+		}
+	}
+
+	err = device.IpcSet(uapiCfg("source_filter", "10.0.0.0/40"))
+	if err == nil {
+		t.Fatal("invalid source prefix was accepted")
+	}
+	if got := len(device.SourceFilter()); got != 2 {
+		t.Errorf("device source filter has %d prefixes after failed set, want 2", got)
+	}
+
+	err = device.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), "replace_source_filter", "true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := peer.SourceFilter(); got != nil {
+		t.Errorf("peer source filter = %v after replace", got)
+	}
+}
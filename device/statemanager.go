@@ -20,9 +20,12 @@
 package device
 
 import (
+	"fmt"
 	"strings"
 	"sync"
 	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
 )
 
 var initialRestartDelay = 4 * time.Second
@@ -37,8 +40,9 @@ var timeNow = time.Now
 // SetNetworkAvailable(true) is called. When SetNetworkAvailable(true) is called twice in a row it'll be interpreted
 // as network change and trigger reset of the connection (on TCP/TLS socket).
 //
-// GetState is blocking and therefore should run in dedicated thread in a loop. After Close is called GetState will
-// return immediately with WireGuardDisabled.
+// GetState is blocking and therefore should run in dedicated thread in a loop. It returns the newest state: a state
+// not yet returned is replaced by the next one. After Close is called GetState will return immediately with
+// WireGuardDisabled.
 type WireGuardStateManager struct {
 	HandshakeStateChan   chan HandshakeState
 	SocketErrChan        chan error
@@ -46,6 +50,7 @@ type WireGuardStateManager struct {
 	closeChan            chan bool
 
 	stateChan      chan WireGuardState
+	stateMu        sync.Mutex // guards closed, serializing posting states with closing stateChan
 	isNetAvailable bool
 
 	lastRestart  time.Time
@@ -68,6 +73,23 @@ const (
 	WireGuardWaitingForNetwork
 )
 
+func (state WireGuardState) String() string {
+	switch state {
+	case WireGuardDisabled:
+		return "disabled"
+	case WireGuardConnecting:
+		return "connecting"
+	case WireGuardConnected:
+		return "connected"
+	case WireGuardError:
+		return "error"
+	case WireGuardWaitingForNetwork:
+		return "waiting_for_network"
+	default:
+		return fmt.Sprintf("WireGuardState(%d)", int(state))
+	}
+}
+
 type BaseDevice interface {
 	Up() error
 	Down() error
@@ -101,13 +123,22 @@ func (man *WireGuardStateManager) GetState() WireGuardState {
 }
 
 func (man *WireGuardStateManager) Close() {
-	man.log.Verbosef("StateManager: closing")
+	man.log.Log(conn.SubsystemState, conn.LevelDebug, "Closing")
+	man.stateMu.Lock()
+	defer man.stateMu.Unlock()
+	if man.closed {
+		return
+	}
 	man.closed = true
-	go func() {
-		man.closeChan <- true
-		man.stateChan <- WireGuardDisabled
-		close(man.stateChan)
-	}()
+	man.closeChan <- true
+	man.replaceState(WireGuardDisabled)
+	close(man.stateChan)
+}
+
+func (man *WireGuardStateManager) isClosed() bool {
+	man.stateMu.Lock()
+	defer man.stateMu.Unlock()
+	return man.closed
 }
 
 func (man *WireGuardStateManager) SetNetworkAvailable(available bool) {
@@ -115,15 +146,20 @@ func (man *WireGuardStateManager) SetNetworkAvailable(available bool) {
 }
 
 func (man *WireGuardStateManager) handlerLoop(device BaseDevice) {
-	man.log.Verbosef("StateManager: start loop")
-	// Ugly way of emulating optional bool type
-	var wasNetAvailablePtr *bool = nil
+	man.log.Log(conn.SubsystemState, conn.LevelDebug, "Start loop", conn.TransportField(man.transmission))
+	var netKnown bool
 	for {
 		select {
 		case netAvailable := <-man.networkAvailableChan:
+			// Ugly way of emulating optional bool type
+			var wasNetAvailablePtr *bool
+			if netKnown {
+				wasNetAvailable := man.isNetAvailable
+				wasNetAvailablePtr = &wasNetAvailable
+			}
+			// Updated first, so that the states posted for the change are not dropped
+			man.isNetAvailable, netKnown = netAvailable, true
 			man.onNetworkAvailabilityChange(device, wasNetAvailablePtr, netAvailable)
-			man.isNetAvailable = netAvailable
-			wasNetAvailablePtr = &man.isNetAvailable
 		case socketErr := <-man.SocketErrChan:
 			if man.isNetAvailable {
 				man.handleSocketErr(device, socketErr)
@@ -133,7 +169,7 @@ func (man *WireGuardStateManager) handlerLoop(device BaseDevice) {
 				man.handleHandshakeState(device, handshakeState)
 			}
 		case <-man.closeChan:
-			man.log.Verbosef("StateManager: end loop")
+			man.log.Log(conn.SubsystemState, conn.LevelDebug, "End loop")
 			return
 		}
 	}
@@ -144,20 +180,20 @@ func (man *WireGuardStateManager) onNetworkAvailabilityChange(device BaseDevice,
 		man.postState(WireGuardWaitingForNetwork)
 	}
 	if available && wasAvailable == nil {
-		man.log.Verbosef("StateManager: network on")
+		man.log.Log(conn.SubsystemState, conn.LevelInfo, "Network on")
 		man.setActive(device, true)
 		man.startedTimestamp = timeNow()
 	} else if available && *wasAvailable && !man.startedTimestamp.IsZero() &&
 		timeNow().After(man.startedTimestamp.Add(5*time.Second)) {
 		// Ignore network changes at the very beginning of connection as those might be false positive
 		// (VPN tunnel opening)
-		man.log.Verbosef("StateManager: network change detected")
+		man.log.Log(conn.SubsystemState, conn.LevelInfo, "Network change detected")
 		man.maybeRestart(device)
 	} else if available && !*wasAvailable {
-		man.log.Verbosef("StateManager: network back")
+		man.log.Log(conn.SubsystemState, conn.LevelInfo, "Network back")
 		man.setActive(device, true)
 	} else if !available && wasAvailable != nil && *wasAvailable {
-		man.log.Verbosef("StateManager: network gone")
+		man.log.Log(conn.SubsystemState, conn.LevelInfo, "Network gone")
 		man.setActive(device, false)
 	}
 }
@@ -174,7 +210,7 @@ func (man *WireGuardStateManager) setActive(device BaseDevice, activate bool) {
 		err = device.Down()
 	}
 	if err != nil {
-		man.log.Errorf("StateManager: setActive(%t) error %v", activate, err)
+		man.log.Log(conn.SubsystemState, conn.LevelError, "Unable to change device state", conn.Field{Key: "active", Value: activate}, conn.ErrorField(err))
 		man.postState(WireGuardError)
 	}
 }
@@ -184,7 +220,7 @@ func (man *WireGuardStateManager) handleSocketErr(device BaseDevice, err error)
 		errStr := err.Error()
 		if strings.Contains(errStr, "broken pipe") ||
 			strings.Contains(errStr, "connection reset by peer") {
-			man.log.Errorf("StateManager: %s", errStr)
+			man.log.Log(conn.SubsystemState, conn.LevelError, "Socket error", conn.TransportField(man.transport(device)), conn.ErrorField(err))
 			man.maybeRestart(device)
 		}
 	}
@@ -202,8 +238,18 @@ func (man *WireGuardStateManager) handleHandshakeState(device BaseDevice, state
 	}
 }
 
+// transport returns the live transport of device if it reports one, as a
+// Device does, and otherwise the transmission the manager was created with.
+func (man *WireGuardStateManager) transport(device BaseDevice) string {
+	if d, ok := device.(interface{ Transport() string }); ok {
+		return d.Transport()
+	}
+	return man.transmission
+}
+
 func (man *WireGuardStateManager) maybeRestart(device BaseDevice) {
-	if man.transmission == "udp" {
+	transport := man.transport(device)
+	if transport == "udp" {
 		return
 	}
 
@@ -211,10 +257,10 @@ func (man *WireGuardStateManager) maybeRestart(device BaseDevice) {
 	defer man.mu.Unlock()
 
 	if man.shouldRestart() {
-		man.log.Verbosef("StateManager: restarting")
+		man.log.Log(conn.SubsystemState, conn.LevelInfo, "Restarting", conn.TransportField(transport))
 		man.postState(WireGuardConnecting)
 		device.Down()
-		if !man.closed {
+		if !man.isClosed() {
 			device.Up()
 		}
 	}
@@ -239,9 +285,20 @@ func (man *WireGuardStateManager) shouldRestart() bool {
 }
 
 func (man *WireGuardStateManager) postState(state WireGuardState) {
-	go func() {
-		if !man.closed && (man.isNetAvailable || state == WireGuardWaitingForNetwork) {
-			man.stateChan <- state
-		}
-	}()
+	man.stateMu.Lock()
+	defer man.stateMu.Unlock()
+	if !man.closed && (man.isNetAvailable || state == WireGuardWaitingForNetwork) {
+		man.replaceState(state)
+	}
+}
+
+// replaceState posts state in place of the state GetState has not returned yet,
+// so that states are never delivered out of order and the newest one wins.
+// The caller must hold stateMu.
+func (man *WireGuardStateManager) replaceState(state WireGuardState) {
+	select {
+	case <-man.stateChan:
+	default:
+	}
+	man.stateChan <- state
 }
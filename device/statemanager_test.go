@@ -22,131 +22,178 @@ package device
 import (
 	"errors"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 	"time"
 )
 
-var timeMs int64 = 0
-var mockDevice MockDevice
-var manager *WireGuardStateManager
-var lastState WireGuardState
+// testClock is the time of the state manager tests, which they advance.
+var testClock struct {
+	sync.Mutex
+	ms   int64
+	once sync.Once
+}
+
+func testClockAdvance(d time.Duration) {
+	testClock.Lock()
+	testClock.ms += d.Milliseconds()
+	testClock.Unlock()
+}
+
+func testClockNow() time.Time {
+	testClock.Lock()
+	defer testClock.Unlock()
+	return time.UnixMilli(testClock.ms)
+}
 
 type MockDevice struct {
+	mu      sync.Mutex
 	isUp    bool
 	upCount int
 }
 
 func (dev *MockDevice) Up() error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
 	dev.isUp = true
 	dev.upCount++
 	return nil
 }
 
 func (dev *MockDevice) Down() error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
 	dev.isUp = false
 	return nil
 }
 
-func setup() {
-	timeMs = 0
-	timeNow = func() time.Time { return time.UnixMilli(timeMs) }
-	mockDevice.isUp = false
+func (dev *MockDevice) IsUp() bool {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.isUp
+}
+
+func (dev *MockDevice) UpCount() int {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.upCount
+}
 
-	manager = NewWireGuardStateManager(NewLogger(LogLevelVerbose, ""), "tcp")
-	manager.Start(&mockDevice)
-	lastState = WireGuardDisabled
+// stateManagerTest runs a manager on a MockDevice, reading its states.
+type stateManagerTest struct {
+	*assert.Assertions
+	manager *WireGuardStateManager
+	device  *MockDevice
+
+	mu        sync.Mutex
+	lastState WireGuardState
+}
+
+func newStateManagerTest(t *testing.T) *stateManagerTest {
+	testClock.once.Do(func() { timeNow = testClockNow })
+	testClock.Lock()
+	testClock.ms = 0
+	testClock.Unlock()
+
+	test := &stateManagerTest{
+		Assertions: assert.New(t),
+		manager:    NewWireGuardStateManager(NewLogger(LogLevelVerbose, ""), "tcp"),
+		device:     &MockDevice{},
+		lastState:  WireGuardDisabled,
+	}
+	test.manager.Start(test.device)
+	done := make(chan struct{})
 	go func() {
-		for lastState != -1 {
-			lastState = manager.GetState()
+		defer close(done)
+		for {
+			state := test.manager.GetState()
+			if state == -1 {
+				return
+			}
+			test.mu.Lock()
+			test.lastState = state
+			test.mu.Unlock()
 		}
 	}()
+	t.Cleanup(func() {
+		test.manager.Close()
+		<-done
+	})
+	return test
 }
 
-func setdown() {
-	manager.Close()
+// waitFor waits for the state and for the device to be up or down.
+func (test *stateManagerTest) waitFor(state WireGuardState, isUp bool) {
+	test.Eventually(func() bool {
+		test.mu.Lock()
+		defer test.mu.Unlock()
+		return test.lastState == state && test.device.IsUp() == isUp
+	}, time.Second, time.Millisecond, "want state %v, device up %v", state, isUp)
 }
 
 func TestWireGuardStateManager_shouldRestart(t *testing.T) {
-	assert := assert.New(t)
-	setup()
-	defer setdown()
-
-	assert.Equal(initialRestartDelay, manager.nextRestartDelay)
-
-	assert.Equal(false, manager.shouldRestart())
-	timeMs += initialRestartDelay.Milliseconds()
-	assert.Equal(false, manager.shouldRestart())
-	timeMs += 1
-	assert.Equal(true, manager.shouldRestart())
-
-	assert.Equal(2*initialRestartDelay, manager.nextRestartDelay)
-	assert.Equal(false, manager.shouldRestart())
-	timeMs += 2 * initialRestartDelay.Milliseconds()
-	assert.Equal(false, manager.shouldRestart())
-	timeMs += 1
-	assert.Equal(true, manager.shouldRestart())
-
-	timeMs += resetRestartDelay.Milliseconds() + 1
-	assert.Equal(true, manager.shouldRestart())
-	assert.Equal(initialRestartDelay, manager.nextRestartDelay)
+	test := newStateManagerTest(t)
+	manager := test.manager
+
+	test.Equal(initialRestartDelay, manager.nextRestartDelay)
+
+	test.Equal(false, manager.shouldRestart())
+	testClockAdvance(initialRestartDelay)
+	test.Equal(false, manager.shouldRestart())
+	testClockAdvance(time.Millisecond)
+	test.Equal(true, manager.shouldRestart())
+
+	test.Equal(2*initialRestartDelay, manager.nextRestartDelay)
+	test.Equal(false, manager.shouldRestart())
+	testClockAdvance(2 * initialRestartDelay)
+	test.Equal(false, manager.shouldRestart())
+	testClockAdvance(time.Millisecond)
+	test.Equal(true, manager.shouldRestart())
+
+	testClockAdvance(resetRestartDelay + time.Millisecond)
+	test.Equal(true, manager.shouldRestart())
+	test.Equal(initialRestartDelay, manager.nextRestartDelay)
 }
 
 func TestWireGuardStateManager_networkStartsAndStopsDevice(t *testing.T) {
-	assert := assert.New(t)
-	setup()
-	defer setdown()
+	test := newStateManagerTest(t)
 
-	assert.Equal(false, mockDevice.isUp)
-	manager.SetNetworkAvailable(true)
-	time.Sleep(time.Millisecond) // Poor substitute for advanceUntilIdle, make sure goroutines finish before checking
-	assert.Equal(true, mockDevice.isUp)
-	assert.Equal(WireGuardConnecting, lastState)
-	manager.SetNetworkAvailable(false)
-	time.Sleep(time.Millisecond)
-	assert.Equal(WireGuardWaitingForNetwork, lastState)
-	assert.Equal(false, mockDevice.isUp)
+	test.Equal(false, test.device.IsUp())
+	test.manager.SetNetworkAvailable(true)
+	test.waitFor(WireGuardConnecting, true)
+	test.manager.SetNetworkAvailable(false)
+	test.waitFor(WireGuardWaitingForNetwork, false)
 }
 
 func TestWireGuardStateManager_happyConnectionPath(t *testing.T) {
-	assert := assert.New(t)
-	setup()
-	defer setdown()
+	test := newStateManagerTest(t)
 
-	manager.SetNetworkAvailable(true)
-	time.Sleep(time.Millisecond)
-	manager.HandshakeStateChan <- HandshakeSuccess
-	time.Sleep(time.Millisecond)
-	assert.Equal(WireGuardConnected, lastState)
-	assert.Equal(true, mockDevice.isUp)
+	test.manager.SetNetworkAvailable(true)
+	test.waitFor(WireGuardConnecting, true)
+	test.manager.HandshakeStateChan <- HandshakeSuccess
+	test.waitFor(WireGuardConnected, true)
 }
 
 func TestWireGuardStateManager_handshakeFailCausesRestart(t *testing.T) {
-	assert := assert.New(t)
-	setup()
-	defer setdown()
-
-	manager.SetNetworkAvailable(true)
-	time.Sleep(time.Millisecond)
-	manager.HandshakeStateChan <- HandshakeFail
-	time.Sleep(time.Millisecond)
-	assert.Equal(WireGuardError, lastState)
-	timeMs += initialRestartDelay.Milliseconds() + 1
-	manager.HandshakeStateChan <- HandshakeFail
-	time.Sleep(time.Millisecond)
-	assert.Equal(WireGuardConnecting, lastState)
-	assert.Equal(2, mockDevice.upCount)
+	test := newStateManagerTest(t)
+
+	test.manager.SetNetworkAvailable(true)
+	test.waitFor(WireGuardConnecting, true)
+	test.manager.HandshakeStateChan <- HandshakeFail
+	test.waitFor(WireGuardError, true)
+	testClockAdvance(initialRestartDelay + time.Millisecond)
+	test.manager.HandshakeStateChan <- HandshakeFail
+	test.waitFor(WireGuardConnecting, true)
+	test.Eventually(func() bool { return test.device.UpCount() == 2 }, time.Second, time.Millisecond)
 }
 
 func TestWireGuardStateManager_brokenPipeCausesRestart(t *testing.T) {
-	assert := assert.New(t)
-	setup()
-	defer setdown()
-
-	manager.SetNetworkAvailable(true)
-	timeMs += initialRestartDelay.Milliseconds() + 1
-	time.Sleep(time.Millisecond)
-	manager.SocketErrChan <- errors.New("broken pipe")
-	time.Sleep(time.Millisecond)
-	assert.Equal(WireGuardConnecting, lastState)
-	assert.Equal(2, mockDevice.upCount)
+	test := newStateManagerTest(t)
+
+	test.manager.SetNetworkAvailable(true)
+	test.waitFor(WireGuardConnecting, true)
+	testClockAdvance(initialRestartDelay + time.Millisecond)
+	test.manager.SocketErrChan <- errors.New("broken pipe")
+	test.Eventually(func() bool { return test.device.UpCount() == 2 }, time.Second, time.Millisecond)
+	test.waitFor(WireGuardConnecting, true)
 }
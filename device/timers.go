@@ -11,6 +11,8 @@ import (
 	"sync"
 	"time"
 	_ "unsafe"
+
+	"golang.zx2c4.com/wireguard/conn"
 )
 
 //go:linkname fastrandn runtime.fastrandn
@@ -77,9 +79,11 @@ func (peer *Peer) timersActive() bool {
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
-	if peer.timers.handshakeAttempts.Load() > MaxTimerHandshakes {
-		peer.device.UpdateHandshakeState(HandshakeFail)
-		peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up", peer, MaxTimerHandshakes+2)
+	t := peer.protocolTimers()
+	if peer.timers.handshakeAttempts.Load() > t.maxHandshakes() {
+		peer.notifyHandshake(HandshakeFail, HandshakeFailMaxAttempts, nil)
+		peer.device.log.Log(conn.SubsystemHandshake, conn.LevelWarn, "Handshake did not complete, giving up",
+			conn.PeerField(peer), peer.endpointField(), conn.Field{Key: "attempts", Value: t.maxHandshakes() + 2})
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
@@ -94,12 +98,13 @@ func expiredRetransmitHandshake(peer *Peer) {
 		 * of a partial exchange.
 		 */
 		if peer.timersActive() && !peer.timers.zeroKeyMaterial.IsPending() {
-			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+			peer.timers.zeroKeyMaterial.Mod(t.RejectAfterTime * 3)
 		}
 	} else {
 		peer.timers.handshakeAttempts.Add(1)
-		peer.device.UpdateHandshakeState(HandshakeFail)
-		peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, int(RekeyTimeout.Seconds()), peer.timers.handshakeAttempts.Load()+1)
+		peer.notifyHandshake(HandshakeFail, HandshakeFailTimeout, nil)
+		peer.device.log.Log(conn.SubsystemHandshake, conn.LevelDebug, "Handshake did not complete, retrying",
+			conn.PeerField(peer), peer.endpointField(), conn.Field{Key: "timeout", Value: t.RekeyTimeout}, conn.Field{Key: "try", Value: peer.timers.handshakeAttempts.Load() + 1})
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.Lock()
@@ -117,13 +122,14 @@ func expiredSendKeepalive(peer *Peer) {
 	if peer.timers.needAnotherKeepalive.Load() {
 		peer.timers.needAnotherKeepalive.Store(false)
 		if peer.timersActive() {
-			peer.timers.sendKeepalive.Mod(KeepaliveTimeout)
+			peer.timers.sendKeepalive.Mod(peer.protocolTimers().KeepaliveTimeout)
 		}
 	}
 }
 
 func expiredNewHandshake(peer *Peer) {
-	peer.device.log.Verbosef("%s - Retrying handshake because we stopped hearing back after %d seconds", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
+	t := peer.protocolTimers()
+	peer.device.log.Verbosef("%s - Retrying handshake because we stopped hearing back after %d seconds", peer, int((t.KeepaliveTimeout + t.RekeyTimeout).Seconds()))
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.Lock()
 	if peer.endpoint != nil {
@@ -134,7 +140,7 @@ func expiredNewHandshake(peer *Peer) {
 }
 
 func expiredZeroKeyMaterial(peer *Peer) {
-	peer.device.log.Verbosef("%s - Removing all keys, since we haven't received a new one in %d seconds", peer, int((RejectAfterTime * 3).Seconds()))
+	peer.device.log.Verbosef("%s - Removing all keys, since we haven't received a new one in %d seconds", peer, int((peer.device.timers().RejectAfterTime * 3).Seconds()))
 	peer.ZeroAndFlushAll()
 }
 
@@ -147,7 +153,8 @@ func expiredPersistentKeepalive(peer *Peer) {
 /* Should be called after an authenticated data packet is sent. */
 func (peer *Peer) timersDataSent() {
 	if peer.timersActive() && !peer.timers.newHandshake.IsPending() {
-		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
+		t := peer.protocolTimers()
+		peer.timers.newHandshake.Mod(t.KeepaliveTimeout + t.RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
 	}
 }
 
@@ -155,7 +162,7 @@ func (peer *Peer) timersDataSent() {
 func (peer *Peer) timersDataReceived() {
 	if peer.timersActive() {
 		if !peer.timers.sendKeepalive.IsPending() {
-			peer.timers.sendKeepalive.Mod(KeepaliveTimeout)
+			peer.timers.sendKeepalive.Mod(peer.protocolTimers().KeepaliveTimeout)
 		} else {
 			peer.timers.needAnotherKeepalive.Store(true)
 		}
@@ -171,6 +178,7 @@ func (peer *Peer) timersAnyAuthenticatedPacketSent() {
 
 /* Should be called after any type of authenticated packet is received -- keepalive, data, or handshake. */
 func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
+	peer.markActive()
 	if peer.timersActive() {
 		peer.timers.newHandshake.Del()
 	}
@@ -179,7 +187,7 @@ func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 /* Should be called after a handshake initiation message is sent. */
 func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
-		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
+		peer.timers.retransmitHandshake.Mod(peer.protocolTimers().RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
 	}
 }
 
@@ -190,13 +198,13 @@ func (peer *Peer) timersHandshakeComplete() {
 	}
 	peer.timers.handshakeAttempts.Store(0)
 	peer.timers.sentLastMinuteHandshake.Store(false)
-	peer.lastHandshakeNano.Store(time.Now().UnixNano())
+	peer.lastHandshakeNano.Store(peer.device.now().UnixNano())
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
 func (peer *Peer) timersSessionDerived() {
 	if peer.timersActive() {
-		peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+		peer.timers.zeroKeyMaterial.Mod(peer.device.timers().RejectAfterTime * 3)
 	}
 }
 
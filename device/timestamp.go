@@ -0,0 +1,37 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+/* Handshake timestamps
+ *
+ * Responders reject initiations whose timestamp is not after the last one
+ * they accepted from the same peer. The timestamps of a device come from a
+ * tai64n.Source, so they keep increasing when the wall clock goes backwards.
+ * With a tai64n.Store, they also keep increasing across restarts.
+ */
+
+// newTimestampSource returns the timestamp source of a device without a store.
+func (device *Device) newTimestampSource() *tai64n.Source {
+	source, _ := tai64n.NewSource(nil, device.now)
+	return source
+}
+
+// SetTimestampStore makes the device persist the high-water mark of its
+// handshake timestamps to store, and continue after the mark stored there.
+// A nil store keeps the mark in memory only.
+func (device *Device) SetTimestampStore(store tai64n.Store) error {
+	source, err := tai64n.NewSource(store, device.now)
+	if err != nil {
+		return err
+	}
+	source.Advance(device.timestamps.Load().Last())
+	device.timestamps.Store(source)
+	return nil
+}
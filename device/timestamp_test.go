@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tai64n"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestHandshakeTimestampClockSkew(t *testing.T) {
+	var clocks [2]manualClock
+	var devs [2]*Device
+	states := make(chan HandshakeState, 16)
+	for i := range devs {
+		clocks[i].now.Store(time.Now().UnixNano())
+		opts := []Option{WithClock(&clocks[i])}
+		if i == 1 {
+			opts = append(opts, WithHandshakeStateChan(states))
+		}
+		devs[i] = NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""), opts...)
+		defer devs[i].Close()
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		assertNil(t, devs[i].SetPrivateKey(sk))
+	}
+	peer, err := devs[0].NewPeer(devs[1].staticIdentity.publicKey)
+	assertNil(t, err)
+	peer1, err := devs[1].NewPeer(devs[0].staticIdentity.publicKey)
+	assertNil(t, err)
+	peer.Start()
+	peer1.Start()
+	sub := devs[1].SubscribeHandshakes(0)
+
+	initiate := func() *MessageInitiation {
+		t.Helper()
+		clocks[1].advance(time.Second) // past the flood protection
+		msg, err := devs[0].CreateMessageInitiation(peer)
+		assertNil(t, err)
+		return msg
+	}
+
+	msg := initiate()
+	if devs[1].ConsumeMessageInitiation(msg) == nil {
+		t.Fatal("initiation rejected")
+	}
+
+	// Replays are rejected and reported, but not as failures on the channel
+	// of WithHandshakeStateChan, whose users restart the device on those.
+	clocks[1].advance(time.Second)
+	if devs[1].ConsumeMessageInitiation(msg) != nil {
+		t.Fatal("replayed initiation accepted")
+	}
+	for reported := false; !reported; {
+		select {
+		case event := <-sub.C:
+			reported = event.State == HandshakeRejected && event.Reason == HandshakeFailStaleTimestamp
+		default:
+			t.Fatal("stale timestamp not reported")
+		}
+	}
+	devs[1].UpdateHandshakeState(HandshakeSuccess)
+	for state := range states {
+		if state == HandshakeFail || state == HandshakeRejected {
+			t.Errorf("state %d sent to the handshake state channel", state)
+		}
+		if state == HandshakeSuccess {
+			break
+		}
+	}
+
+	// Timestamps keep increasing when the clock goes backwards.
+	clocks[0].advance(-time.Hour)
+	if devs[1].ConsumeMessageInitiation(initiate()) == nil {
+		t.Fatal("initiation after clock went backwards rejected")
+	}
+
+	// And across restarts with a store.
+	store := tai64n.FileStore(filepath.Join(t.TempDir(), "timestamp"))
+	assertNil(t, devs[0].SetTimestampStore(store))
+	if devs[1].ConsumeMessageInitiation(initiate()) == nil {
+		t.Fatal("initiation with store rejected")
+	}
+	devs[0].timestamps.Store(devs[0].newTimestampSource())
+	if devs[1].ConsumeMessageInitiation(initiate()) != nil {
+		t.Fatal("initiation from restarted source without store accepted")
+	}
+	assertNil(t, devs[0].SetTimestampStore(store))
+	if devs[1].ConsumeMessageInitiation(initiate()) == nil {
+		t.Fatal("initiation from restarted source with store rejected")
+	}
+}
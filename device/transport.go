@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// A BindFactory creates the Bind of a transport, "udp", "tcp" or "tls",
+// when the transport of a device is changed.
+type BindFactory func(transport string, options conn.TLSOptions) (conn.Bind, error)
+
+// A pendingTransport holds the transport settings of a set operation.
+type pendingTransport struct {
+	transport string
+	options   conn.TLSOptions
+}
+
+// defaultBindFactory creates the binds of conn.CreateStdNetBindWithOptions,
+// with the error channel and socket protection of the current bind. It
+// refuses to replace binds that were not created that way, whose hooks it
+// cannot know.
+func (device *Device) defaultBindFactory(transport string, options conn.TLSOptions) (conn.Bind, error) {
+	hooked, ok := device.Bind().(conn.BindHooks)
+	if !ok {
+		return nil, errors.New("the transport of this bind can only be changed with WithBindFactory")
+	}
+	errorChan, protectSocket := hooked.Hooks()
+	return conn.CreateStdNetBindWithOptions(transport, options, &device.log.Logger, errorChan, protectSocket), nil
+}
+
+// Transport returns the transport of the device: "udp", "tcp" or "tls".
+func (device *Device) Transport() string {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	return conn.TransportOf(device.net.bind)
+}
+
+// TLSOptions returns the options of the TLS transport,
+// which are zero when the device uses another transport.
+func (device *Device) TLSOptions() conn.TLSOptions {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	return bindTLSOptions(device.net.bind)
+}
+
+func bindTLSOptions(bind conn.Bind) conn.TLSOptions {
+	if b, ok := bind.(conn.BindTLS); ok && conn.TransportOf(bind) == "tls" {
+		return b.TLSOptions()
+	}
+	return conn.TLSOptions{}
+}
+
+// validateTransport reports whether transport and options can be set.
+func validateTransport(transport string, options conn.TLSOptions) error {
+	switch transport {
+	case "udp", "tcp":
+	case "tls":
+		return options.Validate()
+	default:
+		return fmt.Errorf("unknown transport %q", transport)
+	}
+	return nil
+}
+
+// SetTransport switches the device to transport, "udp", "tcp" or "tls",
+// with options that only apply to TLS. It replaces the Bind of the device
+// with one made by its BindFactory, keeping the peers and their sessions.
+func (device *Device) SetTransport(transport string, options conn.TLSOptions) error {
+	if err := validateTransport(transport, options); err != nil {
+		return err
+	}
+	if transport != "tls" {
+		options = conn.TLSOptions{}
+	}
+	device.net.RLock()
+	unchanged := conn.TransportOf(device.net.bind) == transport && bindTLSOptions(device.net.bind) == options
+	device.net.RUnlock()
+	if unchanged {
+		return nil
+	}
+	bind, err := device.bindFactory(transport, options)
+	if err != nil {
+		return err
+	}
+	return device.swapBind(bind)
+}
+
+// swapBind replaces the Bind of the device with bind, and opens it if the
+// device is up. The endpoints of the peers are parsed anew by bind.
+func (device *Device) swapBind(bind conn.Bind) error {
+	device.net.Lock()
+	if err := closeBindLocked(device); err != nil {
+		device.log.Log(conn.SubsystemBind, conn.LevelError, "Unable to close bind", conn.TransportField(conn.TransportOf(device.net.bind)), conn.ErrorField(err))
+	}
+	device.net.bind = bind
+	device.net.Unlock()
+
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.Lock()
+		if peer.endpoint != nil {
+			endpoint, err := bind.ParseEndpoint(peer.endpoint.DstToString())
+			if err != nil {
+				device.log.Log(conn.SubsystemBind, conn.LevelError, "Unable to parse endpoint for the new bind", conn.PeerField(peer), peer.endpointField(), conn.ErrorField(err))
+			} else {
+				peer.endpoint = endpoint
+			}
+		}
+		peer.Unlock()
+	}
+	device.peers.RUnlock()
+
+	device.log.Log(conn.SubsystemBind, conn.LevelInfo, "Transport changed", conn.TransportField(conn.TransportOf(bind)))
+	return device.BindUpdate()
+}
@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestSetTransport(t *testing.T) {
+	var made []string
+	var device *Device
+	factory := func(transport string, options conn.TLSOptions) (conn.Bind, error) {
+		made = append(made, transport)
+		return device.defaultBindFactory(transport, options)
+	}
+	errs := make(chan error, 1)
+	var protected []int
+	protect := func(fd int) int {
+		protected = append(protected, fd)
+		return 0
+	}
+	logger := NewLogger(LogLevelError, "")
+	device = NewDevice(tuntest.NewChannelTUN().TUN(), conn.CreateStdNetBind("udp", &logger.Logger, errs, protect), logger, WithBindFactory(factory))
+	defer device.Close()
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	device.SetPrivateKey(sk)
+
+	peerKey := randPublicKeyHex(t)
+	assertNil(t, device.IpcSet(uapiCfg(
+		"public_key", peerKey,
+		"endpoint", "192.0.2.1:443",
+	)))
+	var pk NoisePublicKey
+	assertNil(t, pk.FromHex(peerKey))
+	peer := device.LookupPeer(pk)
+
+	hasLines := func(want ...string) {
+		t.Helper()
+		cfg, err := device.IpcGet()
+		assertNil(t, err)
+		for _, line := range want {
+			if !strings.Contains(cfg, line+"\n") {
+				t.Errorf("configuration lacks %q:\n%s", line, cfg)
+			}
+		}
+	}
+	hasLines("transport=udp")
+
+	assertNil(t, device.IpcSet(uapiCfg(
+		"transport", "tls",
+		"tls_server_name", "example.com",
+		"tls_fingerprint", "chrome_120_pq",
+	)))
+	hasLines("transport=tls", "tls_server_name=example.com", "tls_fingerprint=chrome_120_pq")
+	if got := device.Transport(); got != "tls" {
+		t.Errorf("Transport() = %q, want tls", got)
+	}
+	if device.LookupPeer(pk) != peer {
+		t.Fatal("peer recreated by the change of transport")
+	}
+	errorChan, protectSocket := device.Bind().(conn.BindHooks).Hooks()
+	if errorChan != errs {
+		t.Error("error channel not kept by the new bind")
+	}
+	if protectSocket(7); len(protected) != 1 || protected[0] != 7 {
+		t.Errorf("socket protection not kept by the new bind, protected %v", protected)
+	}
+	peer.RLock()
+	endpoint := peer.endpoint
+	peer.RUnlock()
+	if endpoint == nil || endpoint.DstToString() != "192.0.2.1:443" {
+		t.Errorf("endpoint %v not kept", endpoint)
+	}
+
+	// Setting the same transport does not create a bind.
+	assertNil(t, device.IpcSet(uapiCfg("transport", "tls")))
+	if len(made) != 1 {
+		t.Errorf("created binds for %q, want one", made)
+	}
+
+	// Invalid settings are rejected before anything changes.
+	for _, cfg := range []string{
+		uapiCfg("transport", "quic"),
+		uapiCfg("tls_fingerprint", "netscape"),
+	} {
+		if err := device.IpcSet(cfg); err == nil {
+			t.Errorf("%q accepted", cfg)
+		}
+	}
+	hasLines("transport=tls", "tls_fingerprint=chrome_120_pq")
+
+	// A set operation failing does not change the transport.
+	err = device.IpcSet(uapiCfg(
+		"transport", "udp",
+		"public_key", peerKey,
+		"rekey_timeout", "15",
+		"rekey_attempt_time", "10",
+	))
+	if err == nil {
+		t.Error("set with inconsistent peer timers succeeded")
+	}
+	hasLines("transport=tls", "tls_server_name=example.com")
+
+	assertNil(t, device.IpcSet(uapiCfg("transport", "udp")))
+	hasLines("transport=udp")
+	cfg, err := device.IpcGet()
+	assertNil(t, err)
+	if strings.Contains(cfg, "tls_") {
+		t.Errorf("TLS options reported for the udp transport:\n%s", cfg)
+	}
+}
+
+func TestSetTransportUnknownBind(t *testing.T) {
+	device := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer device.Close()
+	if err := device.SetTransport("tcp", conn.TLSOptions{}); err == nil {
+		t.Error("transport of a bind without hooks changed by the default factory")
+	}
+	if got := device.Transport(); got != "udp" {
+		t.Errorf("Transport() = %q, want udp", got)
+	}
+}
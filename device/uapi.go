@@ -13,11 +13,11 @@ import (
 	"io"
 	"net"
 	"net/netip"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/ipc"
 )
 
@@ -89,6 +89,10 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			keyf("private_key", (*[32]byte)(&device.staticIdentity.privateKey))
 		}
 
+		if device.keyRotationGrace != 0 {
+			sendf("key_rotation_grace=%d", device.keyRotationGrace/time.Second)
+		}
+
 		if device.net.port != 0 {
 			sendf("listen_port=%d", device.net.port)
 		}
@@ -97,6 +101,53 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("fwmark=%d", device.net.fwmark)
 		}
 
+		sendf("mtu=%d", device.tun.mtu.Load())
+
+		sendf("broken_roaming=%t", device.net.brokenRoaming)
+
+		sendf("state=%s", device.State())
+
+		for _, prefix := range device.SourceFilter() {
+			sendf("source_filter=%s", prefix.String())
+		}
+		if dropped := device.SourceFilterDropped(); dropped != 0 {
+			sendf("source_filter_dropped=%d", dropped)
+		}
+
+		if size := device.ReplayWindowSize(); size != 0 {
+			sendf("replay_window=%d", size)
+		}
+
+		if t, d := device.ProtocolTimers(), DefaultProtocolTimers(); t != d {
+			for _, k := range timerKeys {
+				sendf("%s=%d", k.key, *k.device(&t)/time.Second)
+			}
+		}
+
+		if p := device.ObfuscationProfile(); p != nil {
+			for _, k := range obfuscationKeys {
+				if n, _ := obfuscationValue(p, k.key); n != 0 {
+					sendf("%s=%d", k.key, n)
+				}
+			}
+		}
+
+		sendf("transport=%s", conn.TransportOf(device.net.bind))
+		if options := bindTLSOptions(device.net.bind); options != (conn.TLSOptions{}) {
+			if options.ServerName != "" {
+				sendf("tls_server_name=%s", options.ServerName)
+			}
+			if options.Fingerprint != "" {
+				sendf("tls_fingerprint=%s", options.Fingerprint)
+			}
+		}
+
+		if c := device.capture.Load(); c != nil && c.name != "" {
+			sendf("capture_snaplen=%d", c.options.Snaplen)
+			sendf("capture_buffer=%d", c.options.BufferPackets)
+			sendf("capture_file=%s", c.name)
+		}
+
 		for _, peer := range device.peers.keyMap {
 			// Serialize peer state.
 			// Do the work in an anonymous function so that we can use defer.
@@ -110,6 +161,9 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 				if peer.endpoint != nil {
 					sendf("endpoint=%s", peer.endpoint.DstToString())
 				}
+				if peer.host != nil {
+					sendf("endpoint_host=%s", peer.host)
+				}
 
 				nano := peer.lastHandshakeNano.Load()
 				secs := nano / time.Second.Nanoseconds()
@@ -120,11 +174,40 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 				sendf("tx_bytes=%d", peer.txBytes.Load())
 				sendf("rx_bytes=%d", peer.rxBytes.Load())
 				sendf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval.Load())
+				if peer.hybrid.Load() {
+					sendf("hybrid_handshake=true")
+				}
+				t := peer.Timers()
+				for _, k := range timerKeys {
+					if k.peer != nil && *k.peer(&t) != 0 {
+						sendf("%s=%d", k.key, *k.peer(&t)/time.Second)
+					}
+				}
+				if expires, ok := peer.Expires(); ok {
+					remaining := expires.Sub(device.now())
+					if remaining < 0 {
+						remaining = 0
+					}
+					sendf("ttl=%d", (remaining+time.Second-1)/time.Second)
+				}
+				if idle := peer.IdleTimeout(); idle != 0 {
+					sendf("idle_timeout=%d", idle/time.Second)
+				}
+				if size := peer.ReplayWindowSize(); size != 0 {
+					sendf("replay_window=%d", size)
+				}
 
 				device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
 					sendf("allowed_ip=%s", prefix.String())
 					return true
 				})
+
+				for _, prefix := range peer.SourceFilter() {
+					sendf("source_filter=%s", prefix.String())
+				}
+				if dropped := peer.SourceFilterDropped(); dropped != 0 {
+					sendf("source_filter_dropped=%d", dropped)
+				}
 			}()
 		}
 	}()
@@ -140,38 +223,143 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 // IpcSetOperation implements the WireGuard configuration protocol "set" operation.
 // See https://www.wireguard.com/xplatform/#configuration-protocol for details.
 func (device *Device) IpcSetOperation(r io.Reader) (err error) {
-	device.ipcMutex.Lock()
-	defer device.ipcMutex.Unlock()
-
 	defer func() {
 		if err != nil {
 			device.log.Errorf("%v", err)
 		}
 	}()
 
-	peer := new(ipcSetPeer)
-	deviceConfig := true
+	lines, err := readIpcSetLines(r)
+	if err != nil {
+		return err
+	}
+	hosts, err := device.resolveIpcHosts(lines)
+	if err != nil {
+		return err
+	}
+	state, saved, err := device.ipcSetConfig(lines, hosts)
+	if err != nil {
+		return err
+	}
+
+	// The state is changed last, without holding ipcMutex, which bringing
+	// the device up takes to start the peers. A device that fails to come
+	// up is left down, and the rest of the operation is undone.
+	switch state {
+	case "up":
+		device.log.Verbosef("UAPI: Bringing the device up")
+		if err := device.Up(); err != nil {
+			device.rollbackIpcState(saved)
+			return ipcErrorf(ipc.IpcErrorPortInUse, "failed to bring the device up: %w", err)
+		}
+	case "down":
+		device.log.Verbosef("UAPI: Bringing the device down")
+		if err := device.Down(); err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, "failed to bring the device down: %w", err)
+		}
+	}
+	return nil
+}
+
+// ipcSetConfig runs the lines of a set operation, with the addresses of its
+// hostname endpoints, and returns the state it requests, if any, and the
+// configuration it replaced.
+func (device *Device) ipcSetConfig(lines []ipcLine, hosts map[string]netip.AddrPort) (string, *ipcState, error) {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	// Validate the whole operation before applying any of it, and restore
+	// the previous configuration if applying it fails midway.
+	staging := &ipcSetter{device: device, staging: true, hosts: hosts}
+	if err := staging.setLines(lines); err != nil {
+		return "", nil, err
+	}
+	state := device.saveIpcState()
+	setter := &ipcSetter{device: device, hosts: hosts, touched: make(map[NoisePublicKey]bool)}
+	err := setter.setLines(lines)
+	state.touched = setter.touched
+	if err != nil {
+		device.log.Verbosef("UAPI: Restoring configuration after failed set operation")
+		device.restoreIpcState(state)
+		return "", nil, err
+	}
+	device.ipcGeneration++
+	state.generation = device.ipcGeneration
+	return setter.state, state, nil
+}
+
+// An ipcSetter runs the lines of a set operation, either staging them, which
+// only checks them, or applying them. A new one is used for each pass, with
+// ipcMutex held, and collects the settings that are applied together.
+type ipcSetter struct {
+	device  *Device
+	staging bool                      // only check the lines, leaving the device as it is
+	hosts   map[string]netip.AddrPort // the addresses of the hostname endpoints
+
+	sourceFilter *[]netip.Prefix     // the device source filter, once changed
+	obfuscation  *ObfuscationProfile // the obfuscation profile, once changed
+	timers       *ProtocolTimers     // the protocol timers, once changed
+	transport    *pendingTransport   // the transport settings, once changed
+	replacePeers bool                // set by replace_peers
+	rotation     *NoisePrivateKey    // the key rotate_private_key rotates to last
+	state        string              // the state requested, "up", "down" or empty
+
+	// touched are the peers the operation configured, added or removed,
+	// which are the only ones restored if it fails.
+	touched map[NoisePublicKey]bool
+
+	// stagedTimers are the protocol timers that the timers of the peers are
+	// checked against while staging.
+	stagedTimers *ProtocolTimers
+}
+
+// An ipcLine is a key=value line of a set operation.
+type ipcLine struct {
+	key, value string
+}
 
+// readIpcSetLines reads the lines of a set operation, up to a blank line or EOF.
+func readIpcSetLines(r io.Reader) ([]ipcLine, error) {
+	var lines []ipcLine
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if line == "" {
 			// Blank line means terminate operation.
-			peer.handlePostConfig()
-			return nil
+			return lines, nil
 		}
 		key, value, ok := strings.Cut(line, "=")
 		if !ok {
-			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q", line)
+			return nil, ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q", line)
 		}
+		lines = append(lines, ipcLine{key, value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, ipcErrorf(ipc.IpcErrorIO, "failed to read input: %w", err)
+	}
+	return lines, nil
+}
+
+// setLines applies the lines of a set operation or, while staging, only checks them.
+func (setter *ipcSetter) setLines(lines []ipcLine) error {
+	device := setter.device
+	peer := new(ipcSetPeer)
+	deviceConfig := true
 
+	for _, line := range lines {
+		key, value := line.key, line.value
 		if key == "public_key" {
 			if deviceConfig {
 				deviceConfig = false
+				if err := setter.commitDeviceSettings(); err != nil {
+					return err
+				}
+			}
+			if err := peer.handlePostConfig(); err != nil {
+				return err
 			}
-			peer.handlePostConfig()
 			// Load/create the peer we are now configuring.
-			err := device.handlePublicKeyLine(peer, value)
+			err := setter.handlePublicKeyLine(peer, value)
 			if err != nil {
 				return err
 			}
@@ -180,44 +368,149 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 
 		var err error
 		if deviceConfig {
-			err = device.handleDeviceLine(key, value)
+			err = setter.handleDeviceLine(key, value)
 		} else {
-			err = device.handlePeerLine(peer, key, value)
+			err = setter.handlePeerLine(peer, key, value)
 		}
 		if err != nil {
 			return err
 		}
 	}
-	peer.handlePostConfig()
+	if err := peer.handlePostConfig(); err != nil {
+		return err
+	}
+	if err := setter.commitDeviceSettings(); err != nil {
+		return err
+	}
 
-	if err := scanner.Err(); err != nil {
-		return ipcErrorf(ipc.IpcErrorIO, "failed to read input: %w", err)
+	// The key is rotated last, once nothing else can fail, so that a failed
+	// operation never has to bring back the key it retired.
+	if sk := setter.rotation; sk != nil && !setter.staging {
+		grace := device.keyRotationGrace
+		if grace == 0 {
+			grace = DefaultKeyRotationGrace
+		}
+		device.log.Verbosef("UAPI: Rotating private key with a grace period of %v", grace)
+		if err := device.RotatePrivateKey(*sk, grace); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to rotate private_key: %w", err)
+		}
 	}
 	return nil
 }
 
-func (device *Device) handleDeviceLine(key, value string) error {
+// commitDeviceSettings applies the source filter, obfuscation, transport and
+// timer settings of the current set operation, and then its replace_peers.
+// The keys of each are applied together, so that they can come in any order,
+// and the peers are only removed once the device settings that may fail
+// have been applied.
+func (setter *ipcSetter) commitDeviceSettings() error {
+	device := setter.device
+	if setter.staging {
+		setter.sourceFilter = nil
+		if p := setter.obfuscation; p != nil {
+			setter.obfuscation = nil
+			if _, err := newObfuscation(*p); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set obfuscation profile: %w", err)
+			}
+		}
+		if t := setter.timers; t != nil {
+			setter.timers = nil
+			err := t.Validate()
+			if err == nil && !setter.replacePeers {
+				device.peers.RLock()
+				err = device.checkProtocolTimersLocked(*t)
+				device.peers.RUnlock()
+			}
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set protocol timers: %w", err)
+			}
+			// The timers of the peers are checked against these.
+			setter.stagedTimers = t
+		}
+		if t := setter.transport; t != nil {
+			setter.transport = nil
+			if err := validateTransport(t.transport, t.options); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set transport: %w", err)
+			}
+		}
+		return nil
+	}
+	if prefixes := setter.sourceFilter; prefixes != nil {
+		setter.sourceFilter = nil
+		device.log.Verbosef("UAPI: Updating source filter")
+		if err := device.SetSourceFilter(*prefixes); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set source filter: %w", err)
+		}
+	}
+	if p := setter.obfuscation; p != nil {
+		setter.obfuscation = nil
+		device.log.Verbosef("UAPI: Updating obfuscation profile")
+		if err := device.SetObfuscationProfile(p); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set obfuscation profile: %w", err)
+		}
+	}
+	if t := setter.transport; t != nil {
+		setter.transport = nil
+		device.log.Verbosef("UAPI: Updating transport")
+		if err := device.SetTransport(t.transport, t.options); err != nil {
+			return ipcErrorf(ipc.IpcErrorPortInUse, "failed to set transport: %w", err)
+		}
+	}
+	if setter.replacePeers {
+		setter.replacePeers = false
+		device.log.Verbosef("UAPI: Removing all peers")
+		device.peers.RLock()
+		for key := range device.peers.keyMap {
+			setter.touched[key] = true
+		}
+		device.peers.RUnlock()
+		device.RemoveAllPeers()
+	}
+	if t := setter.timers; t != nil {
+		setter.timers = nil
+		device.log.Verbosef("UAPI: Updating protocol timers")
+		if err := device.SetProtocolTimers(*t); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set protocol timers: %w", err)
+		}
+	}
+	return nil
+}
+
+func (setter *ipcSetter) handleDeviceLine(key, value string) error {
+	device := setter.device
+	// The value is parsed as UnmarshalUAPI parses it.
+	var line DeviceConfig
+	if err := line.unmarshalLine(key, value); err != nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, "failed to set %s: %w", key, err)
+	}
+
 	switch key {
 	case "private_key":
-		var sk NoisePrivateKey
-		err := sk.FromMaybeZeroHex(value)
-		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set private_key: %w", err)
+		if setter.staging {
+			return nil
 		}
 		device.log.Verbosef("UAPI: Updating private key")
-		device.SetPrivateKey(sk)
+		device.SetPrivateKey(*line.PrivateKey)
+
+	case "key_rotation_grace":
+		if setter.staging {
+			return nil
+		}
+		device.keyRotationGrace = *line.KeyRotationGrace
+
+	case "rotate_private_key":
+		setter.rotation = line.RotatePrivateKey
 
 	case "listen_port":
-		port, err := strconv.ParseUint(value, 10, 16)
-		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse listen_port: %w", err)
+		if setter.staging {
+			return nil
 		}
 
 		// update port and rebind
 		device.log.Verbosef("UAPI: Updating listen port")
 
 		device.net.Lock()
-		device.net.port = uint16(port)
+		device.net.port = *line.ListenPort
 		device.net.Unlock()
 
 		if err := device.BindUpdate(); err != nil {
@@ -225,25 +518,132 @@ func (device *Device) handleDeviceLine(key, value string) error {
 		}
 
 	case "fwmark":
-		mark, err := strconv.ParseUint(value, 10, 32)
-		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "invalid fwmark: %w", err)
+		if setter.staging {
+			return nil
 		}
 
 		device.log.Verbosef("UAPI: Updating fwmark")
-		if err := device.BindSetMark(uint32(mark)); err != nil {
+		if err := device.BindSetMark(*line.FirewallMark); err != nil {
 			return ipcErrorf(ipc.IpcErrorPortInUse, "failed to update fwmark: %w", err)
 		}
 
-	case "replace_peers":
-		if value != "true" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set replace_peers, invalid value: %v", value)
+	case "replace_source_filter":
+		setter.sourceFilter = new([]netip.Prefix)
+
+	case "source_filter":
+		if setter.sourceFilter == nil {
+			prefixes := device.SourceFilter()
+			setter.sourceFilter = &prefixes
 		}
-		device.log.Verbosef("UAPI: Removing all peers")
-		device.RemoveAllPeers()
+		*setter.sourceFilter = append(*setter.sourceFilter, line.SourceFilter...)
+
+	case "replay_window":
+		if setter.staging {
+			return nil
+		}
+		device.log.Verbosef("UAPI: Updating replay window size")
+		device.SetReplayWindowSize(*line.ReplayWindow)
+
+	case "capture_snaplen":
+		if setter.staging {
+			return nil
+		}
+		device.captureOptions.Snaplen = line.Capture.Options.Snaplen
+
+	case "capture_buffer":
+		if setter.staging {
+			return nil
+		}
+		device.captureOptions.BufferPackets = line.Capture.Options.BufferPackets
+
+	case "capture_file":
+		if value != "" {
+			if err := device.checkCaptureName(value); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set capture_file: %w", err)
+			}
+		}
+		if setter.staging {
+			return nil
+		}
+		if value == "" {
+			device.log.Verbosef("UAPI: Stopping packet capture")
+			device.StopCapture()
+			return nil
+		}
+		device.log.Verbosef("UAPI: Starting packet capture")
+		if err := device.startCaptureInDir(value, device.captureOptions); err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, "failed to set capture_file: %w", err)
+		}
+
+	case "transport", "tls_server_name", "tls_fingerprint":
+		if setter.transport == nil {
+			device.net.RLock()
+			setter.transport = &pendingTransport{
+				transport: conn.TransportOf(device.net.bind),
+				options:   bindTLSOptions(device.net.bind),
+			}
+			device.net.RUnlock()
+		}
+		t := setter.transport
+		switch key {
+		case "transport":
+			t.transport = line.Transport
+		case "tls_server_name":
+			t.options.ServerName = line.TLS.ServerName
+		case "tls_fingerprint":
+			t.options.Fingerprint = line.TLS.Fingerprint
+		}
+
+	case "broken_roaming":
+		if setter.staging {
+			return nil
+		}
+		device.log.Verbosef("UAPI: Updating roaming of peers")
+		device.setBrokenRoaming(*line.BrokenRoaming)
+
+	case "state":
+		if line.State != "up" && line.State != "down" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set state, invalid value: %v", value)
+		}
+		if setter.staging {
+			return nil
+		}
+		setter.state = line.State
+
+	case "mtu":
+		// Reported by get operations, and accepted unchanged so that their
+		// output can be set again. The MTU is set on the TUN device.
+		if current := int(device.tun.mtu.Load()); line.MTU != current {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set mtu %d: the MTU of the TUN device is %d", line.MTU, current)
+		}
+
+	case "source_filter_dropped":
+		// Reported by get operations, and ignored so that their output can
+		// be set again.
+
+	case "replace_peers":
+		setter.replacePeers = true
 
 	default:
-		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI device key: %v", key)
+		// The protocol timers and the obfuscation profile, whose keys are
+		// in tables, are collected and applied by commitDeviceSettings.
+		if t := line.ProtocolTimers; t != nil {
+			if setter.timers == nil {
+				t := device.ProtocolTimers()
+				setter.timers = &t
+			}
+			*deviceTimer(setter.timers, key) = *deviceTimer(t, key)
+		}
+		if p := line.Obfuscation; p != nil {
+			if setter.obfuscation == nil {
+				setter.obfuscation = device.ObfuscationProfile()
+				if setter.obfuscation == nil {
+					setter.obfuscation = new(ObfuscationProfile)
+				}
+			}
+			n, _ := obfuscationValue(p, key)
+			setObfuscationValue(setter.obfuscation, key, uint32(n))
+		}
 	}
 
 	return nil
@@ -251,15 +651,42 @@ func (device *Device) handleDeviceLine(key, value string) error {
 
 // An ipcSetPeer is the current state of an IPC set operation on a peer.
 type ipcSetPeer struct {
-	*Peer        // Peer is the current peer being operated on
-	dummy   bool // dummy reports whether this peer is a temporary, placeholder peer
-	created bool // new reports whether this is a newly created peer
-	pkaOn   bool // pkaOn reports whether the peer had the persistent keepalive turn on
+	*Peer               // Peer is the current peer being operated on
+	dummy   bool        // dummy reports whether this peer is a temporary, placeholder peer
+	created bool        // new reports whether this is a newly created peer
+	pkaOn   bool        // pkaOn reports whether the peer had the persistent keepalive turn on
+	timers  *PeerTimers // timers holds the timer overrides set for the peer, if any
+
+	// staged holds the protocol timers of the device while the operation is
+	// staged, which the timers set for the peer are checked against.
+	staged *ProtocolTimers
+
+	// sourceFilter holds the source filter of the peer once changed, which
+	// replaces the current one at once when the peer is configured.
+	sourceFilter *[]netip.Prefix
 }
 
-func (peer *ipcSetPeer) handlePostConfig() {
+func (peer *ipcSetPeer) handlePostConfig() error {
+	timers, sourceFilter := peer.timers, peer.sourceFilter
+	peer.timers, peer.sourceFilter = nil, nil
+	if staged := peer.staged; staged != nil && timers != nil {
+		if err := staged.withPeer(timers).Validate(); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set protocol timers of peer: %w", err)
+		}
+	}
 	if peer.Peer == nil || peer.dummy {
-		return
+		return nil
+	}
+	if t := timers; t != nil {
+		if err := peer.SetTimers(*t); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set protocol timers of %v: %w", peer.Peer, err)
+		}
+	}
+	if prefixes := sourceFilter; prefixes != nil {
+		peer.device.log.Verbosef("%v - UAPI: Updating source filter", peer.Peer)
+		if err := peer.SetSourceFilter(*prefixes); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set source filter of %v: %w", peer.Peer, err)
+		}
 	}
 	if peer.created {
 		peer.disableRoaming = peer.device.net.brokenRoaming && peer.endpoint != nil
@@ -271,9 +698,11 @@ func (peer *ipcSetPeer) handlePostConfig() {
 		}
 		peer.SendStagedPackets()
 	}
+	return nil
 }
 
-func (device *Device) handlePublicKeyLine(peer *ipcSetPeer, value string) error {
+func (setter *ipcSetter) handlePublicKeyLine(peer *ipcSetPeer, value string) error {
+	device := setter.device
 	// Load/create the peer we are configuring.
 	var publicKey NoisePublicKey
 	err := publicKey.FromHex(value)
@@ -281,6 +710,26 @@ func (device *Device) handlePublicKeyLine(peer *ipcSetPeer, value string) error
 		return ipcErrorf(ipc.IpcErrorInvalid, "failed to get peer by public key: %w", err)
 	}
 
+	// Only check the lines of the peer while staging, with the timer
+	// overrides it has unless the operation replaces the peers.
+	if setter.staging {
+		peer.Peer = &Peer{}
+		peer.dummy = true
+		existing := device.LookupPeer(publicKey)
+		peer.created = existing == nil || setter.replacePeers
+		if !peer.created {
+			peer.timerOverrides.Store(existing.timerOverrides.Load())
+		}
+		staged := device.ProtocolTimers()
+		if setter.stagedTimers != nil {
+			staged = *setter.stagedTimers
+		}
+		peer.staged = &staged
+		return nil
+	}
+	peer.staged = nil
+	setter.touched[publicKey] = true
+
 	// Ignore peer with the same public key as this device.
 	device.staticIdentity.RLock()
 	peer.dummy = device.staticIdentity.publicKey.Equals(publicKey)
@@ -303,70 +752,111 @@ func (device *Device) handlePublicKeyLine(peer *ipcSetPeer, value string) error
 	return nil
 }
 
-func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error {
+func (setter *ipcSetter) handlePeerLine(peer *ipcSetPeer, key, value string) error {
+	device := setter.device
+	// The value is parsed as UnmarshalUAPI parses it.
+	var line PeerConfig
+	if err := line.unmarshalLine(key, value); err != nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, "failed to set %s of peer: %w", key, err)
+	}
+
 	switch key {
 	case "update_only":
 		// allow disabling of creation
-		if value != "true" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set update only, invalid value: %v", value)
-		}
 		if peer.created && !peer.dummy {
 			device.RemovePeer(peer.handshake.remoteStatic)
 			peer.Peer = &Peer{}
 			peer.dummy = true
 		}
+		if peer.created {
+			peer.staged = nil
+		}
 
 	case "remove":
 		// remove currently selected peer from device
-		if value != "true" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set remove, invalid value: %v", value)
-		}
 		if !peer.dummy {
 			device.log.Verbosef("%v - UAPI: Removing", peer.Peer)
 			device.RemovePeer(peer.handshake.remoteStatic)
 		}
 		peer.Peer = &Peer{}
 		peer.dummy = true
+		peer.staged = nil
 
 	case "preshared_key":
 		device.log.Verbosef("%v - UAPI: Updating preshared key", peer.Peer)
 
 		peer.handshake.mutex.Lock()
-		err := peer.handshake.presharedKey.FromHex(value)
+		peer.handshake.presharedKey = *line.PresharedKey
 		peer.handshake.mutex.Unlock()
 
-		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set preshared key: %w", err)
-		}
-
-	case "endpoint":
+	case "endpoint", "endpoint_host":
 		device.log.Verbosef("%v - UAPI: Updating endpoint", peer.Peer)
-		endpoint, err := device.net.bind.ParseEndpoint(value)
+		var endpoint conn.Endpoint
+		var err error
+		host := parseHostEndpoint(value)
+		switch {
+		case host != nil:
+			if setter.staging || peer.dummy {
+				return nil
+			}
+			// The hostname was resolved before the operation began.
+			endpoint, err = device.net.bind.ParseEndpoint(setter.hosts[value].String())
+			host.lookedUp.Store(device.now().UnixNano())
+		case key == "endpoint" && (setter.staging || peer.dummy):
+			// Binds may keep the endpoints they parse, so one that is
+			// not set is only checked.
+			if _, err := netip.ParseAddrPort(value); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set endpoint %v: %w", value, err)
+			}
+			return nil
+		case key == "endpoint":
+			endpoint, err = device.net.bind.ParseEndpoint(value)
+		default:
+			err = errors.New("not a hostname and port")
+		}
 		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set endpoint %v: %w", value, err)
 		}
 		peer.Lock()
-		defer peer.Unlock()
-		peer.endpoint = endpoint
+		peer.host = host
+		changed := peer.setEndpointLocked(endpoint)
+		peer.Unlock()
+		if changed && !peer.dummy {
+			peer.notifyEndpointChanged(endpoint)
+		}
 
-	case "persistent_keepalive_interval":
-		device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
+	case "replay_window":
+		if peer.dummy {
+			return nil
+		}
+		device.log.Verbosef("%v - UAPI: Updating replay window size", peer.Peer)
+		peer.SetReplayWindowSize(*line.ReplayWindow)
 
-		secs, err := strconv.ParseUint(value, 10, 16)
-		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set persistent keepalive interval: %w", err)
+	case "ttl":
+		if peer.dummy {
+			return nil
 		}
+		device.log.Verbosef("%v - UAPI: Setting TTL to %v", peer.Peer, *line.TTL)
+		peer.SetTTL(*line.TTL)
+
+	case "idle_timeout":
+		if peer.dummy {
+			return nil
+		}
+		device.log.Verbosef("%v - UAPI: Setting idle timeout to %v", peer.Peer, *line.IdleTimeout)
+		peer.SetIdleTimeout(*line.IdleTimeout)
+
+	case "persistent_keepalive_interval":
+		device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
 
-		old := peer.persistentKeepaliveInterval.Swap(uint32(secs))
+		secs := uint32(*line.PersistentKeepaliveInterval)
+		old := peer.persistentKeepaliveInterval.Swap(secs)
 
 		// Send immediate keepalive if we're turning it on and before it wasn't on.
 		peer.pkaOn = old == 0 && secs != 0
 
 	case "replace_allowed_ips":
 		device.log.Verbosef("%v - UAPI: Removing all allowedips", peer.Peer)
-		if value != "true" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to replace allowedips, invalid value: %v", value)
-		}
 		if peer.dummy {
 			return nil
 		}
@@ -374,22 +864,44 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 
 	case "allowed_ip":
 		device.log.Verbosef("%v - UAPI: Adding allowedip", peer.Peer)
-		prefix, err := netip.ParsePrefix(value)
-		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set allowed ip: %w", err)
-		}
 		if peer.dummy {
 			return nil
 		}
-		device.allowedips.Insert(prefix, peer.Peer)
+		device.allowedips.Insert(line.AllowedIPs[0], peer.Peer)
 
-	case "protocol_version":
-		if value != "1" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "invalid protocol version: %v", value)
+	case "hybrid_handshake":
+		device.log.Verbosef("%v - UAPI: Updating hybrid handshake", peer.Peer)
+		if err := peer.SetHybridHandshake(*line.HybridHandshake); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set hybrid_handshake: %w", err)
 		}
 
+	case "replace_source_filter":
+		device.log.Verbosef("%v - UAPI: Removing source filter", peer.Peer)
+		peer.sourceFilter = new([]netip.Prefix)
+
+	case "source_filter":
+		device.log.Verbosef("%v - UAPI: Adding source filter prefix", peer.Peer)
+		if peer.sourceFilter == nil {
+			prefixes := peer.SourceFilter()
+			peer.sourceFilter = &prefixes
+		}
+		*peer.sourceFilter = append(*peer.sourceFilter, line.SourceFilter...)
+
+	case "protocol_version", "last_handshake_time_sec", "last_handshake_time_nsec", "tx_bytes", "rx_bytes", "source_filter_dropped":
+		// Only checked, or reported by get operations and ignored so that
+		// their output can be set again.
+
 	default:
-		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI peer key: %v", key)
+		// The timer overrides, whose keys are in a table, are applied by
+		// handlePostConfig.
+		if peer.dummy && peer.staged == nil {
+			return nil
+		}
+		if peer.timers == nil {
+			t := peer.Timers()
+			peer.timers = &t
+		}
+		*peerTimer(peer.timers, key) = *peerTimer(line.Timers, key)
 	}
 
 	return nil
@@ -407,6 +919,66 @@ func (device *Device) IpcSet(uapiConf string) error {
 	return device.IpcSetOperation(strings.NewReader(uapiConf))
 }
 
+// ipcWatchOperation streams the events of the device to rw, one line of
+// space-separated key=value pairs per event, until the client closes the
+// connection or the device is closed. It then ends the stream with errno=0.
+// A watch is the last operation on a connection.
+func (device *Device) ipcWatchOperation(rw *bufio.ReadWriter) {
+	sub := device.SubscribeEvents(0)
+	defer sub.Close()
+
+	// Anything the client sends, and the end of the connection, ends the watch.
+	hangup := make(chan struct{})
+	go func() {
+		rw.Reader.ReadByte()
+		close(hangup)
+	}()
+
+	var dropped uint64
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				fmt.Fprintf(rw, "errno=0\n\n")
+				rw.Flush()
+				return
+			}
+			if n := sub.Dropped(); n != dropped {
+				fmt.Fprintf(rw, "event=overflow dropped=%d\n", n-dropped)
+				dropped = n
+			}
+			if _, err := rw.WriteString(formatIpcEvent(event)); err != nil {
+				return
+			}
+			if err := rw.Flush(); err != nil {
+				return
+			}
+		case <-hangup:
+			return
+		}
+	}
+}
+
+// formatIpcEvent formats event as a line of the watch operation.
+func formatIpcEvent(event Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "event=%s time_sec=%d time_nsec=%d", event.Kind, event.Time.Unix(), event.Time.Nanosecond())
+	if !event.PublicKey.IsZero() {
+		fmt.Fprintf(&b, " public_key=%x", event.PublicKey[:])
+	}
+	if event.Endpoint != "" {
+		fmt.Fprintf(&b, " endpoint=%s", event.Endpoint)
+	}
+	if event.Reason != "" {
+		fmt.Fprintf(&b, " reason=%s", event.Reason)
+	}
+	if event.State != "" {
+		fmt.Fprintf(&b, " state=%s", event.State)
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
 func (device *Device) IpcHandle(socket net.Conn) {
 	defer socket.Close()
 
@@ -416,6 +988,8 @@ func (device *Device) IpcHandle(socket net.Conn) {
 		return bufio.NewReadWriter(reader, writer)
 	}(socket)
 
+	readOnly := ipc.ConnAccess(socket) != ipc.AccessReadWrite
+
 	for {
 		op, err := buffered.ReadString('\n')
 		if err != nil {
@@ -425,6 +999,13 @@ func (device *Device) IpcHandle(socket net.Conn) {
 		// handle operation
 		switch op {
 		case "set=1\n":
+			if readOnly {
+				// Consume the operation to stay in step with the client.
+				if _, err = readIpcSetLines(buffered.Reader); err == nil {
+					err = ipcErrorf(ipc.IpcErrorDenied, "set operation on a read-only connection")
+				}
+				break
+			}
 			err = device.IpcSetOperation(buffered.Reader)
 		case "get=1\n":
 			var nextByte byte
@@ -437,6 +1018,18 @@ func (device *Device) IpcHandle(socket net.Conn) {
 				break
 			}
 			err = device.IpcGetOperation(buffered.Writer)
+		case "watch=1\n":
+			var nextByte byte
+			nextByte, err = buffered.ReadByte()
+			if err != nil {
+				return
+			}
+			if nextByte != '\n' {
+				err = ipcErrorf(ipc.IpcErrorInvalid, "trailing character in UAPI watch: %q", nextByte)
+				break
+			}
+			device.ipcWatchOperation(buffered)
+			return
 		default:
 			device.log.Errorf("invalid UAPI operation: %v", op)
 			return
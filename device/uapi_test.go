@@ -0,0 +1,210 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// newDownDevice returns a device that only changes state through Up, Down
+// and set operations.
+func newDownDevice(t *testing.T) *Device {
+	t.Helper()
+	tun := tuntest.NewChannelTUN()
+	<-tun.TUN().Events() // the initial EventUp
+	device := NewDevice(tun.TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""))
+	t.Cleanup(device.Close)
+	return device
+}
+
+// withoutPort removes the listen port, which differs between devices that are up.
+func withoutPort(cfg string) string {
+	return regexp.MustCompile(`(?m)^listen_port=.*\n`).ReplaceAllString(cfg, "")
+}
+
+func TestIpcGetSetRoundTrip(t *testing.T) {
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	roaming, other := randPublicKeyHex(t), randPublicKeyHex(t)
+
+	dev := newDownDevice(t)
+	assertNil(t, dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"key_rotation_grace", "60",
+		"source_filter", "10.0.0.0/8",
+		"replay_window", "100000",
+		"keepalive_timeout", "20",
+		"obfuscation_initiation_type", "7",
+		"obfuscation_junk_max", "16",
+		"broken_roaming", "true",
+		"state", "up",
+		"public_key", roaming,
+		"endpoint", "127.0.0.1:51820",
+		"allowed_ip", "10.1.0.0/16",
+		"persistent_keepalive_interval", "25",
+		"rekey_timeout", "10",
+		"replay_window", "200000",
+		"idle_timeout", "3600",
+		"source_filter", "10.1.2.0/24",
+		"public_key", other,
+		"allowed_ip", "fd00::/64",
+	)))
+	cfg, err := dev.IpcGet()
+	assertNil(t, err)
+	for _, line := range []string{"mtu=1420", "broken_roaming=true", "state=up", "transport=udp"} {
+		if !strings.Contains(cfg, line+"\n") {
+			t.Errorf("configuration lacks %q:\n%s", line, cfg)
+		}
+	}
+
+	// The output of get, statistics included, configures another device
+	// the same way.
+	copied := newDownDevice(t)
+	assertNil(t, copied.IpcSet(withoutPort(cfg)))
+	if got, want := withoutPort(ipcConfig(t, copied)), withoutPort(ipcConfig(t, dev)); got != want {
+		t.Errorf("round trip gave\n%s\nwant\n%s", got, want)
+	}
+	var pk NoisePublicKey
+	assertNil(t, pk.FromHex(roaming))
+	peer := copied.LookupPeer(pk)
+	peer.RLock()
+	disableRoaming := peer.disableRoaming
+	peer.RUnlock()
+	if !disableRoaming {
+		t.Error("roaming enabled for a peer with an endpoint")
+	}
+
+	// So does it once the device is down, with roaming enabled again.
+	assertNil(t, dev.IpcSet(uapiCfg("broken_roaming", "false", "state", "down")))
+	if state := dev.State(); state != "down" {
+		t.Fatalf("State() = %q after state=down", state)
+	}
+	cfg, err = dev.IpcGet()
+	assertNil(t, err)
+	assertNil(t, copied.IpcSet(withoutPort(cfg)))
+	if got, want := withoutPort(ipcConfig(t, copied)), withoutPort(ipcConfig(t, dev)); got != want {
+		t.Errorf("round trip gave\n%s\nwant\n%s", got, want)
+	}
+	if state := copied.State(); state != "down" {
+		t.Errorf("State() = %q, want down", state)
+	}
+	peer.RLock()
+	disableRoaming = peer.disableRoaming
+	peer.RUnlock()
+	if disableRoaming {
+		t.Error("roaming still disabled")
+	}
+
+	for _, cfg := range []string{
+		uapiCfg("state", "closed"),
+		uapiCfg("broken_roaming", "maybe"),
+		uapiCfg("mtu", "large"),
+		uapiCfg("mtu", "1280"),
+		uapiCfg("public_key", other, "tx_bytes", "-1"),
+	} {
+		if err := dev.IpcSet(cfg); err == nil {
+			t.Errorf("%q accepted", cfg)
+		}
+	}
+}
+
+func TestIpcSetUpFailure(t *testing.T) {
+	dev := newDownDevice(t)
+	before := ipcConfig(t, dev)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The listen port is only bound once the device comes up.
+	err = dev.IpcSet(uapiCfg(
+		"listen_port", strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port),
+		"state", "up",
+		"public_key", randPublicKeyHex(t),
+		"allowed_ip", "10.0.0.0/8",
+	))
+	if err == nil {
+		t.Fatal("set bringing the device up on a port in use succeeded")
+	}
+	if state := dev.State(); state != "down" {
+		t.Errorf("State() = %q after failing to come up", state)
+	}
+	if after := ipcConfig(t, dev); after != before {
+		t.Errorf("configuration not restored from\n%s\nto\n%s", after, before)
+	}
+}
+
+func TestIpcCapture(t *testing.T) {
+	dir := t.TempDir()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""), WithCaptureDir(dir))
+	defer dev.Close()
+	setInvalid := func(cfg string) {
+		t.Helper()
+		var ipcErr *IPCError
+		if err := dev.IpcSet(cfg); !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != ipc.IpcErrorInvalid {
+			t.Errorf("set of %q: got %v, want an invalid argument error", cfg, err)
+		}
+	}
+
+	assertNil(t, dev.IpcSet(uapiCfg(
+		"capture_snaplen", "64",
+		"capture_buffer", "16",
+		"capture_file", "wg.pcapng",
+	)))
+	if _, err := os.Stat(filepath.Join(dir, "wg.pcapng")); err != nil {
+		t.Errorf("capture not written to the capture directory: %v", err)
+	}
+	const running = "capture_snaplen=64\ncapture_buffer=16\ncapture_file=wg.pcapng\n"
+	if cfg := ipcConfig(t, dev); !strings.Contains(cfg, running) {
+		t.Errorf("running capture not reported in\n%s", cfg)
+	}
+
+	// Captures are only written directly in the capture directory.
+	outside := filepath.Join(t.TempDir(), "wg.pcapng")
+	for _, name := range []string{outside, "../wg.pcapng", "sub/wg.pcapng", ".", ".."} {
+		setInvalid(uapiCfg("capture_file", name))
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Errorf("capture written outside the capture directory: %v", err)
+	}
+
+	// Nor through a symbolic link in it.
+	assertNil(t, os.WriteFile(outside, []byte("keep"), 0o600))
+	if err := os.Symlink(outside, filepath.Join(dir, "link.pcapng")); err != nil {
+		t.Logf("not checking symbolic links: %v", err)
+	} else if err := dev.IpcSet(uapiCfg("capture_file", "link.pcapng")); err == nil {
+		t.Error("capture started through a symbolic link")
+	}
+	if b, err := os.ReadFile(outside); err != nil || string(b) != "keep" {
+		t.Errorf("file outside the capture directory changed to %q (%v)", b, err)
+	}
+	if cfg := ipcConfig(t, dev); !strings.Contains(cfg, running) {
+		t.Errorf("refused capture stopped the running one:\n%s", cfg)
+	}
+
+	assertNil(t, dev.IpcSet(uapiCfg("capture_file", "")))
+	if cfg := ipcConfig(t, dev); strings.Contains(cfg, "capture_file") {
+		t.Errorf("stopped capture still reported in\n%s", cfg)
+	}
+
+	// Without a capture directory, captures can only be stopped.
+	dev = newDownDevice(t)
+	setInvalid(uapiCfg("capture_file", "wg.pcapng"))
+	assertNil(t, dev.IpcSet(uapiCfg("capture_file", "")))
+}
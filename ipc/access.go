@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// An Access is what a UAPI client may do.
+type Access int
+
+const (
+	AccessNone      Access = iota // the connection is refused
+	AccessReadOnly                // only get and watch operations
+	AccessReadWrite               // all operations
+)
+
+func (access Access) String() string {
+	switch access {
+	case AccessNone:
+		return "none"
+	case AccessReadOnly:
+		return "read-only"
+	case AccessReadWrite:
+		return "read-write"
+	default:
+		return fmt.Sprintf("Access(%d)", int(access))
+	}
+}
+
+// Credentials identify the process at the other end of a UAPI connection.
+type Credentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// An AccessPolicy decides what UAPI clients may do from their credentials.
+//
+// Root and the user running the process have read-write access. Other
+// clients have read-write access if their UID or GID is in UIDs or GIDs,
+// read-only access if it is in ReadOnlyUIDs or ReadOnlyGIDs, and are
+// refused otherwise.
+type AccessPolicy struct {
+	UIDs         []uint32
+	GIDs         []uint32
+	ReadOnlyUIDs []uint32
+	ReadOnlyGIDs []uint32
+
+	// Logf, if set, logs the refused and read-only connections.
+	Logf func(format string, args ...any)
+}
+
+// Access returns the access of a client with credentials cred.
+func (policy *AccessPolicy) Access(cred Credentials) Access {
+	switch {
+	case cred.UID == 0 || cred.UID == uint32(os.Geteuid()):
+		return AccessReadWrite
+	case contains(policy.UIDs, cred.UID) || contains(policy.GIDs, cred.GID):
+		return AccessReadWrite
+	case contains(policy.ReadOnlyUIDs, cred.UID) || contains(policy.ReadOnlyGIDs, cred.GID):
+		return AccessReadOnly
+	}
+	return AccessNone
+}
+
+func contains(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *AccessPolicy) logf(format string, args ...any) {
+	if policy.Logf != nil {
+		policy.Logf(format, args...)
+	}
+}
+
+// accessConn is a connection with limited access.
+type accessConn struct {
+	net.Conn
+	access Access
+}
+
+func (conn *accessConn) Access() Access {
+	return conn.access
+}
+
+// LimitAccess returns conn granting only access, as reported by ConnAccess.
+func LimitAccess(conn net.Conn, access Access) net.Conn {
+	return &accessConn{conn, access}
+}
+
+// ConnAccess returns the access granted by conn: what LimitAccess limited it
+// to, or read-write access for connections accepted without a policy.
+func ConnAccess(conn net.Conn) Access {
+	if c, ok := conn.(interface{ Access() Access }); ok {
+		return c.Access()
+	}
+	return AccessReadWrite
+}
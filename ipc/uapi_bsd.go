@@ -53,6 +53,23 @@ func (l *UAPIListener) Addr() net.Addr {
 	return l.listener.Addr()
 }
 
+// UAPIListenWithPolicy is UAPIListen with an access policy,
+// which is only supported on Linux.
+func UAPIListenWithPolicy(name string, file *os.File, policy *AccessPolicy) (net.Listener, error) {
+	if err := checkPolicy(policy); err != nil {
+		return nil, err
+	}
+	return UAPIListen(name, file)
+}
+
+// checkPolicy refuses access policies, which are not supported here.
+func checkPolicy(policy *AccessPolicy) error {
+	if policy != nil {
+		return errors.New("UAPI access policies are not supported on this platform")
+	}
+	return nil
+}
+
 func UAPIListen(name string, file *os.File) (net.Listener, error) {
 	// wrap file in listener
 
@@ -12,4 +12,5 @@ const (
 	IpcErrorPortInUse = 3
 	IpcErrorUnknown   = 4
 	IpcErrorProtocol  = 5
+	IpcErrorDenied    = 6
 )
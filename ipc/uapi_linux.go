@@ -6,6 +6,7 @@
 package ipc
 
 import (
+	"errors"
 	"net"
 	"os"
 
@@ -19,6 +20,7 @@ type UAPIListener struct {
 	connErr         chan error
 	inotifyFd       int
 	inotifyRWCancel *rwcancel.RWCancel
+	policy          *AccessPolicy
 }
 
 func (l *UAPIListener) Accept() (net.Conn, error) {
@@ -51,6 +53,14 @@ func (l *UAPIListener) Addr() net.Addr {
 }
 
 func UAPIListen(name string, file *os.File) (net.Listener, error) {
+	return UAPIListenWithPolicy(name, file, nil)
+}
+
+// UAPIListenWithPolicy is UAPIListen with the access of each client decided
+// by policy from its SO_PEERCRED credentials. Refused clients are
+// disconnected, and read-only ones are limited with LimitAccess. A nil
+// policy grants read-write access to anyone who can connect.
+func UAPIListenWithPolicy(name string, file *os.File, policy *AccessPolicy) (net.Listener, error) {
 	// wrap file in listener
 
 	listener, err := net.FileListener(file)
@@ -66,6 +76,7 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 		listener: listener,
 		connNew:  make(chan net.Conn, 1),
 		connErr:  make(chan error, 1),
+		policy:   policy,
 	}
 
 	// watch for deletion of socket
@@ -121,9 +132,65 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 				l.connErr <- err
 				break
 			}
+			if l.policy != nil {
+				if conn = l.authorize(conn); conn == nil {
+					continue
+				}
+			}
 			l.connNew <- conn
 		}
 	}(uapi)
 
 	return uapi, nil
 }
+
+// checkPolicy reports whether policy can be used, which any policy can here.
+func checkPolicy(policy *AccessPolicy) error {
+	return nil
+}
+
+// authorize applies the policy of the listener to conn. It returns conn,
+// limited to read-only access if need be, or nil if conn was refused.
+func (l *UAPIListener) authorize(conn net.Conn) net.Conn {
+	cred, err := PeerCredentials(conn)
+	if err != nil {
+		l.policy.logf("UAPI: Refusing connection without credentials: %v", err)
+		conn.Close()
+		return nil
+	}
+	switch access := l.policy.Access(cred); access {
+	case AccessReadWrite:
+		return conn
+	case AccessReadOnly:
+		l.policy.logf("UAPI: Read-only connection from pid %d, uid %d, gid %d", cred.PID, cred.UID, cred.GID)
+		return LimitAccess(conn, access)
+	default:
+		l.policy.logf("UAPI: Refusing connection from pid %d, uid %d, gid %d", cred.PID, cred.UID, cred.GID)
+		conn.Close()
+		return nil
+	}
+}
+
+// PeerCredentials returns the SO_PEERCRED credentials of a unix socket connection.
+func PeerCredentials(conn net.Conn) (Credentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return Credentials{}, errors.New("not a unix socket")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return Credentials{}, err
+	}
+	var ucred *unix.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+	if credErr != nil {
+		return Credentials{}, credErr
+	}
+	return Credentials{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
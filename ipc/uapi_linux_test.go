@@ -0,0 +1,179 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketPair returns the two ends of a connected unix socket pair.
+func socketPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]net.Conn
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		conns[i], err = net.FileConn(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conns[i].Close() })
+	}
+	return conns[0], conns[1]
+}
+
+func TestPeerCredentials(t *testing.T) {
+	conn, _ := socketPair(t)
+	cred, err := PeerCredentials(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Credentials{PID: int32(os.Getpid()), UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}
+	if cred != want {
+		t.Errorf("PeerCredentials() = %+v, want %+v", cred, want)
+	}
+
+	// The owner of the process has read-write access under any policy.
+	var logged []string
+	l := &UAPIListener{policy: &AccessPolicy{Logf: func(format string, args ...any) {
+		logged = append(logged, format)
+	}}}
+	if got := l.authorize(conn); got != conn || ConnAccess(got) != AccessReadWrite {
+		t.Errorf("authorize() = %v with access %v, want the connection with read-write access", got, ConnAccess(got))
+	}
+	if len(logged) != 0 {
+		t.Errorf("logged %q for an allowed connection", logged)
+	}
+
+	if _, err := PeerCredentials(LimitAccess(conn, AccessReadOnly)); err == nil {
+		t.Error("PeerCredentials() of a wrapped connection succeeded")
+	}
+}
+
+func TestAccessPolicy(t *testing.T) {
+	other := uint32(os.Geteuid()) + 1000
+	policy := &AccessPolicy{
+		UIDs:         []uint32{other},
+		GIDs:         []uint32{100},
+		ReadOnlyUIDs: []uint32{other + 1},
+		ReadOnlyGIDs: []uint32{200},
+	}
+	for _, test := range []struct {
+		cred Credentials
+		want Access
+	}{
+		{Credentials{UID: 0, GID: 0}, AccessReadWrite},
+		{Credentials{UID: uint32(os.Geteuid()), GID: 999}, AccessReadWrite},
+		{Credentials{UID: other, GID: 999}, AccessReadWrite},
+		{Credentials{UID: other + 2, GID: 100}, AccessReadWrite},
+		{Credentials{UID: other + 1, GID: 999}, AccessReadOnly},
+		{Credentials{UID: other + 2, GID: 200}, AccessReadOnly},
+		{Credentials{UID: other + 2, GID: 999}, AccessNone},
+	} {
+		if got := policy.Access(test.cred); got != test.want {
+			t.Errorf("Access(%+v) = %v, want %v", test.cred, got, test.want)
+		}
+	}
+}
+
+// TestUAPIOpenWithPolicy connects to a UAPI socket as a user named by the
+// policy, from a copy of the test running as that user.
+func TestUAPIOpenWithPolicy(t *testing.T) {
+	if path := os.Getenv("WG_TEST_UAPI_DIAL"); path != "" {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		conn.Close()
+		os.Exit(0)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("not running as root")
+	}
+	const nobody = 65534
+
+	dir, err := os.MkdirTemp("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir string) { socketDirectory = dir }(socketDirectory)
+	socketDirectory = dir
+
+	// The test binary is copied where the other user can run it.
+	test, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "ipc.test")
+	if err := os.WriteFile(bin, test, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	dial := func(name string) error {
+		cmd := exec.Command(bin, "-test.run=^TestUAPIOpenWithPolicy$")
+		cmd.Env = append(os.Environ(), "WG_TEST_UAPI_DIAL="+sockPath(name))
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: nobody, Gid: nobody}}
+		out, err := cmd.CombinedOutput()
+		var exit *exec.ExitError
+		if err != nil && !errors.As(err, &exit) {
+			t.Skipf("cannot run the test as another user: %v", err)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return nil
+	}
+
+	// Without a policy, only the owner may connect.
+	file, err := UAPIOpen("nopolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := dial("nopolicy"); err == nil {
+		t.Error("connected to a socket without policy as another user")
+	}
+
+	policy := &AccessPolicy{ReadOnlyUIDs: []uint32{nobody}}
+	file, err = UAPIOpenWithPolicy("policy", policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uapi, err := UAPIListenWithPolicy("policy", file, policy)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uapi.Close()
+	if err := dial("policy"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := uapi.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if access := ConnAccess(conn); access != AccessReadOnly {
+		t.Errorf("connection of a read-only user has %v access", access)
+	}
+}
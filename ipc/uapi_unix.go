@@ -21,6 +21,7 @@ const (
 	IpcErrorProtocol  = -int64(unix.EPROTO)
 	IpcErrorInvalid   = -int64(unix.EINVAL)
 	IpcErrorPortInUse = -int64(unix.EADDRINUSE)
+	IpcErrorDenied    = -int64(unix.EPERM)
 	IpcErrorUnknown   = -55 // ENOANO
 )
 
@@ -33,6 +34,17 @@ func sockPath(iface string) string {
 }
 
 func UAPIOpen(name string) (*os.File, error) {
+	return UAPIOpenWithPolicy(name, nil)
+}
+
+// UAPIOpenWithPolicy is UAPIOpen for a listener with an access policy.
+// Without one, only the owner of the process may connect to the socket.
+// With one, anyone may, and the policy decides what they may do, so that
+// the users and groups it names can reach the socket at all.
+func UAPIOpenWithPolicy(name string, policy *AccessPolicy) (*os.File, error) {
+	if err := checkPolicy(policy); err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(socketDirectory, 0o755); err != nil {
 		return nil, err
 	}
@@ -47,20 +59,24 @@ func UAPIOpen(name string) (*os.File, error) {
 	defer unix.Umask(oldUmask)
 
 	listener, err := net.ListenUnix("unix", addr)
-	if err == nil {
-		return listener.File()
-	}
-
-	// Test socket, if not in use cleanup and try again.
-	if _, err := net.Dial("unix", socketPath); err == nil {
-		return nil, errors.New("unix socket in use")
-	}
-	if err := os.Remove(socketPath); err != nil {
-		return nil, err
-	}
-	listener, err = net.ListenUnix("unix", addr)
 	if err != nil {
-		return nil, err
+		// Test socket, if not in use cleanup and try again.
+		if _, err := net.Dial("unix", socketPath); err == nil {
+			return nil, errors.New("unix socket in use")
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+		listener, err = net.ListenUnix("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if policy != nil {
+		if err := os.Chmod(socketPath, 0o666); err != nil {
+			listener.Close()
+			return nil, err
+		}
 	}
 	return listener.File()
 }
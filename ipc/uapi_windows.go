@@ -18,6 +18,7 @@ const (
 	IpcErrorProtocol  = -int64(71)
 	IpcErrorInvalid   = -int64(22)
 	IpcErrorPortInUse = -int64(98)
+	IpcErrorDenied    = -int64(1)
 	IpcErrorUnknown   = -int64(55)
 )
 
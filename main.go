@@ -9,13 +9,17 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 
+	"golang.zx2c4.com/wireguard/conf"
 	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/control"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/ipc"
 	"golang.zx2c4.com/wireguard/tun"
@@ -30,10 +34,52 @@ const (
 	ENV_WG_TUN_FD             = "WG_TUN_FD"
 	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
 	ENV_WG_PROCESS_FOREGROUND = "WG_PROCESS_FOREGROUND"
+
+	// comma-separated IDs given access to the UAPI socket by an access policy
+	ENV_WG_UAPI_UIDS          = "WG_UAPI_UIDS"
+	ENV_WG_UAPI_GIDS          = "WG_UAPI_GIDS"
+	ENV_WG_UAPI_READONLY_UIDS = "WG_UAPI_READONLY_UIDS"
+	ENV_WG_UAPI_READONLY_GIDS = "WG_UAPI_READONLY_GIDS"
+
+	// directory the capture_file UAPI key writes packet captures into
+	ENV_WG_CAPTURE_DIR = "WG_CAPTURE_DIR"
 )
 
 func printUsage() {
-	fmt.Printf("Usage: %s [-f/--foreground] INTERFACE-NAME\n", os.Args[0])
+	fmt.Printf("Usage: %s [-f/--foreground] [--config FILE] [--control SOCKET] INTERFACE-NAME\n", os.Args[0])
+}
+
+// uapiPolicy returns the UAPI access policy set in the environment,
+// or nil if there is none.
+func uapiPolicy() (*ipc.AccessPolicy, error) {
+	policy := new(ipc.AccessPolicy)
+	set := false
+	for _, env := range []struct {
+		name string
+		ids  *[]uint32
+	}{
+		{ENV_WG_UAPI_UIDS, &policy.UIDs},
+		{ENV_WG_UAPI_GIDS, &policy.GIDs},
+		{ENV_WG_UAPI_READONLY_UIDS, &policy.ReadOnlyUIDs},
+		{ENV_WG_UAPI_READONLY_GIDS, &policy.ReadOnlyGIDs},
+	} {
+		value := os.Getenv(env.name)
+		if value == "" {
+			continue
+		}
+		set = true
+		for _, field := range strings.Split(value, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", env.name, err)
+			}
+			*env.ids = append(*env.ids, uint32(id))
+		}
+	}
+	if !set {
+		return nil, nil
+	}
+	return policy, nil
 }
 
 func warning() {
@@ -67,28 +113,40 @@ func main() {
 
 	var foreground bool
 	var interfaceName string
-	if len(os.Args) < 2 || len(os.Args) > 3 {
-		printUsage()
-		return
-	}
-
-	switch os.Args[1] {
-
-	case "-f", "--foreground":
-		foreground = true
-		if len(os.Args) != 3 {
-			printUsage()
-			return
-		}
-		interfaceName = os.Args[2]
-
-	default:
-		foreground = false
-		if len(os.Args) != 2 {
+	var configPath string
+	var controlAddr string
+	for args := os.Args[1:]; len(args) > 0; args = args[1:] {
+		switch arg := args[0]; {
+		case arg == "-f" || arg == "--foreground":
+			foreground = true
+		case arg == "--config":
+			if len(args) < 2 {
+				printUsage()
+				return
+			}
+			args = args[1:]
+			configPath = args[0]
+		case strings.HasPrefix(arg, "--config="):
+			configPath = strings.TrimPrefix(arg, "--config=")
+		case arg == "--control":
+			if len(args) < 2 {
+				printUsage()
+				return
+			}
+			args = args[1:]
+			controlAddr = args[0]
+		case strings.HasPrefix(arg, "--control="):
+			controlAddr = strings.TrimPrefix(arg, "--control=")
+		case interfaceName == "" && !strings.HasPrefix(arg, "-"):
+			interfaceName = arg
+		default:
 			printUsage()
 			return
 		}
-		interfaceName = os.Args[1]
+	}
+	if interfaceName == "" {
+		printUsage()
+		return
 	}
 
 	if !foreground {
@@ -109,6 +167,21 @@ func main() {
 		return device.LogLevelError
 	}()
 
+	// load the configuration file, reporting errors before daemonizing
+
+	loadConfig := func() (*device.DeviceConfig, error) {
+		return conf.Load(configPath)
+	}
+	var config, applied *device.DeviceConfig // the configuration loaded and the one last applied
+	if configPath != "" {
+		var err error
+		config, err = loadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
 	// open TUN device (or use supplied fd)
 
 	tun, err := func() (tun.Device, error) {
@@ -152,12 +225,21 @@ func main() {
 		os.Exit(ExitSetupFailed)
 	}
 
+	policy, err := uapiPolicy()
+	if err != nil {
+		logger.Errorf("Invalid UAPI access policy: %v", err)
+		os.Exit(ExitSetupFailed)
+	}
+	if policy != nil {
+		policy.Logf = logger.Errorf
+	}
+
 	// open UAPI file (or use supplied fd)
 
 	fileUAPI, err := func() (*os.File, error) {
 		uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
 		if uapiFdStr == "" {
-			return ipc.UAPIOpen(interfaceName)
+			return ipc.UAPIOpenWithPolicy(interfaceName, policy)
 		}
 
 		// use supplied fd
@@ -222,14 +304,39 @@ func main() {
 		return
 	}
 
-	device := device.NewDevice(tun, conn.NewDefaultBind(), logger)
+	var opts []device.Option
+	if dir := os.Getenv(ENV_WG_CAPTURE_DIR); dir != "" {
+		opts = append(opts, device.WithCaptureDir(dir))
+	}
+	device := device.NewDevice(tun, conn.NewDefaultBind(), logger, opts...)
 
 	logger.Verbosef("Device started")
 
+	// apply the configuration file, updating rather than replacing the peers
+
+	applyConfig := func() error {
+		running, err := device.Snapshot()
+		if err != nil {
+			return err
+		}
+		if err := device.Apply(conf.Sync(running, applied, config)); err != nil {
+			return err
+		}
+		applied = config
+		return nil
+	}
+	if config != nil {
+		if err := applyConfig(); err != nil {
+			logger.Errorf("Failed to apply configuration: %v", err)
+			os.Exit(ExitSetupFailed)
+		}
+		logger.Verbosef("Configuration applied from %s", configPath)
+	}
+
 	errs := make(chan error)
 	term := make(chan os.Signal, 1)
 
-	uapi, err := ipc.UAPIListen(interfaceName, fileUAPI)
+	uapi, err := ipc.UAPIListenWithPolicy(interfaceName, fileUAPI, policy)
 	if err != nil {
 		logger.Errorf("Failed to listen on uapi socket: %v", err)
 		os.Exit(ExitSetupFailed)
@@ -248,20 +355,65 @@ func main() {
 
 	logger.Verbosef("UAPI listener started")
 
+	// serve the JSON/HTTP control API
+
+	var controlServer *http.Server
+	if controlAddr != "" {
+		listener, err := control.Listen(controlAddr)
+		if err != nil {
+			logger.Errorf("Failed to listen on control address: %v", err)
+			os.Exit(ExitSetupFailed)
+		}
+		controlServer = &http.Server{Handler: control.NewHandler(device)}
+		go func() {
+			if err := controlServer.Serve(listener); err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+		logger.Verbosef("Control API listening on %s", controlAddr)
+	}
+
 	// wait for program to terminate
 
 	signal.Notify(term, syscall.SIGTERM)
 	signal.Notify(term, os.Interrupt)
 
-	select {
-	case <-term:
-	case <-errs:
-	case <-device.Wait():
+	// reload the configuration file on SIGHUP
+
+	hup := make(chan os.Signal, 1)
+	if configPath != "" {
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+
+wait:
+	for {
+		select {
+		case <-hup:
+			newConfig, err := loadConfig()
+			if err == nil {
+				config = newConfig
+				err = applyConfig()
+			}
+			if err != nil {
+				logger.Errorf("Failed to reload configuration: %v", err)
+				continue
+			}
+			logger.Verbosef("Configuration reloaded from %s", configPath)
+		case <-term:
+			break wait
+		case <-errs:
+			break wait
+		case <-device.Wait():
+			break wait
+		}
 	}
 
 	// clean up
 
 	uapi.Close()
+	if controlServer != nil {
+		controlServer.Close()
+	}
 	device.Close()
 
 	logger.Verbosef("Shutting down")
@@ -9,27 +9,68 @@ package replay
 type block uint64
 
 const (
-	blockBitLog = 6                // 1<<6 == 64 bits
-	blockBits   = 1 << blockBitLog // must be power of 2
-	ringBlocks  = 1 << 7           // must be power of 2
-	windowSize  = (ringBlocks - 1) * blockBits
-	blockMask   = ringBlocks - 1
-	bitMask     = blockBits - 1
+	blockBitLog   = 6                // 1<<6 == 64 bits
+	blockBits     = 1 << blockBitLog // must be power of 2
+	ringBlocks    = 1 << 7           // must be power of 2
+	maxRingBlocks = 1 << 16          // must be power of 2
+	windowSize    = (ringBlocks - 1) * blockBits
+	blockMask     = ringBlocks - 1
+	bitMask       = blockBits - 1
+)
+
+const (
+	// DefaultWindowSize is the window size of the zero Filter, in messages.
+	DefaultWindowSize = windowSize
+
+	// MaxWindowSize is the largest window size of a Filter, in messages.
+	MaxWindowSize = (maxRingBlocks - 1) * blockBits
 )
 
 // A Filter rejects replayed messages by checking if message counter value is
 // within a sliding window of previously received messages.
-// The zero value for Filter is an empty filter ready to use.
+// The zero value for Filter is an empty filter ready to use,
+// with a window of DefaultWindowSize messages.
 // Filters are unsafe for concurrent use.
 type Filter struct {
 	last uint64
-	ring [ringBlocks]block
+	ring []block // nil when using base
+	base [ringBlocks]block
 }
 
 // Reset resets the filter to empty state.
 func (f *Filter) Reset() {
 	f.last = 0
-	f.ring[0] = 0
+	f.base[0] = 0
+	if f.ring != nil {
+		f.ring[0] = 0
+	}
+}
+
+// SetWindowSize resets the filter and sets its window to at least size
+// messages. The window is rounded up to a power of two blocks of 64 messages,
+// and clamped between DefaultWindowSize and MaxWindowSize.
+// Only windows larger than DefaultWindowSize allocate, once.
+func (f *Filter) SetWindowSize(size uint64) {
+	blocks := uint64(ringBlocks)
+	for blocks < maxRingBlocks && (blocks-1)*blockBits < size {
+		blocks <<= 1
+	}
+	switch {
+	case blocks == ringBlocks:
+		f.ring = nil
+	case uint64(len(f.ring)) != blocks:
+		f.ring = make([]block, blocks)
+	}
+	f.Reset()
+}
+
+// WindowSize returns the number of messages behind the highest counter
+// that the filter can still accept.
+func (f *Filter) WindowSize() uint64 {
+	if f.ring == nil {
+		return windowSize
+	}
+	return uint64(len(f.ring)-1) * blockBits
 }
 
 // ValidateCounter checks if the counter should be accepted.
@@ -38,25 +79,31 @@ func (f *Filter) ValidateCounter(counter, limit uint64) bool {
 	if counter >= limit {
 		return false
 	}
+	ring := f.ring
+	if ring == nil {
+		ring = f.base[:]
+	}
+	blocks := uint64(len(ring))
+	mask := blocks - 1
 	indexBlock := counter >> blockBitLog
 	if counter > f.last { // move window forward
 		current := f.last >> blockBitLog
 		diff := indexBlock - current
-		if diff > ringBlocks {
-			diff = ringBlocks // cap diff to clear the whole ring
+		if diff > blocks {
+			diff = blocks // cap diff to clear the whole ring
 		}
 		for i := current + 1; i <= current+diff; i++ {
-			f.ring[i&blockMask] = 0
+			ring[i&mask] = 0
 		}
 		f.last = counter
-	} else if f.last-counter > windowSize { // behind current window
+	} else if f.last-counter > mask*blockBits { // behind current window
 		return false
 	}
 	// check and set bit
-	indexBlock &= blockMask
+	indexBlock &= mask
 	indexBit := counter & bitMask
-	old := f.ring[indexBlock]
+	old := ring[indexBlock]
 	new := old | 1<<indexBit
-	f.ring[indexBlock] = new
+	ring[indexBlock] = new
 	return old != new
 }
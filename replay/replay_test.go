@@ -18,8 +18,46 @@ const RejectAfterMessages = 1<<64 - 1<<13 - 1
 
 func TestReplay(t *testing.T) {
 	var filter Filter
+	testReplay(t, &filter)
+}
+
+func TestReplayWindowSizes(t *testing.T) {
+	var filter Filter
+	for _, test := range []struct {
+		size, want uint64
+	}{
+		{0, DefaultWindowSize},
+		{DefaultWindowSize, DefaultWindowSize},
+		{DefaultWindowSize + 1, 255 * blockBits},
+		{1 << 20, 32767 * blockBits},
+		{MaxWindowSize, MaxWindowSize},
+		{1 << 40, MaxWindowSize},
+	} {
+		filter.SetWindowSize(test.size)
+		if got := filter.WindowSize(); got != test.want {
+			t.Fatalf("window size %d gave %d, want %d", test.size, got, test.want)
+		}
+		testReplay(t, &filter)
+	}
+}
+
+func TestReplayNoAllocs(t *testing.T) {
+	var filter Filter
+	filter.SetWindowSize(MaxWindowSize)
+	counter := uint64(0)
+	allocs := testing.AllocsPerRun(1000, func() {
+		counter += 1000
+		filter.ValidateCounter(counter, RejectAfterMessages)
+		filter.ValidateCounter(counter-MaxWindowSize/2, RejectAfterMessages)
+	})
+	if allocs != 0 {
+		t.Errorf("ValidateCounter allocates %v times", allocs)
+	}
+}
 
-	const T_LIM = windowSize + 1
+func testReplay(t *testing.T, filter *Filter) {
+	windowSize := filter.WindowSize()
+	T_LIM := windowSize + 1
 
 	testNumber := 0
 	T := func(n uint64, expected bool) {
@@ -87,14 +125,14 @@ func TestReplay(t *testing.T) {
 	t.Log("Bulk test 3")
 	filter.Reset()
 	testNumber = 0
-	for i := uint64(windowSize + 1); i > 0; i-- {
+	for i := windowSize + 1; i > 0; i-- {
 		T(i, true)
 	}
 
 	t.Log("Bulk test 4")
 	filter.Reset()
 	testNumber = 0
-	for i := uint64(windowSize + 2); i > 1; i-- {
+	for i := windowSize + 2; i > 1; i-- {
 		T(i, true)
 	}
 	T(0, false)
@@ -102,7 +140,7 @@ func TestReplay(t *testing.T) {
 	t.Log("Bulk test 5")
 	filter.Reset()
 	testNumber = 0
-	for i := uint64(windowSize); i > 0; i-- {
+	for i := windowSize; i > 0; i-- {
 		T(i, true)
 	}
 	T(windowSize+1, true)
@@ -111,9 +149,39 @@ func TestReplay(t *testing.T) {
 	t.Log("Bulk test 6")
 	filter.Reset()
 	testNumber = 0
-	for i := uint64(windowSize); i > 0; i-- {
+	for i := windowSize; i > 0; i-- {
 		T(i, true)
 	}
 	T(0, true)
 	T(windowSize+1, true)
 }
+
+func benchmarkReplay(b *testing.B, size uint64) {
+	var filter Filter
+	filter.SetWindowSize(size)
+	window := filter.WindowSize()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Advance by one and accept a message reordered across half the window.
+		counter := window + uint64(i)
+		filter.ValidateCounter(counter, RejectAfterMessages)
+		filter.ValidateCounter(counter-window/2, RejectAfterMessages)
+	}
+}
+
+func BenchmarkReplayDefault(b *testing.B) { benchmarkReplay(b, DefaultWindowSize) }
+func BenchmarkReplay64K(b *testing.B)     { benchmarkReplay(b, 1<<16) }
+func BenchmarkReplay1M(b *testing.B)      { benchmarkReplay(b, 1<<20) }
+func BenchmarkReplayMax(b *testing.B)     { benchmarkReplay(b, MaxWindowSize) }
+
+func BenchmarkReplayJump(b *testing.B) {
+	// Jumps past the whole window clear the entire ring.
+	var filter Filter
+	filter.SetWindowSize(MaxWindowSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter.ValidateCounter(uint64(i+1)*(MaxWindowSize+blockBits), RejectAfterMessages)
+	}
+}
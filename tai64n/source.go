@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tai64n
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultLease is how far ahead of the timestamps it hands out
+// a Source persists its high-water mark.
+const DefaultLease = time.Minute
+
+// A Store persists the high-water mark of a Source across restarts.
+type Store interface {
+	// Load returns the stored high-water mark,
+	// or the zero Timestamp if none was stored yet.
+	Load() (Timestamp, error)
+	Store(Timestamp) error
+}
+
+// A Source hands out strictly increasing timestamps, even when the wall
+// clock goes backwards. With a Store, this holds across restarts: the Source
+// persists a high-water mark a lease ahead of the timestamps it hands out,
+// and never hands out timestamps below the stored mark.
+// It is safe for concurrent use.
+type Source struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	store     Store
+	last      Timestamp // last timestamp handed out
+	persisted Timestamp // high-water mark in store
+}
+
+// NewSource returns a Source reading the wall clock from now,
+// or time.Now if now is nil, and persisting its high-water mark to store,
+// if it is not nil.
+func NewSource(store Store, now func() time.Time) (*Source, error) {
+	if now == nil {
+		now = time.Now
+	}
+	s := &Source{now: now, store: store}
+	if store != nil {
+		mark, err := store.Load()
+		if err != nil {
+			return nil, err
+		}
+		s.last, s.persisted = mark, mark
+	}
+	return s, nil
+}
+
+// Now returns a timestamp after all the timestamps handed out before.
+// It fails if the high-water mark could not be persisted.
+func (s *Source) Now() (Timestamp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := stamp(s.now())
+	if !t.After(s.last) {
+		t = s.last.next()
+	}
+	if s.store != nil && t.After(s.persisted) {
+		mark := stamp(t.time().Add(DefaultLease))
+		if err := s.store.Store(mark); err != nil {
+			return Timestamp{}, err
+		}
+		s.persisted = mark
+	}
+	s.last = t
+	return t, nil
+}
+
+// Advance makes the source hand out timestamps after t from now on.
+func (s *Source) Advance(t Timestamp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.After(s.last) {
+		s.last = t
+	}
+}
+
+// Last returns the last timestamp handed out.
+func (s *Source) Last() Timestamp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// A FileStore is a Store keeping the high-water mark in a file.
+type FileStore string
+
+// Load reads the high-water mark from the file.
+func (path FileStore) Load() (Timestamp, error) {
+	var t Timestamp
+	b, err := os.ReadFile(string(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return t, err
+	}
+	if len(b) != TimestampSize {
+		return t, errors.New("tai64n: invalid timestamp file " + string(path))
+	}
+	copy(t[:], b)
+	return t, nil
+}
+
+// Store replaces the high-water mark in the file atomically.
+func (path FileStore) Store(t Timestamp) error {
+	tmp, err := os.CreateTemp(filepath.Dir(string(path)), "."+filepath.Base(string(path))+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(t[:]); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), string(path))
+}
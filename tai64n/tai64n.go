@@ -37,5 +37,22 @@ func (t1 Timestamp) After(t2 Timestamp) bool {
 }
 
 func (t Timestamp) String() string {
-	return time.Unix(int64(binary.BigEndian.Uint64(t[:8])-base), int64(binary.BigEndian.Uint32(t[8:12]))).String()
+	return t.time().String()
+}
+
+func (t Timestamp) time() time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint64(t[:8])-base), int64(binary.BigEndian.Uint32(t[8:12])))
+}
+
+// next returns the smallest whitened timestamp after t.
+func (t Timestamp) next() Timestamp {
+	secs := binary.BigEndian.Uint64(t[:8])
+	nano := binary.BigEndian.Uint32(t[8:]) + whitenerMask + 1
+	if nano >= uint32(time.Second) {
+		secs++
+		nano = 0
+	}
+	binary.BigEndian.PutUint64(t[:8], secs)
+	binary.BigEndian.PutUint32(t[8:], nano)
+	return t
 }
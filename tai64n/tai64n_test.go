@@ -6,6 +6,7 @@
 package tai64n
 
 import (
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -38,3 +39,75 @@ func TestMonotonic(t *testing.T) {
 		})
 	}
 }
+
+type memoryStore struct {
+	mark   Timestamp
+	stores int
+}
+
+func (s *memoryStore) Load() (Timestamp, error) { return s.mark, nil }
+
+func (s *memoryStore) Store(t Timestamp) error {
+	s.mark = t
+	s.stores++
+	return nil
+}
+
+func TestSourceMonotonic(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	store := new(memoryStore)
+	source, err := NewSource(store, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last Timestamp
+	for i, step := range []time.Duration{0, 0, time.Millisecond, -time.Hour, time.Second, 2 * time.Hour} {
+		now = now.Add(step)
+		ts, err := source.Now()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ts.After(last) {
+			t.Errorf("timestamp %d %v not after %v", i, ts, last)
+		}
+		last = ts
+		if !store.mark.After(ts) {
+			t.Errorf("high-water mark %v not after timestamp %d %v", store.mark, i, ts)
+		}
+	}
+	if store.stores != 2 {
+		t.Errorf("high-water mark stored %d times, want 2", store.stores)
+	}
+
+	// A restarted source continues after the stored mark,
+	// even when the clock went back.
+	now = now.Add(-24 * time.Hour)
+	source, err = NewSource(store, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := source.Now()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.After(last) {
+		t.Errorf("timestamp after restart %v not after %v", ts, last)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	store := FileStore(filepath.Join(t.TempDir(), "timestamp"))
+	mark, err := store.Load()
+	if err != nil || mark != (Timestamp{}) {
+		t.Fatalf("Load of missing file = %v, %v", mark, err)
+	}
+	want := stamp(time.Unix(1700000000, 0))
+	if err := store.Store(want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Load(); err != nil || got != want {
+		t.Errorf("Load = %v, %v; want %v", got, err, want)
+	}
+}